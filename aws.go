@@ -1,198 +1,180 @@
 package main
 
 import (
-	"encoding/json"
-	"os"
-	"os/exec"
-	"strconv"
-
+	"context"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/lightsail"
+	lightsailtypes "github.com/aws/aws-sdk-go-v2/service/lightsail/types"
 	"github.com/fatih/color"
 	"github.com/urfave/cli/v2"
-	"github.com/xuri/excelize/v2"
 )
 
-func listInstances() {
-	var lightsailInstancesJSON map[string]interface{} = getLightsailInstancesAsJSON()
-	var ec2InstancesJSON map[string]interface{} = getEC2InstancesAsJSON()
+// AWSResult is the result of the matrix aws command
+type AWSResult struct {
+	Instances   []Instance       `json:"instances,omitempty"`
+	Errors      []InventoryError `json:"errors,omitempty"`
+	Spreadsheet string           `json:"spreadsheet,omitempty"`
+	Export      string           `json:"export,omitempty"`
+}
+
+// getInventory collects the inventory across the profiles and regions given
+// with --profile and --region, or configured in ~/.matrix/config. With
+// resources it also collects volumes, buckets and static IPs.
+func getInventory(ctx context.Context, cCtx *cli.Context, resources bool) (Inventory, error) {
+	var profiles, regions []string
+
+	if cCtx != nil {
+		profiles = cCtx.StringSlice("profile")
+		regions = cCtx.StringSlice("region")
+	}
+
+	targets, err := inventoryTargets(profiles, regions)
+	if err != nil {
+		return Inventory{}, err
+	}
+
+	inventory, err := collectInventoryAcross(ctx, targets, resources)
+
+	for _, inventoryErr := range inventory.Errors {
+		color.Yellow("× Skipped " + inventoryErr.Profile + " " + inventoryErr.Region + ": " + inventoryErr.Error)
+	}
+
+	return inventory, err
+}
+
+func listInstances(cCtx *cli.Context) (Inventory, error) {
+	inventory, err := getInventory(context.Background(), cCtx, false)
+	if err != nil {
+		return inventory, err
+	}
 
 	color.Magenta("EC2 Instances:")
 
 	// Loop through ec2 instances
-	for _, reservation := range ec2InstancesJSON["Reservations"].([]interface{}) {
-		reservation := reservation.(map[string]interface{})
-		for _, instance := range reservation["Instances"].([]interface{}) {
-			instance := instance.(map[string]interface{})
-			color.White("  - " + instance["InstanceId"].(string))
-
-			if instance["State"].(map[string]interface{})["Name"].(string) == "running" {
-				color.Green("    - Status: " + instance["State"].(map[string]interface{})["Name"].(string))
-			} else {
-				color.Red("    - Status: " + instance["State"].(map[string]interface{})["Name"].(string))
-			}
-
-			color.White("    - Public IP: " + instance["PublicIpAddress"].(string))
-			color.White("    - Private IP: " + instance["PrivateIpAddress"].(string))
+	for _, instance := range inventory.Instances {
+		if instance.Provider == ProviderEC2 {
+			printInstance(instance)
 		}
 	}
 
 	color.Magenta("Lightsail Instances:")
 
 	// Loop through lightsail instances
-	for _, instance := range lightsailInstancesJSON["instances"].([]interface{}) {
-		instance := instance.(map[string]interface{})
-		color.White("  - " + instance["name"].(string))
-
-		if instance["state"].(map[string]interface{})["name"].(string) == "running" {
-			color.Green("    - Status: " + instance["state"].(map[string]interface{})["name"].(string))
-		} else {
-			color.Red("    - Status: " + instance["state"].(map[string]interface{})["name"].(string))
+	for _, instance := range inventory.Instances {
+		if instance.Provider == ProviderLightsail {
+			printInstance(instance)
 		}
-
-		color.White("    - Public IP: " + instance["publicIpAddress"].(string))
-		color.White("    - Private IP: " + instance["privateIpAddress"].(string))
 	}
+
+	return inventory, nil
 }
 
-func createSpreadsheetOfInstances(cCtx *cli.Context) {
-	s.Suffix = " Creating spreadsheet of AWS instances..."
-	s.Start()
+func printInstance(instance Instance) {
+	if instance.Name != instance.ID {
+		color.White("  - " + instance.Name + " (" + instance.ID + ")")
+	} else {
+		color.White("  - " + instance.Name)
+	}
 
-	var lightsailInstancesJSON map[string]interface{} = getLightsailInstancesAsJSON()
-	var ec2InstancesJSON map[string]interface{} = getEC2InstancesAsJSON()
+	if instance.State == "running" {
+		color.Green("    - Status: " + instance.State)
+	} else {
+		color.Red("    - Status: " + instance.State)
+	}
 
-	// Create a new spreadsheet
-	f := excelize.NewFile()
+	color.White("    - Public IP: " + valueOr(instance.PublicIP, "-"))
+	color.White("    - Private IP: " + valueOr(instance.PrivateIP, "-"))
+	color.White("    - Region: " + instance.Region + " (Account " + valueOr(instance.Account, "-") + ")")
+}
 
-	// Create a new sheet
-	index, err := f.NewSheet("Sheet1")
-	if err != nil {
-		color.Red("× Error Creating Spreadsheet: " + err.Error())
-		os.Exit(1)
-	}
+// getLightsailInstances returns every Lightsail instance in the client's region
+func getLightsailInstances(ctx context.Context, client *AWSClient) ([]lightsailtypes.Instance, error) {
+	var instances []lightsailtypes.Instance
 
-	// Add data
-	f.SetCellValue("Sheet1", "A1", "EC2 or Lightsail")
-	f.SetCellValue("Sheet1", "B1", "Name")
-	f.SetCellValue("Sheet1", "C1", "Status")
-	f.SetCellValue("Sheet1", "D1", "Instance Type")
-	f.SetCellValue("Sheet1", "E1", "Public IP")
-	f.SetCellValue("Sheet1", "F1", "Private IP")
-	f.SetCellValue("Sheet1", "G1", "CPUs")
-	f.SetCellValue("Sheet1", "H1", "RAM")
-	f.SetCellValue("Sheet1", "I1", "Disk")
-	f.SetCellValue("Sheet1", "J1", "Region")
+	input := &lightsail.GetInstancesInput{}
 
-	// Loop through lightsail instances
-	for i, instance := range lightsailInstancesJSON["instances"].([]interface{}) {
-		instance := instance.(map[string]interface{})
-		f.SetCellValue("Sheet1", "A"+strconv.Itoa(i+2), "Lightsail")
-		f.SetCellValue("Sheet1", "B"+strconv.Itoa(i+2), instance["name"].(string))
-		f.SetCellValue("Sheet1", "C"+strconv.Itoa(i+2), instance["state"].(map[string]interface{})["name"].(string))
-		f.SetCellValue("Sheet1", "D"+strconv.Itoa(i+2), instance["bundleId"].(string))
-		f.SetCellValue("Sheet1", "E"+strconv.Itoa(i+2), instance["publicIpAddress"].(string))
-		f.SetCellValue("Sheet1", "F"+strconv.Itoa(i+2), instance["privateIpAddress"].(string))
-		f.SetCellValue("Sheet1", "G"+strconv.Itoa(i+2), instance["hardware"].(map[string]interface{})["cpuCount"].(float64))
-		f.SetCellValue("Sheet1", "H"+strconv.Itoa(i+2), instance["hardware"].(map[string]interface{})["ramSizeInGb"].(float64))
-
-		// Disk size
-		var diskSize float64
-		for _, disk := range instance["hardware"].(map[string]interface{})["disks"].([]interface{}) {
-			disk := disk.(map[string]interface{})
-			diskSize += disk["sizeInGb"].(float64)
+	for {
+		out, err := client.Lightsail.GetInstances(ctx, input)
+		if err != nil {
+			return nil, awsError("lightsail get-instances", err)
 		}
-		f.SetCellValue("Sheet1", "I"+strconv.Itoa(i+2), strconv.FormatFloat(diskSize, 'f', 0, 64)+" GB")
 
-		f.SetCellValue("Sheet1", "J"+strconv.Itoa(i+2), instance["location"].(map[string]interface{})["availabilityZone"].(string))
-	}
+		instances = append(instances, out.Instances...)
 
-	// Loop through ec2 instances and add on to the end of the lightsail instances
-	for i, reservation := range ec2InstancesJSON["Reservations"].([]interface{}) {
-		reservation := reservation.(map[string]interface{})
-		for _, instance := range reservation["Instances"].([]interface{}) {
-			instance := instance.(map[string]interface{})
-			f.SetCellValue("Sheet1", "A"+strconv.Itoa(i+2), "EC2")
-			f.SetCellValue("Sheet1", "B"+strconv.Itoa(i+2), instance["InstanceId"].(string))
-			f.SetCellValue("Sheet1", "C"+strconv.Itoa(i+2), instance["State"].(map[string]interface{})["Name"].(string))
-			f.SetCellValue("Sheet1", "D"+strconv.Itoa(i+2), instance["InstanceType"].(string))
-			f.SetCellValue("Sheet1", "E"+strconv.Itoa(i+2), instance["PublicIpAddress"].(string))
-			f.SetCellValue("Sheet1", "F"+strconv.Itoa(i+2), instance["PrivateIpAddress"].(string))
-			f.SetCellValue("Sheet1", "G"+strconv.Itoa(i+2), instance["CpuOptions"].(map[string]interface{})["CoreCount"].(float64))
+		if aws.ToString(out.NextPageToken) == "" {
+			break
 		}
-	}
 
-	// Set active sheet of the workbook
-	f.SetActiveSheet(index)
-
-	// Set column widths
-	f.SetColWidth("Sheet1", "A", "A", 15)
-	f.SetColWidth("Sheet1", "B", "B", 20)
-	f.SetColWidth("Sheet1", "C", "C", 15)
-	f.SetColWidth("Sheet1", "D", "D", 15)
-	f.SetColWidth("Sheet1", "E", "E", 15)
-	f.SetColWidth("Sheet1", "F", "F", 15)
-	f.SetColWidth("Sheet1", "G", "G", 10)
-	f.SetColWidth("Sheet1", "H", "H", 10)
-	f.SetColWidth("Sheet1", "I", "I", 10)
-	f.SetColWidth("Sheet1", "J", "J", 15)
-
-	// Set row heights
-	for i := 1; i <= len(ec2InstancesJSON["Reservations"].([]interface{}))+len(lightsailInstancesJSON["instances"].([]interface{}))+1; i++ {
-		f.SetRowHeight("Sheet1", i, 20)
+		input.PageToken = out.NextPageToken
 	}
 
-	// Save spreadsheet
-	if err := f.SaveAs("aws-instances.xlsx"); err != nil {
-		color.Red("× Error Saving Spreadsheet: " + err.Error())
-		os.Exit(1)
-	}
+	return instances, nil
+}
 
-	color.Magenta("--------------------------------------------------")
-	color.Magenta("🎉   SPREADSHEET CREATED: aws-instances.xlsx    🎉")
-	color.Magenta("--------------------------------------------------")
+// getEC2Instances returns every EC2 instance in the client's region, flattened
+// out of their reservations
+func getEC2Instances(ctx context.Context, client *AWSClient) ([]ec2types.Instance, error) {
+	return describeEC2Instances(ctx, client, &ec2.DescribeInstancesInput{})
 }
 
-func getLightsailInstancesAsJSON() map[string]interface{} {
-	// Run aws lightsail get-instances
-	cmd := exec.Command("aws", "lightsail", "get-instances", "--profile", "matrix")
-	out, err := cmd.Output()
-	if err != nil {
-		color.Red("× Error Running: " + cmd.String())
-		color.Red("× " + err.Error())
-		os.Exit(1)
+func describeEC2Instances(ctx context.Context, client *AWSClient, input *ec2.DescribeInstancesInput) ([]ec2types.Instance, error) {
+	var instances []ec2types.Instance
+
+	paginator := ec2.NewDescribeInstancesPaginator(client.EC2, input)
+
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, awsError("ec2 describe-instances", err)
+		}
+
+		for _, reservation := range out.Reservations {
+			instances = append(instances, reservation.Instances...)
+		}
 	}
-	lightsailInstances := string(out)
 
-	// Convert output to json
-	var lightsailInstancesJSON map[string]interface{}
-	err = json.Unmarshal([]byte(lightsailInstances), &lightsailInstancesJSON)
+	return instances, nil
+}
+
+// findProjectInstance finds the instance a project is deployed to, by the Name
+// tag deploy gives EC2 instances or by the Lightsail instance name. Terminated
+// instances are ignored.
+func findProjectInstance(ctx context.Context, cCtx *cli.Context, project string) (Instance, error) {
+	inventory, err := getInventory(ctx, cCtx, false)
 	if err != nil {
-		color.Red("× Error Parsing JSON: " + err.Error())
-		os.Exit(1)
+		return Instance{}, err
 	}
 
-	s.Stop()
-
-	return lightsailInstancesJSON
+	return matchProjectInstance(inventory.Instances, project)
 }
 
-func getEC2InstancesAsJSON() map[string]interface{} {
-	// Run aws ec2 describe-instances
-	cmd := exec.Command("aws", "ec2", "describe-instances", "--profile", "matrix")
-	out, err := cmd.Output()
-	if err != nil {
-		color.Red("× Error Running: " + cmd.String())
-		color.Red("× " + err.Error())
-		os.Exit(1)
+func matchProjectInstance(instances []Instance, project string) (Instance, error) {
+	var matches []Instance
+
+	for _, instance := range instances {
+		if instance.Name != project || instance.State == "terminated" || instance.State == "shutting-down" {
+			continue
+		}
+
+		matches = append(matches, instance)
 	}
-	ec2Instances := string(out)
 
-	// Convert output to json
-	var ec2InstancesJSON map[string]interface{}
-	err = json.Unmarshal([]byte(ec2Instances), &ec2InstancesJSON)
-	if err != nil {
-		color.Red("× Error Parsing JSON: " + err.Error())
-		os.Exit(1)
+	if len(matches) == 0 {
+		return Instance{}, newError(ErrInstanceNotFound, project, nil)
+	}
+
+	if len(matches) > 1 {
+		var found []string
+		for _, instance := range matches {
+			found = append(found, instance.ID+" ("+instance.Provider+" "+instance.Region+" "+valueOr(instance.Profile, "-")+")")
+		}
+
+		return Instance{}, newError(ErrAmbiguousInstance, project+": "+strings.Join(found, ", "), nil)
 	}
 
-	return ec2InstancesJSON
+	return matches[0], nil
 }
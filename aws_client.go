@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/ssocreds"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/lightsail"
+	"github.com/aws/aws-sdk-go-v2/service/route53"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go"
+)
+
+// The AWS profile that matrix configure writes to ~/.aws/config
+var AWSProfile string = "matrix"
+
+// AWSClient holds the AWS service clients for a single profile and region.
+//
+// Credentials come from the usual AWS SDK chain using AWSProfile, which is the
+// SSO profile set up by matrix configure, unless AWS_ACCESS_KEY_ID is set.
+// Setting AWS_ENDPOINT_URL points every service at a local stand-in such as
+// LocalStack.
+type AWSClient struct {
+	Profile string
+	Region  string
+
+	EC2       *ec2.Client
+	KMS       *kms.Client
+	Lightsail *lightsail.Client
+	Route53   *route53.Client
+	S3        *s3.Client
+	SSM       *ssm.Client
+	STS       *sts.Client
+}
+
+// newAWSClient loads the AWS config for profile, optionally overriding the
+// region the profile defaults to
+func newAWSClient(ctx context.Context, profile string, region string) (*AWSClient, error) {
+	var options []func(*config.LoadOptions) error
+
+	// Keys in the environment (CI, local stand-ins) win over the SSO profile
+	if profile != "" && os.Getenv("AWS_ACCESS_KEY_ID") == "" {
+		options = append(options, config.WithSharedConfigProfile(profile))
+	}
+
+	if region != "" {
+		options = append(options, config.WithRegion(region))
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, options...)
+	if err != nil {
+		var profileErr config.SharedConfigProfileNotExistError
+		if errors.As(err, &profileErr) {
+			return nil, newError(ErrConfig, "AWS profile '"+profile+"' not found, run 'matrix configure'", err)
+		}
+
+		return nil, newError(ErrConfig, "loading AWS config", err)
+	}
+
+	// Local stand-ins don't support virtual hosted buckets
+	usePathStyle := os.Getenv("AWS_ENDPOINT_URL") != "" || os.Getenv("AWS_ENDPOINT_URL_S3") != ""
+
+	return &AWSClient{
+		Profile:   profile,
+		Region:    cfg.Region,
+		EC2:       ec2.NewFromConfig(cfg),
+		KMS:       kms.NewFromConfig(cfg),
+		Lightsail: lightsail.NewFromConfig(cfg),
+		Route53:   route53.NewFromConfig(cfg),
+		S3: s3.NewFromConfig(cfg, func(o *s3.Options) {
+			o.UsePathStyle = usePathStyle
+		}),
+		SSM: ssm.NewFromConfig(cfg),
+		STS: sts.NewFromConfig(cfg),
+	}, nil
+}
+
+// awsChange makes an AWS API call that changes something. It goes through the
+// executor like any other command so --dry-run skips it and --record logs it.
+// args describe the call the same way the equivalent aws CLI command would.
+func awsChange(args []string, call func() error) error {
+	return executor.Call(append([]string{"aws"}, args...), call)
+}
+
+// API error codes grouped by what matrix does about them
+var (
+	awsAuthErrorCodes = []string{
+		"ExpiredToken",
+		"ExpiredTokenException",
+		"InvalidClientTokenId",
+		"UnrecognizedClientException",
+		"AuthFailure",
+		"InvalidGrantException",
+	}
+	awsThrottleErrorCodes = []string{
+		"Throttling",
+		"ThrottlingException",
+		"RequestLimitExceeded",
+		"TooManyRequestsException",
+		"SlowDown",
+	}
+	awsAccessDeniedErrorCodes = []string{
+		"AccessDenied",
+		"AccessDeniedException",
+		"UnauthorizedOperation",
+		"UnauthorizedAccess",
+	}
+)
+
+// awsError wraps an error from the AWS SDK with the kind that matches the
+// underlying API error
+func awsError(operation string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var tokenErr *ssocreds.InvalidTokenError
+	if errors.As(err, &tokenErr) {
+		return newError(ErrAWSAuthExpired, operation, err)
+	}
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		code := apiErr.ErrorCode()
+
+		switch {
+		case slices.Contains(awsAuthErrorCodes, code):
+			return newError(ErrAWSAuthExpired, operation, err)
+		case slices.Contains(awsThrottleErrorCodes, code):
+			return newError(ErrAWSThrottled, operation, err)
+		case slices.Contains(awsAccessDeniedErrorCodes, code):
+			return newError(ErrAWSAccessDenied, operation, err)
+		}
+	}
+
+	// Credential errors happen before any API call is made
+	message := err.Error()
+	if strings.Contains(message, "SSO") && (strings.Contains(message, "expired") || strings.Contains(message, "refresh")) {
+		return newError(ErrAWSAuthExpired, operation, err)
+	}
+	if strings.Contains(message, "failed to retrieve credentials") || strings.Contains(message, "no EC2 IMDS role found") {
+		return newError(ErrAWSAuthExpired, operation, err)
+	}
+
+	return newError(ErrAWS, operation, err)
+}
+
+// checkAWSAuth confirms the profile has working credentials and returns the
+// ARN they belong to
+func checkAWSAuth(ctx context.Context, client *AWSClient) (string, error) {
+	identity, err := client.STS.GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", awsError("sts get-caller-identity", err)
+	}
+
+	return aws.ToString(identity.Arn), nil
+}
+
+// getAWSAccountID returns the ID of the account the client's credentials are for
+func getAWSAccountID(ctx context.Context, client *AWSClient) (string, error) {
+	identity, err := client.STS.GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", awsError("sts get-caller-identity", err)
+	}
+
+	return aws.ToString(identity.Account), nil
+}
@@ -1,26 +1,61 @@
 package main
 
 import (
-	"log"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
 	"os"
 	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
 	"github.com/fatih/color"
 	"github.com/joho/godotenv"
 	"github.com/urfave/cli/v2"
 )
 
-func backup(cCtx *cli.Context) {
+// BackupUpload is a single archive uploaded by matrix backup
+type BackupUpload struct {
+	Key        string `json:"key"`
+	URL        string `json:"url"`
+	Size       int64  `json:"size"`
+	Encryption string `json:"encryption,omitempty"`
+	KeyID      string `json:"keyId,omitempty"`
+}
+
+// BackupSet is the database and files archives of one backup, which share
+// the timestamp in their names
+type BackupSet struct {
+	Timestamp string         `json:"timestamp"`
+	Time      time.Time      `json:"time"`
+	Archives  []BackupUpload `json:"archives"`
+}
+
+// How backups are timestamped in their names
+const backupTimeFormat = "2006-01-02-15-04-05"
+
+// BackupResult is the result of matrix backup
+type BackupResult struct {
+	Project string         `json:"project"`
+	Bucket  string         `json:"bucket"`
+	Uploads []BackupUpload `json:"uploads"`
+	DryRun  bool           `json:"dryRun,omitempty"`
+}
+
+func backup(cCtx *cli.Context) error {
 	color.Magenta("Backing up project to AWS S3")
 
 	// Check if mysql is installed or exit
 	cmd := exec.Command("mysql", "--version")
-	_, err := cmd.Output()
+	_, err := executor.Lookup(cmd)
 	if err != nil {
-		color.Red("× Error Running: " + cmd.String())
-		color.Red("× " + err.Error())
-		os.Exit(1)
+		return commandError(ErrToolNotInstalled, cmd, err)
 	}
 
 	color.Green("✓ MySQL is installed")
@@ -28,10 +63,12 @@ func backup(cCtx *cli.Context) {
 	// Get project name
 	ProjectName = cCtx.Args().First()
 	if ProjectName == "" {
-		color.Red("× Error: Missing project name")
-		os.Exit(1)
+		return newError(ErrMissingProjectName, "", nil)
 	}
 
+	var dump *exec.Cmd
+	var dumpSize int64
+
 	// Check if project is craft
 	if fileExists("./craft") {
 		ProjectType = "craft"
@@ -40,14 +77,13 @@ func backup(cCtx *cli.Context) {
 
 		// check if .env file
 		if !fileExists("./.env") {
-			color.Red("× Error: Missing .env file")
-			os.Exit(1)
+			return newError(ErrConfig, "missing .env file", nil)
 		}
 
 		// Get DB settings from .env file
 		err := godotenv.Load("./.env")
 		if err != nil {
-			log.Fatal("Error loading .env file")
+			return newError(ErrConfig, "loading .env file", err)
 		}
 
 		// Get DB settings from .env file
@@ -60,15 +96,14 @@ func backup(cCtx *cli.Context) {
 
 		// Check if DB settings are empty
 		if dbDriver == "" || dbServer == "" || dbPort == "" || dbUser == "" || dbPassword == "" || dbName == "" {
-			color.Red("× Error: Missing DB settings in .env file")
-			os.Exit(1)
+			return newError(ErrConfig, "missing DB settings in .env file", nil)
 		}
 
-		// backup the database using mysqldump
-		cmd = exec.Command(
+		// backup the database using mysqldump, which writes to stdout so the
+		// dump can be streamed to S3
+		dump = exec.Command(
 			"mysqldump",
 			"-u", dbUser,
-			"-p"+dbPassword,
 			"-h", dbServer,
 			"-P", dbPort,
 			dbName,
@@ -85,19 +120,29 @@ func backup(cCtx *cli.Context) {
 			"--skip-disable-keys",
 			"--skip-tz-utc",
 			"--skip-lock-tables",
-			"--result-file="+ProjectName+".sql",
 		)
 
-		color.White("Running: " + cmd.String())
+		// The password goes in the environment, where it isn't shown by
+		// --dry-run, written to --record or seen by ps
+		dump.Env = append(os.Environ(), "MYSQL_PWD="+dbPassword)
 
-		err = cmd.Run()
-		if err != nil {
-			color.Red("× Error Running: " + cmd.String())
-			color.Red("× " + err.Error())
-			os.Exit(1)
-		}
+		// How big the tables are is only a guess at how big the dump will be,
+		// but it is enough to show roughly how long is left
+		cmd = exec.Command(
+			"mysql",
+			"-u", dbUser,
+			"-h", dbServer,
+			"-P", dbPort,
+			"--batch",
+			"--skip-column-names",
+			"-e", "SELECT COALESCE(SUM(data_length), 0) FROM information_schema.tables WHERE table_schema = '"+strings.ReplaceAll(dbName, "'", "''")+"'",
+		)
+
+		cmd.Env = dump.Env
 
-		color.Green("✓ Completed: Database backup file created locally")
+		if out, err := executor.Lookup(cmd); err == nil {
+			dumpSize, _ = strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+		}
 	}
 
 	// Check if project is wordpress
@@ -107,43 +152,197 @@ func backup(cCtx *cli.Context) {
 		color.White("✓ WordPress Detected")
 
 		// Exit as currently don't support wordpress backups
-		color.Red("× Error: WordPress backups are not currently supported")
-		os.Exit(1)
+		return newError(ErrUnsupported, "WordPress backups", nil)
+	}
+
+	if dump == nil {
+		color.Yellow("× Not backing up a database, only craft projects' databases are")
 	}
 
-	var backupFileName = ProjectName + "-" + time.Now().Format("2006-01-02-15-04-05")
+	var backupFileName = ProjectName + "-" + time.Now().Format(backupTimeFormat)
 
-	runCommand(exec.Command("tar", "-czf", backupFileName+".sql.tar.gz", ProjectName+".sql"), false, false, false)
-	runCommand(exec.Command("tar", "--warning=no-file-changed", "-czf", backupFileName+".tar.gz", "--exclude='web/cpresources'", "--exclude='storage/runtime'", "--exclude='vendor'", "--exclude='.git'", "--exclude='"+backupFileName+".tar.gz'", "."), false, false, false)
+	ctx := context.Background()
 
-	// Upload SQL backup to S3
-	cmd = exec.Command("aws", "s3", "cp", backupFileName+".sql.tar.gz", "s3://"+ProjectName+"/backups/"+backupFileName+".sql.tar.gz")
-	color.White("Running: " + cmd.String())
-	err = cmd.Run()
+	client, err := newAWSClient(ctx, AWSProfile, "")
 	if err != nil {
-		color.Red("× Error Running: " + cmd.String())
-		color.White("Your AWS token probably has expired. Run 'matrix configure' to setup AWS CLI Auth again")
-		os.Exit(1)
+		return err
 	}
 
-	// Upload Files backup to S3
-	cmd = exec.Command("aws", "s3", "cp", backupFileName+".tar.gz", "s3://"+ProjectName+"/backups/"+backupFileName+".tar.gz")
-	color.White("Running: " + cmd.String())
-	err = cmd.Run()
+	settings, err := loadSettings(cCtx)
 	if err != nil {
-		color.Red("× Error Running: " + cmd.String())
-		color.White("Your AWS token probably has expired. Run 'matrix configure' to setup AWS CLI Auth again")
-		os.Exit(1)
+		return err
 	}
 
-	color.Green("✓ Completed: Database backup uploaded to S3")
+	encryption, err := loadBackupEncryption(settings, client)
+	if err != nil {
+		return err
+	}
 
-	// Delete local temp files
-	runCommand(exec.Command("rm", backupFileName+".sql.tar.gz"), false, false, true)
-	runCommand(exec.Command("rm", backupFileName+".tar.gz"), false, false, true)
-	runCommand(exec.Command("rm", ProjectName+".sql"), false, false, true)
+	if encryption != nil {
+		color.Green("✓ Encrypting with " + encryption.Method + " (" + encryption.KeyID + ")")
+	}
+
+	result := BackupResult{Project: ProjectName, Bucket: ProjectName, DryRun: dryRun}
+
+	// Stream the SQL backup and then the Files backup to S3, so nothing is
+	// written to the project or the disk along the way
+	if dump != nil {
+		upload := newBackupUpload(backupFileName + ".sql.gz")
+		progress := newBackupProgress("database", dumpSize)
+
+		err = streamBackup(ctx, client, &upload, append(dump.Args, "|", "gzip"), progress, encryption, func(w io.Writer) error {
+			gz := gzip.NewWriter(w)
+
+			dump.Stdout = progress.counter(gz)
+			dump.Stderr = os.Stderr
+
+			if err := executor.Run(dump); err != nil {
+				return commandError(ErrDatabaseDump, dump, err)
+			}
+
+			return gz.Close()
+		})
+		if err != nil {
+			return err
+		}
+
+		if !dryRun {
+			color.Green("✓ Completed: Database backup uploaded to " + upload.URL + " (" + formatSize(upload.Size) + ")")
+		}
+
+		result.Uploads = append(result.Uploads, upload)
+	}
+
+	upload := newBackupUpload(backupFileName + ".tar.gz")
+	progress := newBackupProgress("files", filesBackupSize("."))
+	skipped := []string{}
+
+	args := []string{"tar", "-czf", "-"}
+	for _, exclude := range backupExcludes {
+		args = append(args, "--exclude=./"+exclude)
+	}
+
+	err = streamBackup(ctx, client, &upload, append(args, "."), progress, encryption, func(w io.Writer) error {
+		skipped, err = writeFilesBackup(w, ".", progress)
+		if err != nil {
+			return newError(ErrArchive, upload.URL, err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// tar carries on past files it can't read, and so does the backup
+	for _, name := range skipped {
+		color.Yellow("× Couldn't read " + name + ", it isn't in the backup")
+	}
+
+	if !dryRun {
+		color.Green("✓ Completed: Files backup uploaded to " + upload.URL + " (" + formatSize(upload.Size) + ")")
+	}
+
+	result.Uploads = append(result.Uploads, upload)
 
 	color.Magenta("--------------------------------------------------")
 	color.Magenta("🎉            BACKUP COMPLETE                   🎉")
 	color.Magenta("--------------------------------------------------")
+
+	return printResult(result)
+}
+
+// newBackupUpload is where an archive of a backup goes in the project's
+// bucket
+func newBackupUpload(archive string) BackupUpload {
+	return BackupUpload{Key: "backups/" + archive, URL: "s3://" + ProjectName + "/backups/" + archive}
+}
+
+// archive returns the archive of the set with the given suffix, .sql.gz for
+// the database or .tar.gz for the files
+func (set BackupSet) archive(suffix string) *BackupUpload {
+	for i, archive := range set.Archives {
+		name := strings.TrimPrefix(archive.Key, "backups/"+ProjectName+"-"+set.Timestamp)
+
+		if name == suffix {
+			return &set.Archives[i]
+		}
+	}
+
+	return nil
+}
+
+// database returns the database archive of the set, a gzipped dump or, for
+// backups from before they were streamed, a dump in a .sql.tar.gz
+func (set BackupSet) database() *BackupUpload {
+	if archive := set.archive(".sql.gz"); archive != nil {
+		return archive
+	}
+
+	return set.archive(".sql.tar.gz")
+}
+
+// complete is whether the set has both its database and files archives
+func (set BackupSet) complete() bool {
+	return set.database() != nil && set.archive(".tar.gz") != nil
+}
+
+// listBackupSets lists the project's backups in its bucket, oldest first. A
+// project without a bucket has never been backed up, so it has none.
+func listBackupSets(ctx context.Context, client *AWSClient) ([]BackupSet, error) {
+	byTimestamp := map[string]*BackupSet{}
+	sets := []BackupSet{}
+
+	paginator := s3.NewListObjectsV2Paginator(client.S3, &s3.ListObjectsV2Input{
+		Bucket: aws.String(ProjectName),
+		Prefix: aws.String("backups/" + ProjectName + "-"),
+	})
+
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(ctx)
+
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "NoSuchBucket" {
+			return sets, nil
+		}
+
+		if err != nil {
+			return nil, awsError("s3 list-objects-v2 s3://"+ProjectName+"/backups/", err)
+		}
+
+		for _, object := range out.Contents {
+			key := aws.ToString(object.Key)
+
+			// Anything else in the folder isn't a backup
+			name := strings.TrimPrefix(key, "backups/"+ProjectName+"-")
+			if len(name) < len(backupTimeFormat) {
+				continue
+			}
+
+			timestamp := name[:len(backupTimeFormat)]
+
+			backupTime, err := time.ParseInLocation(backupTimeFormat, timestamp, time.Local)
+			if err != nil {
+				continue
+			}
+
+			set, ok := byTimestamp[timestamp]
+			if !ok {
+				set = &BackupSet{Timestamp: timestamp, Time: backupTime}
+				byTimestamp[timestamp] = set
+			}
+
+			set.Archives = append(set.Archives, BackupUpload{Key: key, URL: "s3://" + ProjectName + "/" + key, Size: aws.ToInt64(object.Size)})
+		}
+	}
+
+	for _, set := range byTimestamp {
+		sets = append(sets, *set)
+	}
+
+	sort.Slice(sets, func(i, j int) bool {
+		return sets[i].Timestamp < sets[j].Timestamp
+	})
+
+	return sets, nil
 }
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	kmstypes "github.com/aws/aws-sdk-go-v2/service/kms/types"
+)
+
+// Ways a backup can be encrypted before it is uploaded
+const (
+	EncryptAge     = "age"
+	EncryptKMS     = "kms"
+	EncryptKeyfile = "keyfile"
+)
+
+// The first lines of backups encrypted with age and with AES-GCM, which is
+// how restore tells they need decrypting
+const (
+	ageHeader        = "age-encryption.org/v1\n"
+	backupGCMHeader  = "matrix-backup-encryption/v1\n"
+	backupChunkSize  = 64 * 1024
+	backupKeyfileKDF = "matrix backup keyfile"
+)
+
+// BackupEncryption is the key backups are encrypted with before they leave
+// this machine: age recipients, a KMS key that hands out a data key for each
+// archive, or a local keyfile
+type BackupEncryption struct {
+	Method string `json:"method"`
+	KeyID  string `json:"keyId"`
+
+	recipients []age.Recipient
+	key        []byte
+	client     *AWSClient
+}
+
+// loadBackupEncryption reads which key to encrypt backups with from
+// --age-recipient, --kms-key or --keyfile, or backup_age_recipients,
+// backup_kms_key or backup_keyfile. Backups aren't encrypted when none is set.
+func loadBackupEncryption(settings Settings, client *AWSClient) (*BackupEncryption, error) {
+	recipients := settings.Get("age-recipient", "backup_age_recipients", "")
+	kmsKey := settings.Get("kms-key", "backup_kms_key", "")
+	keyfile := settings.Get("keyfile", "backup_keyfile", "")
+
+	set := 0
+	for _, value := range []string{recipients, kmsKey, keyfile} {
+		if value != "" {
+			set++
+		}
+	}
+
+	if set == 0 {
+		return nil, nil
+	}
+
+	if set > 1 {
+		return nil, newError(ErrConfig, "backups can only be encrypted one way, set one of backup_age_recipients, backup_kms_key and backup_keyfile", nil)
+	}
+
+	switch {
+	case recipients != "":
+		encryption := &BackupEncryption{Method: EncryptAge}
+		names := strings.FieldsFunc(recipients, func(r rune) bool { return r == ',' || r == ' ' })
+
+		for _, name := range names {
+			recipient, err := age.ParseX25519Recipient(name)
+			if err != nil {
+				return nil, newError(ErrConfig, "age recipient '"+name+"'", err)
+			}
+
+			encryption.recipients = append(encryption.recipients, recipient)
+		}
+
+		encryption.KeyID = strings.Join(names, ",")
+
+		return encryption, nil
+	case kmsKey != "":
+		return &BackupEncryption{Method: EncryptKMS, KeyID: kmsKey, client: client}, nil
+	}
+
+	key, err := readBackupKeyfile(keyfile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BackupEncryption{Method: EncryptKeyfile, KeyID: keyfileID(key), key: key}, nil
+}
+
+// readBackupKeyfile reads a 256 bit key, either as it is or base64 encoded
+// like 'openssl rand -base64 32' makes
+func readBackupKeyfile(path string) ([]byte, error) {
+	data, err := os.ReadFile(expandHome(path))
+	if err != nil {
+		return nil, newError(ErrConfig, "reading backup keyfile", err)
+	}
+
+	if key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data))); err == nil && len(key) == 32 {
+		return key, nil
+	}
+
+	if len(data) == 32 {
+		return data, nil
+	}
+
+	return nil, newError(ErrConfig, "backup keyfile "+path+" isn't a 32 byte key, make one with 'openssl rand -base64 32'", nil)
+}
+
+// keyfileID identifies a keyfile without giving anything away about it
+func keyfileID(key []byte) string {
+	sum := sha256.Sum256(key)
+
+	return "sha256:" + hex.EncodeToString(sum[:8])
+}
+
+// encrypt starts encrypting one archive, returning the key ID to record with
+// it and a function that wraps what the archive is written to. Each archive
+// gets a key of its own so no two share a nonce.
+func (e *BackupEncryption) encrypt(ctx context.Context) (string, func(w io.Writer) (io.WriteCloser, error), error) {
+	if e.Method == EncryptAge {
+		return e.KeyID, func(w io.Writer) (io.WriteCloser, error) {
+			return age.Encrypt(w, e.recipients...)
+		}, nil
+	}
+
+	keyID := e.KeyID
+	var header string
+	var key []byte
+
+	if e.Method == EncryptKMS {
+		out, err := e.client.KMS.GenerateDataKey(ctx, &kms.GenerateDataKeyInput{
+			KeyId:   aws.String(e.KeyID),
+			KeySpec: kmstypes.DataKeySpecAes256,
+		})
+		if err != nil {
+			return "", nil, awsError("kms generate-data-key "+e.KeyID, err)
+		}
+
+		keyID = aws.ToString(out.KeyId)
+		key = out.Plaintext
+		header = EncryptKMS + " " + keyID + " " + base64.StdEncoding.EncodeToString(out.CiphertextBlob) + "\n"
+	} else {
+		salt := make([]byte, 32)
+		if _, err := rand.Read(salt); err != nil {
+			return "", nil, newError(ErrArchive, "making backup key salt", err)
+		}
+
+		derived, err := hkdf.Key(sha256.New, e.key, salt, backupKeyfileKDF, 32)
+		if err != nil {
+			return "", nil, newError(ErrArchive, "deriving backup key", err)
+		}
+
+		key = derived
+		header = EncryptKeyfile + " " + keyID + " " + base64.StdEncoding.EncodeToString(salt) + "\n"
+	}
+
+	aead, err := newBackupAEAD(key)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return keyID, func(w io.Writer) (io.WriteCloser, error) {
+		header := []byte(backupGCMHeader + header)
+		if _, err := w.Write(header); err != nil {
+			return nil, err
+		}
+
+		return &gcmWriter{w: w, aead: aead, header: header}, nil
+	}, nil
+}
+
+func newBackupAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, newError(ErrArchive, "backup key", err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, newError(ErrArchive, "backup key", err)
+	}
+
+	return aead, nil
+}
+
+// backupNonce is the nonce of the chunk at counter. The last chunk is marked
+// so a backup cut off between chunks doesn't decrypt.
+func backupNonce(counter uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], counter)
+
+	if last {
+		nonce[11] = 1
+	}
+
+	return nonce
+}
+
+// gcmWriter seals what is written to it in chunks of backupChunkSize, each
+// authenticated along with the header
+type gcmWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	header  []byte
+	buffer  []byte
+	counter uint64
+}
+
+func (w *gcmWriter) Write(b []byte) (int, error) {
+	w.buffer = append(w.buffer, b...)
+
+	// A full chunk is held back until there is more, as it could be the last
+	sealed := 0
+	for len(w.buffer)-sealed > backupChunkSize {
+		if err := w.seal(w.buffer[sealed:sealed+backupChunkSize], false); err != nil {
+			return 0, err
+		}
+
+		sealed += backupChunkSize
+	}
+
+	w.buffer = append(w.buffer[:0], w.buffer[sealed:]...)
+
+	return len(b), nil
+}
+
+func (w *gcmWriter) Close() error {
+	return w.seal(w.buffer, true)
+}
+
+func (w *gcmWriter) seal(chunk []byte, last bool) error {
+	sealed := w.aead.Seal(nil, backupNonce(w.counter, last), chunk, w.header)
+	w.counter++
+
+	_, err := w.w.Write(sealed)
+
+	return err
+}
+
+// backupKeys decrypts backups for restore, loading the keys from
+// --age-identity or backup_age_identity, --keyfile or backup_keyfile, or
+// KMS as a backup needs them
+type backupKeys struct {
+	settings Settings
+	client   *AWSClient
+}
+
+// decrypt returns what reader decrypts to, or reader itself if it isn't
+// encrypted
+func (k backupKeys) decrypt(ctx context.Context, reader io.Reader) (io.Reader, error) {
+	buffered := bufio.NewReader(reader)
+
+	start, _ := buffered.Peek(len(backupGCMHeader))
+
+	switch {
+	case bytes.HasPrefix(start, []byte(ageHeader)):
+		identityFile := k.settings.Get("age-identity", "backup_age_identity", "")
+		if identityFile == "" {
+			return nil, newError(ErrBackupKey, "the backup is encrypted with age, give the identity to decrypt it with --age-identity or backup_age_identity", nil)
+		}
+
+		file, err := os.Open(expandHome(identityFile))
+		if err != nil {
+			return nil, newError(ErrBackupKey, "reading age identity", err)
+		}
+		defer file.Close()
+
+		identities, err := age.ParseIdentities(file)
+		if err != nil {
+			return nil, newError(ErrBackupKey, "reading age identity "+identityFile, err)
+		}
+
+		decrypted, err := age.Decrypt(buffered, identities...)
+		if err != nil {
+			var noMatch *age.NoIdentityMatchError
+			if errors.As(err, &noMatch) {
+				return nil, newError(ErrBackupKey, "the backup isn't encrypted to "+identityFile, err)
+			}
+
+			return nil, newError(ErrBackupDamaged, "decrypting", err)
+		}
+
+		return &ageReader{reader: decrypted}, nil
+	case string(start) == backupGCMHeader:
+		buffered.Discard(len(backupGCMHeader))
+
+		line, err := buffered.ReadString('\n')
+		if err != nil {
+			return nil, newError(ErrBackupDamaged, "reading the encryption header", err)
+		}
+
+		key, err := k.backupKey(ctx, strings.Fields(line))
+		if err != nil {
+			return nil, err
+		}
+
+		aead, err := newBackupAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+
+		return &gcmReader{reader: buffered, aead: aead, header: []byte(backupGCMHeader + line)}, nil
+	}
+
+	return buffered, nil
+}
+
+// backupKey gets the key a backup was encrypted with from the fields of its
+// header: the method, key ID and encrypted data key or salt
+func (k backupKeys) backupKey(ctx context.Context, fields []string) ([]byte, error) {
+	if len(fields) != 3 {
+		return nil, newError(ErrBackupDamaged, "the encryption header is malformed", nil)
+	}
+
+	method, keyID := fields[0], fields[1]
+
+	value, err := base64.StdEncoding.DecodeString(fields[2])
+	if err != nil {
+		return nil, newError(ErrBackupDamaged, "the encryption header is malformed", err)
+	}
+
+	switch method {
+	case EncryptKMS:
+		out, err := k.client.KMS.Decrypt(ctx, &kms.DecryptInput{CiphertextBlob: value, KeyId: aws.String(keyID)})
+		if err != nil {
+			return nil, newError(ErrBackupKey, "decrypting the backup's data key with "+keyID, awsError("kms decrypt", err))
+		}
+
+		return out.Plaintext, nil
+	case EncryptKeyfile:
+		keyfile := k.settings.Get("keyfile", "backup_keyfile", "")
+		if keyfile == "" {
+			return nil, newError(ErrBackupKey, "the backup is encrypted with keyfile "+keyID+", give it with --keyfile or backup_keyfile", nil)
+		}
+
+		secret, err := readBackupKeyfile(keyfile)
+		if err != nil {
+			return nil, err
+		}
+
+		if keyfileID(secret) != keyID {
+			return nil, newError(ErrBackupKey, "the backup is encrypted with keyfile "+keyID+", not "+keyfileID(secret), nil)
+		}
+
+		key, err := hkdf.Key(sha256.New, secret, value, backupKeyfileKDF, 32)
+		if err != nil {
+			return nil, newError(ErrArchive, "deriving backup key", err)
+		}
+
+		return key, nil
+	}
+
+	return nil, newError(ErrUnsupported, "backups encrypted with "+method, nil)
+}
+
+// gcmReader opens the chunks a gcmWriter sealed, failing if any has been
+// changed, reordered or cut off
+type gcmReader struct {
+	reader  io.Reader
+	aead    cipher.AEAD
+	header  []byte
+	counter uint64
+	chunk   []byte
+	pending int
+	plain   []byte
+	done    bool
+}
+
+func (r *gcmReader) Read(b []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(b, r.plain)
+	r.plain = r.plain[n:]
+
+	return n, nil
+}
+
+// open reads and opens the next chunk. It reads a byte past a full chunk to
+// tell whether it is the last.
+func (r *gcmReader) open() error {
+	if r.chunk == nil {
+		r.chunk = make([]byte, backupChunkSize+r.aead.Overhead()+1)
+	}
+
+	n, err := io.ReadFull(r.reader, r.chunk[r.pending:])
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	size := r.pending + n
+	last := size < len(r.chunk)
+
+	if !last {
+		size--
+	}
+
+	plain, openErr := r.aead.Open(nil, backupNonce(r.counter, last), r.chunk[:size], r.header)
+	if openErr != nil {
+		return newError(ErrBackupDamaged, "the backup doesn't decrypt, it has been changed or cut off", openErr)
+	}
+
+	r.counter++
+	r.plain = plain
+	r.done = last
+
+	// The byte read past the chunk starts the next one
+	r.pending = 0
+	if !last {
+		r.chunk[0] = r.chunk[len(r.chunk)-1]
+		r.pending = 1
+	}
+
+	return nil
+}
+
+// ageReader marks errors decrypting age as a damaged backup
+type ageReader struct {
+	reader io.Reader
+}
+
+func (r *ageReader) Read(b []byte) (int, error) {
+	n, err := r.reader.Read(b)
+	if err != nil && err != io.EOF {
+		err = newError(ErrBackupDamaged, "the backup doesn't decrypt, it has been changed or cut off", err)
+	}
+
+	return n, err
+}
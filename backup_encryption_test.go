@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+)
+
+// sealTestBackup seals data with a gcmWriter, written in uneven pieces
+func sealTestBackup(t *testing.T, key []byte, header []byte, data []byte) []byte {
+	t.Helper()
+
+	aead, err := newBackupAEAD(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sealed bytes.Buffer
+	writer := &gcmWriter{w: &sealed, aead: aead, header: header}
+
+	for rest := data; len(rest) > 0; {
+		n := min(len(rest), 10007)
+
+		if _, err := writer.Write(rest[:n]); err != nil {
+			t.Fatal(err)
+		}
+
+		rest = rest[n:]
+	}
+
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return sealed.Bytes()
+}
+
+func openTestBackup(t *testing.T, key []byte, header []byte, sealed []byte) ([]byte, error) {
+	t.Helper()
+
+	aead, err := newBackupAEAD(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return io.ReadAll(&gcmReader{reader: bytes.NewReader(sealed), aead: aead, header: header})
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+func TestGCMRoundTrip(t *testing.T) {
+	key := randomBytes(t, 32)
+	header := []byte(backupGCMHeader + "keyfile sha256:0 AAAA\n")
+
+	for _, size := range []int{0, 1, backupChunkSize - 1, backupChunkSize, backupChunkSize + 1, 3 * backupChunkSize, 3*backupChunkSize + 17} {
+		data := randomBytes(t, size)
+
+		got, err := openTestBackup(t, key, header, sealTestBackup(t, key, header, data))
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+
+		if !bytes.Equal(got, data) {
+			t.Errorf("%d bytes: got %d bytes back that don't match", size, len(got))
+		}
+	}
+}
+
+func TestGCMDamaged(t *testing.T) {
+	key := randomBytes(t, 32)
+	header := []byte(backupGCMHeader + "keyfile sha256:0 AAAA\n")
+	sealedChunk := backupChunkSize + 16
+
+	tests := []struct {
+		name   string
+		size   int
+		damage func(sealed []byte) []byte
+		header []byte
+	}{
+		{"cut off at a chunk boundary", 3 * backupChunkSize, func(sealed []byte) []byte { return sealed[:2*sealedChunk] }, header},
+		{"cut off after the first chunk", backupChunkSize + 1, func(sealed []byte) []byte { return sealed[:sealedChunk] }, header},
+		{"cut off in a chunk", 3 * backupChunkSize, func(sealed []byte) []byte { return sealed[:sealedChunk+100] }, header},
+		{"cut off entirely", 100, func(sealed []byte) []byte { return nil }, header},
+		{"last byte missing", 100, func(sealed []byte) []byte { return sealed[:len(sealed)-1] }, header},
+		{"byte added", 100, func(sealed []byte) []byte { return append(sealed, 0) }, header},
+		{"byte flipped in the first chunk", 2 * backupChunkSize, func(sealed []byte) []byte { sealed[10] ^= 1; return sealed }, header},
+		{"byte flipped in the last chunk", 2 * backupChunkSize, func(sealed []byte) []byte { sealed[len(sealed)-20] ^= 1; return sealed }, header},
+		{"chunks swapped", 2*backupChunkSize + 1, func(sealed []byte) []byte {
+			return slices.Concat(sealed[sealedChunk:2*sealedChunk], sealed[:sealedChunk], sealed[2*sealedChunk:])
+		}, header},
+		{"header changed", 100, func(sealed []byte) []byte { return sealed }, []byte(backupGCMHeader + "keyfile sha256:1 AAAA\n")},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sealed := test.damage(sealTestBackup(t, key, header, randomBytes(t, test.size)))
+
+			if _, err := openTestBackup(t, key, test.header, sealed); !errors.Is(err, ErrBackupDamaged) {
+				t.Errorf("got error %v, want ErrBackupDamaged", err)
+			}
+		})
+	}
+}
+
+// encryptTestBackup encrypts data as backup would
+func encryptTestBackup(t *testing.T, encryption *BackupEncryption, data []byte) []byte {
+	t.Helper()
+
+	_, wrap, err := encryption.encrypt(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var encrypted bytes.Buffer
+
+	w, err := wrap(&encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return encrypted.Bytes()
+}
+
+func decryptTestBackup(keys backupKeys, encrypted []byte) ([]byte, error) {
+	reader, err := keys.decrypt(context.Background(), bytes.NewReader(encrypted))
+	if err != nil {
+		return nil, err
+	}
+
+	return io.ReadAll(reader)
+}
+
+func writeTestFile(t *testing.T, name string, data []byte) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestBackupKeyfile(t *testing.T) {
+	secret := randomBytes(t, 32)
+	keyfile := writeTestFile(t, "backup.key", []byte(base64.StdEncoding.EncodeToString(secret)+"\n"))
+	settings := Settings{project: map[string]string{"backup_keyfile": keyfile}}
+
+	encryption, err := loadBackupEncryption(settings, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if encryption.Method != EncryptKeyfile || encryption.KeyID != keyfileID(secret) {
+		t.Fatalf("got %s %s, want keyfile %s", encryption.Method, encryption.KeyID, keyfileID(secret))
+	}
+
+	data := randomBytes(t, backupChunkSize+1)
+	encrypted := encryptTestBackup(t, encryption, data)
+
+	header, _, _ := strings.Cut(strings.TrimPrefix(string(encrypted), backupGCMHeader), "\n")
+	if fields := strings.Fields(header); len(fields) != 3 || fields[0] != EncryptKeyfile || fields[1] != keyfileID(secret) {
+		t.Fatalf("header is %q, want keyfile %s and a salt", header, keyfileID(secret))
+	}
+
+	t.Run("decrypts with the keyfile", func(t *testing.T) {
+		got, err := decryptTestBackup(backupKeys{settings: settings}, encrypted)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(got, data) {
+			t.Error("decrypted backup doesn't match")
+		}
+	})
+
+	t.Run("decrypts with the raw key", func(t *testing.T) {
+		raw := Settings{project: map[string]string{"backup_keyfile": writeTestFile(t, "raw.key", secret)}}
+
+		if _, err := decryptTestBackup(backupKeys{settings: raw}, encrypted); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("needs a keyfile", func(t *testing.T) {
+		if _, err := decryptTestBackup(backupKeys{}, encrypted); !errors.Is(err, ErrBackupKey) {
+			t.Errorf("got error %v, want ErrBackupKey", err)
+		}
+	})
+
+	t.Run("needs the same keyfile", func(t *testing.T) {
+		other := Settings{project: map[string]string{"backup_keyfile": writeTestFile(t, "other.key", randomBytes(t, 32))}}
+
+		if _, err := decryptTestBackup(backupKeys{settings: other}, encrypted); !errors.Is(err, ErrBackupKey) {
+			t.Errorf("got error %v, want ErrBackupKey", err)
+		}
+	})
+
+	t.Run("rejects a short keyfile", func(t *testing.T) {
+		short := Settings{project: map[string]string{"backup_keyfile": writeTestFile(t, "short.key", []byte("secret"))}}
+
+		if _, err := loadBackupEncryption(short, nil); !errors.Is(err, ErrConfig) {
+			t.Errorf("got error %v, want ErrConfig", err)
+		}
+	})
+}
+
+func TestBackupEncryptionHeader(t *testing.T) {
+	keyfile := writeTestFile(t, "backup.key", []byte(base64.StdEncoding.EncodeToString(randomBytes(t, 32))))
+	keys := backupKeys{settings: Settings{project: map[string]string{"backup_keyfile": keyfile}}}
+
+	tests := []struct {
+		name      string
+		encrypted string
+		err       error
+	}{
+		{"too few fields", backupGCMHeader + "keyfile sha256:0\n", ErrBackupDamaged},
+		{"too many fields", backupGCMHeader + "keyfile sha256:0 AAAA BBBB\n", ErrBackupDamaged},
+		{"salt isn't base64", backupGCMHeader + "keyfile sha256:0 !!!!\n", ErrBackupDamaged},
+		{"no end of line", backupGCMHeader + "keyfile sha256:0 AAAA", ErrBackupDamaged},
+		{"unknown method", backupGCMHeader + "rot13 x AAAA\n", ErrUnsupported},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := decryptTestBackup(keys, []byte(test.encrypted)); !errors.Is(err, test.err) {
+				t.Errorf("got error %v, want %v", err, test.err)
+			}
+		})
+	}
+
+	t.Run("not encrypted", func(t *testing.T) {
+		data := []byte("-- MySQL dump\n")
+
+		got, err := decryptTestBackup(keys, data)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("got %q, %v, want it back as it is", got, err)
+		}
+	})
+}
+
+func TestBackupKMS(t *testing.T) {
+	const keyID = "arn:aws:kms:eu-west-2:111111111111:key/test"
+
+	dataKey := randomBytes(t, 32)
+	blob := []byte("encrypted data key")
+	decrypted := []map[string]string{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request := map[string]string{}
+		json.NewDecoder(r.Body).Decode(&request)
+
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+
+		switch r.Header.Get("X-Amz-Target") {
+		case "TrentService.GenerateDataKey":
+			json.NewEncoder(w).Encode(map[string]any{"KeyId": keyID, "Plaintext": dataKey, "CiphertextBlob": blob})
+		case "TrentService.Decrypt":
+			decrypted = append(decrypted, request)
+
+			if request["KeyId"] != keyID {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{"__type": "NotFoundException", "message": "no such key"})
+
+				return
+			}
+
+			json.NewEncoder(w).Encode(map[string]any{"KeyId": keyID, "Plaintext": dataKey})
+		}
+	}))
+	defer server.Close()
+
+	client := &AWSClient{KMS: kms.New(kms.Options{Region: "eu-west-2", BaseEndpoint: aws.String(server.URL), Credentials: aws.AnonymousCredentials{}})}
+
+	encryption, err := loadBackupEncryption(Settings{project: map[string]string{"backup_kms_key": "alias/backups"}}, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := randomBytes(t, 1000)
+	encrypted := encryptTestBackup(t, encryption, data)
+
+	want := backupGCMHeader + EncryptKMS + " " + keyID + " " + base64.StdEncoding.EncodeToString(blob) + "\n"
+	if !bytes.HasPrefix(encrypted, []byte(want)) {
+		t.Fatalf("header is %q, want %q", encrypted[:len(want)], want)
+	}
+
+	got, err := decryptTestBackup(backupKeys{client: client}, encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, data) {
+		t.Error("decrypted backup doesn't match")
+	}
+
+	if len(decrypted) != 1 || decrypted[0]["CiphertextBlob"] != base64.StdEncoding.EncodeToString(blob) {
+		t.Errorf("KMS was asked to decrypt %v, want the data key from the header", decrypted)
+	}
+
+	// Another key ID in the header is what KMS is asked for, and refuses
+	other := bytes.Replace(encrypted, []byte(keyID), []byte(keyID+"2"), 1)
+	if _, err := decryptTestBackup(backupKeys{client: client}, other); !errors.Is(err, ErrBackupKey) {
+		t.Errorf("got error %v, want ErrBackupKey", err)
+	}
+}
+
+func TestBackupAge(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encryption, err := loadBackupEncryption(Settings{project: map[string]string{"backup_age_recipients": identity.Recipient().String()}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := randomBytes(t, backupChunkSize+1)
+	encrypted := encryptTestBackup(t, encryption, data)
+
+	keys := backupKeys{settings: Settings{project: map[string]string{"backup_age_identity": writeTestFile(t, "identity.txt", []byte(identity.String()+"\n"))}}}
+
+	got, err := decryptTestBackup(keys, encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, data) {
+		t.Error("decrypted backup doesn't match")
+	}
+
+	other, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys = backupKeys{settings: Settings{project: map[string]string{"backup_age_identity": writeTestFile(t, "other.txt", []byte(other.String()+"\n"))}}}
+	if _, err := decryptTestBackup(keys, encrypted); !errors.Is(err, ErrBackupKey) {
+		t.Errorf("got error %v, want ErrBackupKey", err)
+	}
+
+	if _, err := decryptTestBackup(backupKeys{}, encrypted); !errors.Is(err, ErrBackupKey) {
+		t.Errorf("got error %v without an identity, want ErrBackupKey", err)
+	}
+}
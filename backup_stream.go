@@ -0,0 +1,439 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Paths in the project that are left out of the files backup, as they are
+// rebuilt rather than restored
+var backupExcludes = []string{"web/cpresources", "storage/runtime", "vendor", ".git"}
+
+// How much of a backup is uploaded at a time. S3 allows 10,000 parts, so
+// backups up to 160 GB fit, and only one part is held in memory at once.
+const backupPartSize = 16 * 1024 * 1024
+
+// backupProgress keeps count of a streamed backup and shows how far along it
+// is on the spinner
+type backupProgress struct {
+	name     string
+	total    int64
+	read     atomic.Int64
+	uploaded atomic.Int64
+	start    time.Time
+	done     chan struct{}
+}
+
+// newBackupProgress counts the backup of name, which is expected to read
+// total bytes, or an unknown amount if total is 0
+func newBackupProgress(name string, total int64) *backupProgress {
+	return &backupProgress{name: name, total: total}
+}
+
+// counter counts what is written through it as read for the backup
+func (p *backupProgress) counter(w io.Writer) io.Writer {
+	return &progressWriter{w: w, count: &p.read}
+}
+
+// show starts the spinner, updating it every second until stop is called
+func (p *backupProgress) show() {
+	p.start = time.Now()
+	p.done = make(chan struct{})
+
+	s.Suffix = " Backing up " + p.name
+	s.Start()
+
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-p.done:
+				return
+			case <-ticker.C:
+				s.Lock()
+				s.Suffix = " " + p.String()
+				s.Unlock()
+			}
+		}
+	}()
+}
+
+func (p *backupProgress) stop() {
+	close(p.done)
+	s.Stop()
+}
+
+// String shows how much has been read and uploaded, how fast, and how long
+// is left when the total is known
+func (p *backupProgress) String() string {
+	read := p.read.Load()
+	elapsed := time.Since(p.start)
+
+	line := "Backing up " + p.name + ": " + formatSize(read)
+	if p.total > 0 {
+		line += " of ~" + formatSize(p.total)
+	}
+
+	if elapsed < time.Second || read == 0 {
+		return line
+	}
+
+	rate := float64(read) / elapsed.Seconds()
+	line += " at " + formatSize(int64(rate)) + "/s"
+
+	// The total is an estimate, so once it is passed there is no telling
+	if p.total > read {
+		left := time.Duration(float64(p.total-read)/rate) * time.Second
+		line += ", " + left.Round(time.Second).String() + " left"
+	}
+
+	return line + " (" + formatSize(p.uploaded.Load()) + " uploaded)"
+}
+
+type progressWriter struct {
+	w     io.Writer
+	count *atomic.Int64
+}
+
+func (w *progressWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.count.Add(int64(n))
+
+	return n, err
+}
+
+// streamBackup uploads what write writes to the backup's key as it is
+// written, encrypting it first if encryption isn't nil, and sets the
+// upload's size and key once it is done. args describe what writes it, for
+// --dry-run and --record.
+func streamBackup(ctx context.Context, client *AWSClient, upload *BackupUpload, args []string, progress *backupProgress, encryption *BackupEncryption, write func(w io.Writer) error) error {
+	args = slices.Clip(args)
+	if encryption != nil {
+		args = append(args, "|", "encrypt", encryption.Method+":"+encryption.KeyID)
+	}
+
+	args = append(args, "|", "aws", "s3", "cp", "-", upload.URL)
+
+	return executor.Call(args, func() error {
+		metadata := map[string]string{}
+		wrap := func(w io.Writer) (io.WriteCloser, error) {
+			return nopWriteCloser{w}, nil
+		}
+
+		// The key is recorded with the archive so it is clear what it needs
+		// to be restored without downloading it
+		if encryption != nil {
+			keyID, encrypt, err := encryption.encrypt(ctx)
+			if err != nil {
+				return err
+			}
+
+			upload.Encryption, upload.KeyID = encryption.Method, keyID
+			metadata["encryption"], metadata["key-id"] = encryption.Method, keyID
+			wrap = encrypt
+		}
+
+		progress.show()
+		defer progress.stop()
+
+		reader, writer := io.Pipe()
+		written := make(chan struct{})
+
+		go func() {
+			w, err := wrap(writer)
+			if err == nil {
+				err = write(w)
+			}
+
+			if err == nil {
+				err = w.Close()
+			}
+
+			writer.CloseWithError(err)
+			close(written)
+		}()
+
+		size, err := streamToS3(ctx, client, reader, ProjectName, upload.Key, metadata, &progress.uploaded)
+
+		// Stops write if the upload failed part way
+		reader.CloseWithError(errors.New("upload stopped"))
+		<-written
+
+		if err != nil {
+			return err
+		}
+
+		upload.Size = size
+
+		return nil
+	})
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// streamToS3 uploads everything read from reader to s3://bucket/key as a
+// multipart upload, with metadata stored on the object, counting what has
+// been uploaded in uploaded, and returns its size. The upload is aborted if
+// anything fails so no parts are left behind, and an error reading is
+// returned as it is.
+func streamToS3(ctx context.Context, client *AWSClient, reader io.Reader, bucket string, key string, metadata map[string]string, uploaded *atomic.Int64) (int64, error) {
+	url := "s3://" + bucket + "/" + key
+
+	created, err := client.S3.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:            aws.String(bucket),
+		Key:               aws.String(key),
+		Metadata:          metadata,
+		ChecksumAlgorithm: s3types.ChecksumAlgorithmCrc32,
+	})
+	if err != nil {
+		return 0, awsError("s3 create-multipart-upload "+url, err)
+	}
+
+	abort := func(err error) (int64, error) {
+		client.S3.AbortMultipartUpload(context.Background(), &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(bucket),
+			Key:      aws.String(key),
+			UploadId: created.UploadId,
+		})
+
+		return 0, err
+	}
+
+	parts := []s3types.CompletedPart{}
+	buffer := make([]byte, backupPartSize)
+	size := int64(0)
+
+	for number := int32(1); ; number++ {
+		n, err := io.ReadFull(reader, buffer)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return abort(err)
+		}
+
+		// Every upload needs a part, even when there is nothing to upload
+		if n == 0 && len(parts) > 0 {
+			break
+		}
+
+		part, partErr := client.S3.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:            aws.String(bucket),
+			Key:               aws.String(key),
+			UploadId:          created.UploadId,
+			PartNumber:        aws.Int32(number),
+			Body:              bytes.NewReader(buffer[:n]),
+			ChecksumAlgorithm: s3types.ChecksumAlgorithmCrc32,
+		})
+		if partErr != nil {
+			return abort(awsError("s3 upload-part "+url+" part "+strconv.Itoa(int(number)), partErr))
+		}
+
+		parts = append(parts, s3types.CompletedPart{
+			PartNumber:    aws.Int32(number),
+			ETag:          part.ETag,
+			ChecksumCRC32: part.ChecksumCRC32,
+		})
+
+		size += int64(n)
+		uploaded.Store(size)
+
+		// A part that isn't full is the last one
+		if err != nil {
+			break
+		}
+	}
+
+	_, err = client.S3.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(bucket),
+		Key:             aws.String(key),
+		UploadId:        created.UploadId,
+		MultipartUpload: &s3types.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		return abort(awsError("s3 complete-multipart-upload "+url, err))
+	}
+
+	return size, nil
+}
+
+// excludedFromBackup is whether a path relative to the project is left out
+// of the files backup
+func excludedFromBackup(name string) bool {
+	return slices.Contains(backupExcludes, filepath.ToSlash(name))
+}
+
+// filesBackupSize adds up the size of the files the files backup will read,
+// to show how long is left
+func filesBackupSize(root string) int64 {
+	total := int64(0)
+
+	filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		if name, _ := filepath.Rel(root, path); excludedFromBackup(name) && entry.IsDir() {
+			return filepath.SkipDir
+		}
+
+		if entry.Type().IsRegular() {
+			if info, err := entry.Info(); err == nil {
+				total += info.Size()
+			}
+		}
+
+		return nil
+	})
+
+	return total
+}
+
+// writeFilesBackup writes a .tar.gz of the project at root to w, leaving out
+// backupExcludes, and returns the files it couldn't read. Like tar it carries
+// on when files change while being read, so a busy site can still be backed
+// up.
+func writeFilesBackup(w io.Writer, root string, progress *backupProgress) ([]string, error) {
+	gz := gzip.NewWriter(w)
+	archive := tar.NewWriter(gz)
+	skipped := []string{}
+
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		name, _ := filepath.Rel(root, path)
+
+		if err != nil {
+			// Deleted since the directory was read
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+
+			skipped = append(skipped, name)
+
+			if entry != nil && entry.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		if name == "." {
+			return nil
+		}
+
+		if excludedFromBackup(name) {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		// Sockets, pipes and devices aren't part of the project
+		if !entry.IsDir() && !entry.Type().IsRegular() && entry.Type()&fs.ModeSymlink == 0 {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				skipped = append(skipped, name)
+			}
+
+			return nil
+		}
+
+		link := ""
+		if info.Mode()&fs.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				skipped = append(skipped, name)
+				return nil
+			}
+		}
+
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			skipped = append(skipped, name)
+			return nil
+		}
+
+		header.Name = filepath.ToSlash(name)
+		if entry.IsDir() {
+			header.Name += "/"
+		}
+
+		if !info.Mode().IsRegular() {
+			return archive.WriteHeader(header)
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				skipped = append(skipped, name)
+			}
+
+			return nil
+		}
+		defer file.Close()
+
+		if err := archive.WriteHeader(header); err != nil {
+			return err
+		}
+
+		// The header has the size the file was, so a file that has grown is
+		// cut off there and one that has shrunk is padded out to it
+		written, err := io.Copy(progress.counter(archive), io.LimitReader(file, header.Size))
+		if err != nil {
+			var readErr *fs.PathError
+			if !errors.As(err, &readErr) {
+				return err
+			}
+
+			skipped = append(skipped, name)
+		}
+
+		if written < header.Size {
+			_, err = io.CopyN(archive, zeroReader{}, header.Size-written)
+		}
+
+		return err
+	})
+	if err != nil {
+		return skipped, err
+	}
+
+	if err := archive.Close(); err != nil {
+		return skipped, err
+	}
+
+	return skipped, gz.Close()
+}
+
+// zeroReader reads zeros forever, to pad out files that shrank while being
+// backed up
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	clear(b)
+
+	return len(b), nil
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/fatih/color"
+	"github.com/urfave/cli/v2"
+)
+
+// RetentionPolicy is how many daily, weekly and monthly backups prune keeps.
+// The newest backup of each of the last Daily days is kept, and so on.
+type RetentionPolicy struct {
+	Daily   int `json:"daily"`
+	Weekly  int `json:"weekly"`
+	Monthly int `json:"monthly"`
+}
+
+// BackupListResult is the result of matrix backup list
+type BackupListResult struct {
+	Project string      `json:"project"`
+	Bucket  string      `json:"bucket"`
+	Backups []BackupSet `json:"backups"`
+}
+
+// PrunedBackup is a backup with why prune keeps it, if it does
+type PrunedBackup struct {
+	BackupSet
+
+	KeptFor []string `json:"keptFor,omitempty"`
+}
+
+// BackupPruneResult is the result of matrix backup prune
+type BackupPruneResult struct {
+	Project string          `json:"project"`
+	Policy  RetentionPolicy `json:"policy"`
+	Kept    []PrunedBackup  `json:"kept"`
+	Deleted []PrunedBackup  `json:"deleted"`
+	DryRun  bool            `json:"dryRun,omitempty"`
+}
+
+// backupCommands are the subcommands of matrix backup
+func backupCommands() []*cli.Command {
+	return []*cli.Command{
+		{
+			Name:      "list",
+			Usage:     "List a project's backups in S3",
+			ArgsUsage: "[project]",
+			Action: func(cCtx *cli.Context) error {
+				return backupList(cCtx)
+			},
+		},
+		{
+			Name:      "prune",
+			Usage:     "Delete the backups a project's retention policy doesn't keep",
+			ArgsUsage: "[project]",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "keep-daily",
+					Usage: "Days to keep the newest backup of (default: backup_keep_daily in .matrix/config or ~/.matrix/config, or 7)",
+				},
+				&cli.StringFlag{
+					Name:  "keep-weekly",
+					Usage: "Weeks to keep the newest backup of (default: backup_keep_weekly in .matrix/config or ~/.matrix/config, or 4)",
+				},
+				&cli.StringFlag{
+					Name:  "keep-monthly",
+					Usage: "Months to keep the newest backup of (default: backup_keep_monthly in .matrix/config or ~/.matrix/config, or 12)",
+				},
+				&cli.BoolFlag{
+					Name:    "yes",
+					Aliases: []string{"y"},
+					Usage:   "Don't ask for confirmation",
+				},
+			},
+			Action: func(cCtx *cli.Context) error {
+				return backupPrune(cCtx)
+			},
+		},
+	}
+}
+
+func backupList(cCtx *cli.Context) error {
+	project, err := projectNameFromArgs(cCtx)
+	if err != nil {
+		return err
+	}
+
+	ProjectName = project
+
+	ctx := context.Background()
+
+	client, err := newAWSClient(ctx, AWSProfile, "")
+	if err != nil {
+		return err
+	}
+
+	sets, err := listBackupSets(ctx, client)
+	if err != nil {
+		return err
+	}
+
+	color.Magenta("Backups of " + ProjectName + " in s3://" + ProjectName + "/backups/:")
+
+	if len(sets) == 0 {
+		color.White("  No backups yet")
+	}
+
+	// Newest first
+	for i := len(sets) - 1; i >= 0; i-- {
+		printBackupSet(sets[i], "")
+	}
+
+	return printResult(BackupListResult{Project: ProjectName, Bucket: ProjectName, Backups: sets})
+}
+
+// printBackupSet shows a backup on one line, in red if its database or files
+// archive is missing
+func printBackupSet(set BackupSet, note string) {
+	sql, files := "-", "-"
+
+	if archive := set.database(); archive != nil {
+		sql = formatSize(archive.Size)
+	}
+
+	if archive := set.archive(".tar.gz"); archive != nil {
+		files = formatSize(archive.Size)
+	}
+
+	line := "  - " + set.Timestamp + "  database " + sql + "  files " + files
+
+	if note != "" {
+		line += "  " + note
+	}
+
+	if !set.complete() {
+		color.Red(line + "  (incomplete)")
+	} else {
+		color.White(line)
+	}
+}
+
+func loadRetentionPolicy(settings Settings) (RetentionPolicy, error) {
+	policy := RetentionPolicy{}
+
+	for _, keep := range []struct {
+		Name     string
+		Fallback string
+		Value    *int
+	}{
+		{"daily", "7", &policy.Daily},
+		{"weekly", "4", &policy.Weekly},
+		{"monthly", "12", &policy.Monthly},
+	} {
+		value := settings.Get("keep-"+keep.Name, "backup_keep_"+keep.Name, keep.Fallback)
+
+		count, err := strconv.Atoi(value)
+		if err != nil || count < 0 {
+			return policy, newError(ErrConfig, "backup_keep_"+keep.Name+" '"+value+"' is not a number of backups", nil)
+		}
+
+		*keep.Value = count
+	}
+
+	// A policy that keeps nothing would delete every backup
+	if policy.Daily+policy.Weekly+policy.Monthly == 0 {
+		return policy, newError(ErrConfig, "the retention policy keeps no backups, keep at least one daily, weekly or monthly backup", nil)
+	}
+
+	return policy, nil
+}
+
+// applyRetentionPolicy works out which backups, oldest first, to keep. Going
+// from the newest, each rule keeps the newest complete backup of a day, week
+// or month until it has kept as many as it is allowed. Incomplete backups
+// can't be restored, so they are never kept and the newest complete backup
+// always is.
+func applyRetentionPolicy(sets []BackupSet, policy RetentionPolicy) []PrunedBackup {
+	rules := []struct {
+		Name   string
+		Count  int
+		Period func(set BackupSet) string
+	}{
+		{"daily", policy.Daily, func(set BackupSet) string {
+			return set.Time.Format("2006-01-02")
+		}},
+		{"weekly", policy.Weekly, func(set BackupSet) string {
+			year, week := set.Time.ISOWeek()
+			return strconv.Itoa(year) + "-W" + strconv.Itoa(week)
+		}},
+		{"monthly", policy.Monthly, func(set BackupSet) string {
+			return set.Time.Format("2006-01")
+		}},
+	}
+
+	backups := make([]PrunedBackup, len(sets))
+	for i, set := range sets {
+		backups[i] = PrunedBackup{BackupSet: set}
+	}
+
+	for _, rule := range rules {
+		last := ""
+		kept := 0
+
+		for i := len(backups) - 1; i >= 0 && kept < rule.Count; i-- {
+			if !backups[i].complete() {
+				continue
+			}
+
+			period := rule.Period(backups[i].BackupSet)
+			if period == last {
+				continue
+			}
+
+			last = period
+			kept++
+
+			backups[i].KeptFor = append(backups[i].KeptFor, rule.Name)
+		}
+	}
+
+	for i := len(backups) - 1; i >= 0; i-- {
+		if backups[i].complete() {
+			if len(backups[i].KeptFor) == 0 {
+				backups[i].KeptFor = []string{"newest"}
+			}
+
+			break
+		}
+	}
+
+	return backups
+}
+
+func backupPrune(cCtx *cli.Context) error {
+	project, err := projectNameFromArgs(cCtx)
+	if err != nil {
+		return err
+	}
+
+	ProjectName = project
+
+	settings, err := loadSettings(cCtx)
+	if err != nil {
+		return err
+	}
+
+	policy, err := loadRetentionPolicy(settings)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	client, err := newAWSClient(ctx, AWSProfile, "")
+	if err != nil {
+		return err
+	}
+
+	sets, err := listBackupSets(ctx, client)
+	if err != nil {
+		return err
+	}
+
+	result := BackupPruneResult{Project: ProjectName, Policy: policy, Kept: []PrunedBackup{}, Deleted: []PrunedBackup{}, DryRun: dryRun}
+
+	color.Magenta("Pruning backups of " + ProjectName + ", keeping " + strconv.Itoa(policy.Daily) + " daily, " + strconv.Itoa(policy.Weekly) + " weekly and " + strconv.Itoa(policy.Monthly) + " monthly:")
+
+	backups := applyRetentionPolicy(sets, policy)
+
+	for i := len(backups) - 1; i >= 0; i-- {
+		backup := backups[i]
+
+		if len(backup.KeptFor) > 0 {
+			result.Kept = append(result.Kept, backup)
+			printBackupSet(backup.BackupSet, "keep ("+strings.Join(backup.KeptFor, ", ")+")")
+		} else {
+			result.Deleted = append(result.Deleted, backup)
+			printBackupSet(backup.BackupSet, "delete")
+		}
+	}
+
+	if len(result.Deleted) == 0 {
+		color.Green("✓ Nothing to prune")
+
+		return printResult(result)
+	}
+
+	// Nothing changes in a dry run so there is nothing to confirm
+	if !dryRun && !cCtx.Bool("yes") {
+		if err := confirm("Delete " + strconv.Itoa(len(result.Deleted)) + " backups of " + ProjectName + "?"); err != nil {
+			return err
+		}
+	}
+
+	for _, backup := range result.Deleted {
+		if err := deleteBackupSet(ctx, client, backup.BackupSet); err != nil {
+			return err
+		}
+	}
+
+	if !dryRun {
+		color.Green("✓ Completed: Deleted " + strconv.Itoa(len(result.Deleted)) + " backups of " + ProjectName)
+	}
+
+	return printResult(result)
+}
+
+// deleteBackupSet deletes both archives of a backup
+func deleteBackupSet(ctx context.Context, client *AWSClient, set BackupSet) error {
+	args := []string{"s3", "rm"}
+	objects := []s3types.ObjectIdentifier{}
+
+	for _, archive := range set.Archives {
+		args = append(args, archive.URL)
+		objects = append(objects, s3types.ObjectIdentifier{Key: aws.String(archive.Key)})
+	}
+
+	return awsChange(args, func() error {
+		out, err := client.S3.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(ProjectName),
+			Delete: &s3types.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return awsError("s3 delete-objects s3://"+ProjectName, err)
+		}
+
+		for _, failed := range out.Errors {
+			return newError(ErrAWS, "deleting s3://"+ProjectName+"/"+aws.ToString(failed.Key)+": "+aws.ToString(failed.Message), nil)
+		}
+
+		return nil
+	})
+}
+
+// formatSize shows a number of bytes in the largest unit that fits
+func formatSize(bytes int64) string {
+	if bytes < 1024 {
+		return strconv.FormatInt(bytes, 10) + " B"
+	}
+
+	size := float64(bytes) / 1024
+
+	for _, unit := range []string{"KB", "MB", "GB"} {
+		if size < 1024 {
+			return strconv.FormatFloat(size, 'f', 1, 64) + " " + unit
+		}
+
+		size /= 1024
+	}
+
+	return strconv.FormatFloat(size, 'f', 1, 64) + " TB"
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApplyRetentionPolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy RetentionPolicy
+		// Backups oldest first, each with the rules it is kept for, or
+		// incomplete without a files archive
+		backups []string
+	}{
+		{
+			name:   "newest of each day",
+			policy: RetentionPolicy{Daily: 2},
+			backups: []string{
+				"2024-03-09-12-00-00",
+				"2024-03-10-09-00-00",
+				"2024-03-10-18-00-00 daily",
+				"2024-03-11-00-00-00",
+				"2024-03-11-09-30-00",
+				"2024-03-11-23-59-59 daily",
+			},
+		},
+		{
+			name:   "ISO weeks starting on Monday",
+			policy: RetentionPolicy{Weekly: 3},
+			backups: []string{
+				"2024-12-15-12-00-00",
+				"2024-12-29-12-00-00 weekly",
+				"2024-12-30-12-00-00",
+				"2025-01-05-12-00-00 weekly",
+				"2025-01-06-12-00-00 weekly",
+			},
+		},
+		{
+			name:   "ISO week across the new year",
+			policy: RetentionPolicy{Weekly: 2},
+			backups: []string{
+				"2020-12-20-12-00-00",
+				"2020-12-28-12-00-00",
+				"2021-01-03-12-00-00 weekly",
+				"2021-01-04-12-00-00 weekly",
+			},
+		},
+		{
+			name:   "same week number in different years",
+			policy: RetentionPolicy{Weekly: 2},
+			backups: []string{
+				"2023-01-09-12-00-00 weekly",
+				"2024-01-08-12-00-00 weekly",
+			},
+		},
+		{
+			name:   "months across the new year",
+			policy: RetentionPolicy{Monthly: 2},
+			backups: []string{
+				"2023-11-30-12-00-00",
+				"2023-12-01-12-00-00",
+				"2023-12-31-23-00-00 monthly",
+				"2024-01-01-00-00-00",
+				"2024-01-31-12-00-00 monthly",
+			},
+		},
+		{
+			name:   "rules overlap",
+			policy: RetentionPolicy{Daily: 3, Weekly: 2, Monthly: 2},
+			backups: []string{
+				"2024-01-20-12-00-00",
+				"2024-02-20-12-00-00",
+				"2024-02-25-12-00-00 weekly",
+				"2024-02-29-09-00-00",
+				"2024-02-29-12-00-00 daily monthly",
+				"2024-03-01-12-00-00 daily",
+				"2024-03-02-09-00-00",
+				"2024-03-02-12-00-00 daily weekly monthly",
+			},
+		},
+		{
+			name:   "fewer backups than the policy keeps",
+			policy: RetentionPolicy{Daily: 7, Weekly: 4, Monthly: 12},
+			backups: []string{
+				"2024-03-10-12-00-00 daily weekly monthly",
+			},
+		},
+		{
+			name:   "skips incomplete backups",
+			policy: RetentionPolicy{Daily: 2, Monthly: 1},
+			backups: []string{
+				"2024-03-09-12-00-00",
+				"2024-03-10-09-00-00 daily",
+				"2024-03-10-18-00-00 incomplete",
+				"2024-03-11-09-30-00 daily monthly",
+				"2024-03-11-23-59-59 incomplete",
+			},
+		},
+		{
+			name:   "keeps the newest complete backup",
+			policy: RetentionPolicy{},
+			backups: []string{
+				"2024-03-10-18-00-00",
+				"2024-03-11-09-30-00 newest",
+				"2024-03-11-23-59-59 incomplete",
+			},
+		},
+		{
+			name:   "only incomplete backups",
+			policy: RetentionPolicy{Daily: 7},
+			backups: []string{
+				"2024-03-10-18-00-00 incomplete",
+				"2024-03-11-23-59-59 incomplete",
+			},
+		},
+		{
+			name:   "no backups",
+			policy: RetentionPolicy{Daily: 7},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sets := []BackupSet{}
+			want := [][]string{}
+
+			for _, backup := range test.backups {
+				fields := strings.Fields(backup)
+
+				backupTime, err := time.Parse(backupTimeFormat, fields[0])
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				set := BackupSet{Timestamp: fields[0], Time: backupTime}
+				set.Archives = []BackupUpload{{Key: "backups/" + ProjectName + "-" + set.Timestamp + ".sql.gz"}}
+
+				if slices.Contains(fields, "incomplete") {
+					fields = fields[:1]
+				} else {
+					set.Archives = append(set.Archives, BackupUpload{Key: "backups/" + ProjectName + "-" + set.Timestamp + ".tar.gz"})
+				}
+
+				sets = append(sets, set)
+				want = append(want, fields[1:])
+			}
+
+			backups := applyRetentionPolicy(sets, test.policy)
+			if len(backups) != len(sets) {
+				t.Fatalf("got %d backups, want %d", len(backups), len(sets))
+			}
+
+			for i, backup := range backups {
+				if backup.Timestamp != sets[i].Timestamp {
+					t.Errorf("backup %d is %s, want %s", i, backup.Timestamp, sets[i].Timestamp)
+				}
+
+				if !slices.Equal(backup.KeptFor, want[i]) {
+					t.Errorf("%s is kept for %v, want %v", backup.Timestamp, backup.KeptFor, want[i])
+				}
+			}
+		})
+	}
+}
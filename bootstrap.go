@@ -0,0 +1,227 @@
+package main
+
+import (
+	"embed"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// The bootstrap script templates for each project type, with the parts they
+// share in common.sh.tmpl
+//
+//go:embed bootstrap/*.sh.tmpl
+var bootstrapTemplates embed.FS
+
+// A project can replace its type's bootstrap script with its own template,
+// which can still use the parts in common.sh.tmpl
+const projectBootstrapPath = ".matrix/bootstrap.sh.tmpl"
+
+// Where each project type is served from, relative to the clone
+var projectDocroots = map[string]string{
+	"craft":     "web",
+	"wordpress": "",
+	"laravel":   "public",
+	"static":    "",
+}
+
+// Bootstrap is how a new instance is set up for the project. Each setting
+// comes from the project's .matrix/config or ~/.matrix/config.
+type Bootstrap struct {
+	Type       string
+	Docroot    string
+	PHPVersion string
+
+	// Written to .env in the clone
+	Env map[string]string
+
+	// Run as root in the clone once everything else is done
+	PostInstall []string
+
+	// Domain to get a Let's Encrypt certificate for, see matrix domain
+	Domain       string
+	CertbotEmail string
+}
+
+// BootstrapData is what bootstrap templates are rendered with
+type BootstrapData struct {
+	Project     string
+	Type        string
+	Repo        string
+	Commit      string
+	DeployDir   string
+	Docroot     string
+	PHPVersion  string
+	Env         map[string]string
+	PostInstall []string
+
+	// Variables kept in SSM under EnvPath, which are fetched from there with
+	// the instance role in Region when FetchEnv is set, or copied to PushedEnv
+	// by matrix otherwise
+	EnvKeys   []string
+	EnvPath   string
+	FetchEnv  bool
+	PushedEnv string
+	Region    string
+
+	Domain       string
+	CertbotEmail string
+
+	// The commands that fetch the deploy key, clone the repo and check out
+	// Commit
+	Clone string
+}
+
+// detectProjectType works out what kind of project the current directory is
+func detectProjectType() string {
+	switch {
+	case fileExists("craft"):
+		return "craft"
+	case fileExists("wp-content"):
+		return "wordpress"
+	case fileExists("artisan"):
+		return "laravel"
+	}
+
+	return "static"
+}
+
+func loadBootstrap(settings Settings) (Bootstrap, error) {
+	bootstrap := Bootstrap{
+		Type:       settings.Get("", "deploy_type", detectProjectType()),
+		PHPVersion: settings.Get("", "deploy_php_version", ""),
+		Env:        settings.Prefixed("deploy_env_"),
+
+		Domain:       strings.ToLower(settings.Get("domain", "deploy_domain", "")),
+		CertbotEmail: settings.Get("", "deploy_certbot_email", ""),
+	}
+
+	docroot, ok := projectDocroots[bootstrap.Type]
+	if !ok {
+		return bootstrap, newError(ErrConfig, "unknown project type '"+bootstrap.Type+"', use "+strings.Join(projectTypes(), ", "), nil)
+	}
+
+	bootstrap.Docroot = strings.Trim(settings.Get("", "deploy_docroot", docroot), "/")
+
+	// One command per line
+	for _, command := range strings.Split(settings.Get("", "deploy_post_install", ""), "\n") {
+		if command = strings.TrimSpace(command); command != "" {
+			bootstrap.PostInstall = append(bootstrap.PostInstall, command)
+		}
+	}
+
+	return bootstrap, nil
+}
+
+func projectTypes() []string {
+	types := []string{}
+	for projectType := range projectDocroots {
+		types = append(types, projectType)
+	}
+
+	sort.Strings(types)
+
+	return types
+}
+
+// loadBootstrapTemplates parses the built in bootstrap templates, and the
+// project's own one if it has one
+func loadBootstrapTemplates() (*template.Template, error) {
+	tmpl, err := template.New("bootstrap").Funcs(template.FuncMap{"dotenv": dotenvValue, "join": strings.Join}).ParseFS(bootstrapTemplates, "bootstrap/*.sh.tmpl")
+	if err != nil {
+		return nil, newError(ErrGeneral, "loading bootstrap templates", err)
+	}
+
+	if fileExists(projectBootstrapPath) {
+		text, err := os.ReadFile(projectBootstrapPath)
+		if err != nil {
+			return nil, newError(ErrConfig, "reading "+projectBootstrapPath, err)
+		}
+
+		if _, err := tmpl.New(path.Base(projectBootstrapPath)).Parse(string(text)); err != nil {
+			return nil, newError(ErrConfig, "parsing "+projectBootstrapPath, err)
+		}
+	}
+
+	return tmpl, nil
+}
+
+// renderBootstrap renders the script a new instance runs at boot to clone and
+// set up the project, from the project's own template if it has one
+func renderBootstrap(bootstrap Bootstrap, repo string, region string, commit string, fetch bool, envKeys []string) (string, error) {
+	tmpl, err := loadBootstrapTemplates()
+	if err != nil {
+		return "", err
+	}
+
+	name := bootstrap.Type + ".sh.tmpl"
+	if fileExists(projectBootstrapPath) {
+		name = path.Base(projectBootstrapPath)
+	}
+
+	// Variables in SSM win over ones in the config
+	env := map[string]string{}
+	for key, value := range bootstrap.Env {
+		if !slices.Contains(envKeys, key) {
+			env[key] = value
+		}
+	}
+
+	data := BootstrapData{
+		Project:     ProjectName,
+		Type:        bootstrap.Type,
+		Repo:        repo,
+		Commit:      commit,
+		DeployDir:   deployDir,
+		Docroot:     strings.TrimSuffix(deployDir+"/"+bootstrap.Docroot, "/"),
+		PHPVersion:  bootstrap.PHPVersion,
+		Env:         env,
+		PostInstall: bootstrap.PostInstall,
+		EnvKeys:     envKeys,
+		EnvPath:     envParameterPath(ProjectName),
+		FetchEnv:    fetch,
+		PushedEnv:   pushedEnvPath,
+		Region:      region,
+
+		Domain:       bootstrap.Domain,
+		CertbotEmail: bootstrap.CertbotEmail,
+
+		// Lightsail instances don't have an instance role to fetch the key with
+		Clone: deployKeyScript(repo, region, fetch) + "git checkout --force " + commit + "\n",
+	}
+
+	var script strings.Builder
+	if err := tmpl.ExecuteTemplate(&script, name, data); err != nil {
+		return "", newError(ErrConfig, "rendering bootstrap script "+name, err)
+	}
+
+	return script.String(), nil
+}
+
+// renderTLSScript renders the part of the bootstrap script that gets a
+// certificate for domain, to run on an instance that is already set up
+func renderTLSScript(domain string, email string) (string, error) {
+	tmpl, err := loadBootstrapTemplates()
+	if err != nil {
+		return "", err
+	}
+
+	var script strings.Builder
+	if err := tmpl.ExecuteTemplate(&script, "tls-script", BootstrapData{Project: ProjectName, Domain: domain, CertbotEmail: email}); err != nil {
+		return "", newError(ErrGeneral, "rendering certificate script", err)
+	}
+
+	return script.String(), nil
+}
+
+// dotenvValue quotes a value for a .env file so it is read back as is
+func dotenvValue(value string) string {
+	if !strings.ContainsAny(value, "'\n") {
+		return "'" + value + "'"
+	}
+
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "\n", `\n`).Replace(value) + `"`
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/joho/godotenv"
+	"github.com/urfave/cli/v2"
+)
+
+// matrixConfigPath is the global config written by matrix configure
+func matrixConfigPath() string {
+	return os.Getenv("HOME") + "/.matrix/config"
+}
+
+// readMatrixConfig reads ~/.matrix/config without touching the environment.
+// A missing file is the same as an empty one.
+func readMatrixConfig() (map[string]string, error) {
+	if !fileExists(matrixConfigPath()) {
+		return map[string]string{}, nil
+	}
+
+	values, err := godotenv.Read(matrixConfigPath())
+	if err != nil {
+		return nil, newError(ErrConfig, "loading ~/.matrix/config", err)
+	}
+
+	return values, nil
+}
+
+// configList splits a comma separated config value, dropping empty entries
+func configList(value string) []string {
+	var list []string
+
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
+
+// projectConfigPath is the per-project manifest, committed in the project repo
+const projectConfigPath = ".matrix/config"
+
+// readProjectConfig reads the current project's .matrix/config, which uses
+// the same format as ~/.matrix/config. A missing file is the same as an empty
+// one.
+func readProjectConfig() (map[string]string, error) {
+	if !fileExists(projectConfigPath) {
+		return map[string]string{}, nil
+	}
+
+	values, err := godotenv.Read(projectConfigPath)
+	if err != nil {
+		return nil, newError(ErrConfig, "loading "+projectConfigPath, err)
+	}
+
+	return values, nil
+}
+
+// Settings looks each setting up from a flag, then the project's
+// .matrix/config, then ~/.matrix/config
+type Settings struct {
+	cCtx    *cli.Context
+	project map[string]string
+	global  map[string]string
+}
+
+func loadSettings(cCtx *cli.Context) (Settings, error) {
+	project, err := readProjectConfig()
+	if err != nil {
+		return Settings{}, err
+	}
+
+	global, err := readMatrixConfig()
+	if err != nil {
+		return Settings{}, err
+	}
+
+	return Settings{cCtx: cCtx, project: project, global: global}, nil
+}
+
+// Get returns the value of flag if it was given, otherwise key from the
+// project or global config, otherwise fallback. A flag that can be repeated,
+// like --region for the commands that search several, only sets a setting
+// when it is given once.
+func (settings Settings) Get(flag string, key string, fallback string) string {
+	if settings.cCtx != nil && flag != "" && settings.cCtx.IsSet(flag) {
+		if _, repeatable := settings.cCtx.Value(flag).(cli.StringSlice); !repeatable {
+			return settings.cCtx.String(flag)
+		}
+
+		if values := settings.cCtx.StringSlice(flag); len(values) == 1 {
+			return values[0]
+		}
+	}
+
+	if value := settings.project[key]; value != "" {
+		return value
+	}
+
+	if value := settings.global[key]; value != "" {
+		return value
+	}
+
+	return fallback
+}
+
+// Prefixed returns the settings whose keys start with prefix, without it.
+// Project settings win over global ones with the same key.
+func (settings Settings) Prefixed(prefix string) map[string]string {
+	values := map[string]string{}
+
+	for _, config := range []map[string]string{settings.global, settings.project} {
+		for key, value := range config {
+			if name, ok := strings.CutPrefix(key, prefix); ok && name != "" {
+				values[name] = value
+			}
+		}
+	}
+
+	return values
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/urfave/cli/v2"
+)
+
+func TestSettingsGet(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		flag string
+		key  string
+		want string
+	}{
+		{"flag", []string{"--profile", "client"}, "profile", "deploy_profile", "client"},
+		{"repeatable flag given once", []string{"--region", "eu-west-1"}, "region", "deploy_region", "eu-west-1"},
+		{"repeatable flag given more than once", []string{"--region", "eu-west-1", "--region", "us-east-1"}, "region", "deploy_region", "eu-west-2"},
+		{"config", nil, "region", "deploy_region", "eu-west-2"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := ""
+
+			app := &cli.App{
+				Flags: []cli.Flag{&cli.StringFlag{Name: "profile"}, &cli.StringSliceFlag{Name: "region"}},
+				Action: func(cCtx *cli.Context) error {
+					settings := Settings{cCtx: cCtx, project: map[string]string{"deploy_profile": "matrix", "deploy_region": "eu-west-2"}}
+
+					got = settings.Get(test.flag, test.key, "")
+
+					return nil
+				},
+			}
+
+			if err := app.Run(append([]string{"matrix"}, test.args...)); err != nil {
+				t.Fatal(err)
+			}
+
+			if got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
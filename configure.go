@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"os"
 	"os/exec"
 
@@ -10,12 +9,12 @@ import (
 	"github.com/joho/godotenv"
 )
 
-func configureMatrix() {
+func configureMatrix() error {
 	// If config already setup then exit
 	if fileExists(os.Getenv("HOME") + "/.matrix/config") {
 		color.Green("✓ Matrix CLI Already Configured")
 
-		return
+		return nil
 	}
 
 	// Create config file
@@ -45,18 +44,20 @@ func configureMatrix() {
 	userMatrixConfigData += "aws_role_name = " + awsRoleName + "\n\n"
 
 	if !fileExists(userMatrixPath) {
-		runCommand(exec.Command("mkdir", "-p", userMatrixPath), false, false, true)
+		if err := runCommand(exec.Command("mkdir", "-p", userMatrixPath), false, false, true); err != nil {
+			return err
+		}
 	}
 
 	// Write to ~/.matrix/config
 	color.White("Writing to: " + userMatrixConfigPath)
 	f, err := os.OpenFile(userMatrixConfigPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
-		log.Fatal(err)
+		return newError(ErrConfig, userMatrixConfigPath, err)
 	}
 	defer f.Close()
 	if _, err := f.WriteString(userMatrixConfigData); err != nil {
-		log.Fatal(err)
+		return newError(ErrConfig, userMatrixConfigPath, err)
 	}
 
 	color.Green("✓ Completed: Writing to: " + userMatrixConfigPath)
@@ -64,23 +65,29 @@ func configureMatrix() {
 	color.Magenta("--------------------------------------------------")
 	color.Magenta("🎉            MATRIX POWER ACTIVATED            🎉")
 	color.Magenta("--------------------------------------------------")
+
+	return nil
 }
 
-func configureGithub() {
+func configureGithub() error {
 	// run command: gh auth login and allow to reply to prompt
 	s.Stop()
 	cmd := exec.Command("gh", "auth", "login", "--git-protocol", "ssh")
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	cmd.Run()
+	if err := executor.Run(cmd); err != nil {
+		return commandError(ErrGitHub, cmd, err)
+	}
 
 	color.Magenta("--------------------------------------------------")
 	color.Magenta("🎉            GITHUB POWER ACTIVATED            🎉")
 	color.Magenta("--------------------------------------------------")
+
+	return nil
 }
 
-func configureAWS() {
+func configureAWS() error {
 	color.Magenta("Configuring Matrix CLI with AWS IAM Identity Center")
 
 	userAwsPath := os.Getenv("HOME") + "/.aws"
@@ -95,7 +102,7 @@ func configureAWS() {
 	if fileExists(os.Getenv("HOME") + "/.matrix/config") {
 		err := godotenv.Load(os.Getenv("HOME") + "/.matrix/config")
 		if err != nil {
-			log.Fatal("Error loading .matrix/config file")
+			return newError(ErrConfig, "loading ~/.matrix/config", err)
 		}
 
 		ssoRegion = os.Getenv("aws_region")
@@ -103,15 +110,18 @@ func configureAWS() {
 		ssoStartUrl = os.Getenv("aws_start_url")
 		ssoRoleName = os.Getenv("aws_role_name")
 	} else {
-		color.Red("× Error: Missing ~/.matrix/config file")
-		os.Exit(1)
+		return newError(ErrConfig, "missing ~/.matrix/config file", nil)
 	}
 
 	if !fileExists(userAwsPath + "/config") {
-		runCommand(exec.Command("mkdir", "-p", userAwsPath), false, false, true)
+		if err := runCommand(exec.Command("mkdir", "-p", userAwsPath), false, false, true); err != nil {
+			return err
+		}
 	} else {
 		// Rename old config file
-		runCommand(exec.Command("mv", userAwsPath+"/config", userAwsPath+"/config.old"), false, false, true)
+		if err := runCommand(exec.Command("mv", userAwsPath+"/config", userAwsPath+"/config.old"), false, false, true); err != nil {
+			return err
+		}
 	}
 
 	// Setup aws config data
@@ -130,11 +140,11 @@ func configureAWS() {
 	color.White("Writing to: " + userAwsPath + "/config")
 	f, err := os.OpenFile(userAwsPath+"/config", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
-		log.Fatal(err)
+		return newError(ErrConfig, userAwsPath+"/config", err)
 	}
 	defer f.Close()
 	if _, err := f.WriteString(data); err != nil {
-		log.Fatal(err)
+		return newError(ErrConfig, userAwsPath+"/config", err)
 	}
 	color.Green("✓ Completed: Writing to: " + userAwsPath + "/config")
 
@@ -143,9 +153,13 @@ func configureAWS() {
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	cmd.Run()
+	if err := executor.Run(cmd); err != nil {
+		return commandError(ErrAWSAuthExpired, cmd, err)
+	}
 
 	color.Magenta("--------------------------------------------------")
 	color.Magenta("🎉            AWS POWER ACTIVATED               🎉")
 	color.Magenta("--------------------------------------------------")
+
+	return nil
 }
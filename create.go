@@ -1,28 +1,28 @@
 package main
 
 import (
-	"os"
-
 	"github.com/fatih/color"
 	"github.com/urfave/cli/v2"
 )
 
-func create(cCtx *cli.Context) {
+func create(cCtx *cli.Context) error {
 	ProjectName = cCtx.Args().First()
 
 	if ProjectName == "" {
-		color.Red("× Error: Missing project name")
-		os.Exit(1)
+		return newError(ErrMissingProjectName, "", nil)
 	}
 
 	if fileExists(ProjectName) {
-		color.Red("× Error: Project directory already exists")
-		os.Exit(2)
+		return newError(ErrProjectExists, ProjectName, nil)
 	}
 
 	color.Magenta("Creating new Craft CMS project: " + ProjectName)
 
-	setupProject(true, false)
+	if err := setupProject(true, false); err != nil {
+		return err
+	}
 
 	color.Magenta("Project Ready! cd " + ProjectName)
+
+	return printResult(ActionResult{Action: "create", Project: ProjectName, Path: "./" + ProjectName, DryRun: dryRun})
 }
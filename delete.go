@@ -1,26 +1,23 @@
 package main
 
 import (
-	"os"
 	"os/exec"
 
 	"github.com/fatih/color"
 	"github.com/urfave/cli/v2"
 )
 
-func delete(cCtx *cli.Context) {
+func delete(cCtx *cli.Context) error {
 	color.White(ProjectName)
 
 	ProjectName = cCtx.Args().First()
 
 	if ProjectName == "" {
-		color.Red("× Error: Missing project name")
-		os.Exit(1)
+		return newError(ErrMissingProjectName, "", nil)
 	}
 
 	if !fileExists(ProjectName) {
-		color.Red("× Error: Project directory not found")
-		os.Exit(2)
+		return newError(ErrProjectNotFound, ProjectName, nil)
 	}
 
 	color.Magenta("Deleting project: " + ProjectName)
@@ -29,7 +26,11 @@ func delete(cCtx *cli.Context) {
 	runCommand(exec.Command("ddev", "stop", "--remove-data", "--omit-snapshot"), false, true, false)
 
 	// rm -rf {ProjectName}
-	runCommand(exec.Command("rm", "-rf", ProjectName), false, false, true)
+	if err := runCommand(exec.Command("rm", "-rf", ProjectName), false, false, true); err != nil {
+		return err
+	}
 
 	color.Magenta("Project Deleted!")
+
+	return printResult(ActionResult{Action: "delete", Project: ProjectName, Path: "./" + ProjectName, DryRun: dryRun})
 }
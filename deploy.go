@@ -1,221 +1,422 @@
 package main
 
 import (
-	"encoding/json"
-	"log"
-	"os"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"os/exec"
 	"strings"
-	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
 	"github.com/fatih/color"
 	"github.com/urfave/cli/v2"
 )
 
-func deploy(cCtx *cli.Context) {
-	// Deploy an AWS EC2 instance using the Git repo from the current directory using launch template
-	color.Magenta("Deploying project to AWS")
+// DeployResult is the result of matrix deploy
+type DeployResult struct {
+	Project    string `json:"project"`
+	DeployID   string `json:"deployId,omitempty"`
+	Commit     string `json:"commit,omitempty"`
+	InstanceID string `json:"instanceId,omitempty"`
+	State      string `json:"state,omitempty"`
+	PublicIP   string `json:"publicIp,omitempty"`
+	URL        string `json:"url,omitempty"`
+	Domain     string `json:"domain,omitempty"`
+	Updated    bool   `json:"updated,omitempty"`
+	DryRun     bool   `json:"dryRun,omitempty"`
+
+	DeployConfig
+}
 
-	var launchTemplateName string = "matrix-2023-10-01"
-	var instanceType string = "t2.micro"
-	var profileName string = "matrix"
+// DeployConfig is what a project is deployed with. Each setting comes from
+// its flag, the project's .matrix/config, or ~/.matrix/config.
+type DeployConfig struct {
+	Target  string `json:"target"`
+	Ref     string `json:"ref,omitempty"`
+	Region  string `json:"region,omitempty"`
+	Profile string `json:"profile"`
 
-	// Get project name
-	ProjectName = cCtx.Args().First()
+	// Where deploy history is kept, see saveDeployRecord
+	History string `json:"-"`
 
-	if ProjectName == "" {
-		// Get project name from current directory
-		workingDir, err := os.Getwd()
-		if err != nil {
-			color.Red("× Error: " + err.Error())
-			os.Exit(1)
-		}
+	// How to tell the deploy worked
+	Health HealthCheck `json:"-"`
+
+	// How new instances are set up
+	Bootstrap Bootstrap `json:"-"`
+
+	// EC2 settings
+	LaunchTemplate string `json:"launchTemplate,omitempty"`
+	InstanceType   string `json:"instanceType,omitempty"`
+
+	// Lightsail settings
+	Blueprint string `json:"blueprint,omitempty"`
+	Bundle    string `json:"bundle,omitempty"`
+	Zone      string `json:"zone,omitempty"`
+}
+
+func loadDeployConfig(cCtx *cli.Context) (DeployConfig, error) {
+	settings, err := loadSettings(cCtx)
+	if err != nil {
+		return DeployConfig{}, err
+	}
+
+	config := DeployConfig{
+		Target:  settings.Get("target", "deploy_target", ProviderEC2),
+		Ref:     settings.Get("ref", "deploy_ref", ""),
+		Region:  settings.Get("region", "deploy_region", ""),
+		Profile: settings.Get("profile", "deploy_profile", AWSProfile),
+		History: settings.Get("", "deploy_history", defaultDeployHistory),
+	}
+
+	if config.Health, err = loadHealthCheck(settings); err != nil {
+		return config, err
+	}
 
-		ProjectName = strings.Split(workingDir, "/")[len(strings.Split(workingDir, "/"))-1]
+	if config.Bootstrap, err = loadBootstrap(settings); err != nil {
+		return config, err
+	}
 
-		color.White("Project Name: " + ProjectName)
+	switch config.Target {
+	case ProviderEC2:
+		config.LaunchTemplate = settings.Get("launch-template", "deploy_launch_template", "matrix-2023-10-01")
+		config.InstanceType = settings.Get("instance-type", "deploy_instance_type", "t2.micro")
+	case ProviderLightsail:
+		config.Blueprint = settings.Get("blueprint", "deploy_blueprint", "lamp_8_bitnami")
+		config.Bundle = settings.Get("bundle", "deploy_bundle", "small_3_0")
+		config.Zone = settings.Get("zone", "deploy_zone", "")
+	default:
+		return config, newError(ErrConfig, "unknown deploy target '"+config.Target+"', use ec2 or lightsail", nil)
 	}
 
-	// Check if project is craft
-	if fileExists("craft") {
-		ProjectType = "craft"
+	return config, nil
+}
+
+// validateDeployConfig checks what the project is deployed with exists in the
+// region before anything is launched
+func validateDeployConfig(ctx context.Context, client *AWSClient, config DeployConfig) error {
+	if config.Target == ProviderLightsail {
+		return validateLightsailDeployConfig(ctx, client, config)
 	}
 
-	// Check if project is wordpress
-	if fileExists("wp-content") {
-		ProjectType = "wordpress"
+	return validateEC2DeployConfig(ctx, client, config)
+}
+
+func validateEC2DeployConfig(ctx context.Context, client *AWSClient, config DeployConfig) error {
+	templates, err := client.EC2.DescribeLaunchTemplates(ctx, &ec2.DescribeLaunchTemplatesInput{
+		LaunchTemplateNames: []string{config.LaunchTemplate},
+	})
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && strings.HasPrefix(apiErr.ErrorCode(), "InvalidLaunchTemplateName") || err == nil && len(templates.LaunchTemplates) == 0 {
+		return newError(ErrConfig, "launch template '"+config.LaunchTemplate+"' not found in "+client.Region, nil)
 	}
 
-	// Get github token
-	cmd := exec.Command("gh", "auth", "token")
-	out, err := cmd.Output()
 	if err != nil {
-		color.Red("× Error Running: " + cmd.String())
-		color.Red("× " + err.Error())
-		os.Exit(1)
+		return awsError("ec2 describe-launch-templates", err)
 	}
-	githubToken := string(out)
 
-	// Get current git remote url
-	cmd = exec.Command("git", "config", "--get", "remote.origin.url")
-	out, err = cmd.Output()
+	out, err := client.EC2.DescribeInstanceTypeOfferings(ctx, &ec2.DescribeInstanceTypeOfferingsInput{
+		LocationType: ec2types.LocationTypeRegion,
+		Filters: []ec2types.Filter{
+			{Name: aws.String("instance-type"), Values: []string{config.InstanceType}},
+		},
+	})
 	if err != nil {
-		color.Red("× Error Running: " + cmd.String())
-		color.Red("× " + err.Error())
-		os.Exit(1)
+		return awsError("ec2 describe-instance-type-offerings", err)
+	}
+
+	if len(out.InstanceTypeOfferings) == 0 {
+		return newError(ErrConfig, "instance type '"+config.InstanceType+"' is not available in "+client.Region, nil)
 	}
-	gitRemoteUrl := string(out)
 
-	// Convert git remote URL to HTTPS
-	if string(out[0:3]) == "git" {
-		gitRemoteUrl = "https://" + string(out[4:len(out)-5])
+	return nil
+}
 
-		// github.com: should be github.com/
-		gitRemoteUrl = strings.Replace(gitRemoteUrl, "github.com:", "github.com/", 1)
+func deploy(cCtx *cli.Context) error {
+	// Deploy the Git repo from the current directory to an AWS EC2 instance
+	// (from the launch template) or a Lightsail instance, updating the
+	// project's existing instance in place when there is one
+
+	// Keep stdout for the script itself
+	if cCtx.Bool("print-user-data") {
+		color.Output = color.Error
 	}
 
-	// Get current github username
-	cmd = exec.Command("gh", "api", "user")
-	out, err = cmd.Output()
+	color.Magenta("Deploying project to AWS")
+
+	// Get project name, from the current directory if not given
+	project, err := projectNameFromArgs(cCtx)
 	if err != nil {
-		color.Red("× Error Running: " + cmd.String())
-		color.Red("× " + err.Error())
-		os.Exit(1)
+		return err
 	}
-	githubUsernameJson := string(out)
 
-	// Get github username from JSON
-	githubUsername := strings.Split(githubUsernameJson, "\"")[3]
+	ProjectName = project
 
-	color.White("Git Username: " + githubUsername)
-	color.White("Git Remote URL: " + gitRemoteUrl)
-	color.White("Git Token: " + githubToken)
+	color.White("Project Name: " + ProjectName)
 
-	// Add username:token to git remote URL
-	gitRemoteUrl = strings.Replace(gitRemoteUrl, "https://", "https://"+githubUsername+":"+githubToken+"@", 1)
+	// Get current git remote url
+	cmd := exec.Command("git", "config", "--get", "remote.origin.url")
+	out, err := executor.Lookup(cmd)
+	if err != nil {
+		return commandError(ErrConfig, cmd, err)
+	}
 
-	// Remove new line
-	gitRemoteUrl = strings.Replace(gitRemoteUrl, "\n", "", 1)
+	repo, err := githubRepoFromRemote(string(out))
+	if err != nil {
+		return err
+	}
+
+	color.White("Git Repo: " + repo)
 
-	color.White("Git Remote URL: " + gitRemoteUrl)
+	ctx := context.Background()
 
-	// Start creating deploy script
-	data := "#!/bin/bash\n"
+	config, err := loadDeployConfig(cCtx)
+	if err != nil {
+		return err
+	}
 
-	// cd to /var/www/html
-	data += "cd /var/www/html\n"
+	ProjectType = config.Bootstrap.Type
 
-	// if ProjectType == "craft" {
-	// 	// Edit /opt/bitnami/apache/conf/bitnami/bitnami.conf and change /opt/bitnami/apache/htdocs to /opt/bitnami/apache/htdocs/web and save
-	// 	data += "sed -i 's|/opt/bitnami/apache/htdocs|/opt/bitnami/apache/htdocs/web|g' /opt/bitnami/apache2/conf/bitnami/bitnami.conf\n"
+	color.White("Project Type: " + ProjectType)
 
-	// 	// Restart Apache
-	// 	data += "/opt/bitnami/ctlscript.sh restart apache\n"
-	// }
+	client, err := newAWSClient(ctx, config.Profile, config.Region)
+	if err != nil {
+		return err
+	}
 
-	// git clone repo into current directory
-	data += "git clone " + gitRemoteUrl + " .\n"
+	config.Region = client.Region
 
-	// If deploy.sh script already exists then make a copy and delete it
-	if fileExists("deploy.sh") {
-		runCommand(exec.Command("mv", "deploy.sh", "deploy.sh.old"), false, false, true)
+	if config.Target == ProviderLightsail && config.Zone == "" {
+		config.Zone = config.Region + "a"
 	}
 
-	// Write to deploy.sh
-	color.White("Writing to: deploy.sh")
-	f, err := os.OpenFile("deploy.sh", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		log.Fatal(err)
+	// Show what a new instance would run without deploying anything
+	if cCtx.Bool("print-user-data") {
+		commit, err := resolveDeployRef(config.Ref)
+		if err != nil {
+			return err
+		}
+
+		env, err := getEnvParameters(ctx, client, ProjectName, false)
+		if err != nil {
+			return err
+		}
+
+		script, err := renderBootstrap(config.Bootstrap, repo, config.Region, commit, config.Target == ProviderEC2, sortedKeys(env))
+		if err != nil {
+			return err
+		}
+
+		fmt.Print(script)
+
+		return nil
 	}
-	defer f.Close()
-	if _, err := f.WriteString(data); err != nil {
-		log.Fatal(err)
+
+	if err := validateDeployConfig(ctx, client, config); err != nil {
+		return err
 	}
 
-	color.Green("✓ Completed: Writing to: deploy.sh")
+	if config.Target == ProviderLightsail {
+		color.White("Blueprint: " + config.Blueprint)
+		color.White("Bundle: " + config.Bundle)
+		color.White("Zone: " + config.Zone + " (Profile " + config.Profile + ")")
+	} else {
+		color.White("Launch Template: " + config.LaunchTemplate)
+		color.White("Instance Type: " + config.InstanceType)
+		color.White("Region: " + config.Region + " (Profile " + config.Profile + ")")
+	}
 
-	// Run a EC2 instance using the git repo from the current directory
-	cmd = exec.Command("aws", "ec2", "run-instances", "--launch-template", "LaunchTemplateName="+launchTemplateName, "--instance-type", instanceType, "--user-data", "file://deploy.sh", "--tag-specifications", "ResourceType=instance,Tags=[{Key=Name,Value="+ProjectName+"}]", "--profile", profileName)
-	out, err = cmd.Output()
+	commit, err := resolveDeployRef(config.Ref)
 	if err != nil {
-		color.Red("× Error Running: " + cmd.String())
-		color.Red("× " + err.Error())
-		// More error details (TODO: Add to more errors)
-		color.Red("× " + string(err.(*exec.ExitError).Stderr))
-		os.Exit(1)
+		return err
 	}
 
-	// Get instance ID from JSON
-	instanceID := strings.Split(string(out), "\"InstanceId\": \"")[1]
-	instanceID = strings.Split(instanceID, "\"")[0]
+	color.White("Git Ref: " + valueOr(config.Ref, "HEAD") + " (" + shortCommit(commit) + ")")
 
-	color.White("Instance ID: " + instanceID)
+	record := newDeployRecord(config, commit)
+	claimDeployID(ctx, client, config.History, &record)
 
-	// Delete deploy.sh file
-	runCommand(exec.Command("rm", "deploy.sh"), false, false, true)
+	instance, updated, err := deployInstance(ctx, cCtx, client, config, repo, &record)
 
-	color.Green("✓ Completed: Started new EC2 instance")
+	// Nothing was launched so there is nothing to report
+	if dryRun {
+		if err != nil {
+			return err
+		}
+
+		return printResult(DeployResult{Project: ProjectName, Commit: commit, DryRun: true, DeployConfig: config})
+	}
+
+	// The boot script waits for the domain to resolve before getting a
+	// certificate for it
+	if err == nil && config.Bootstrap.Domain != "" {
+		err = deployDomain(ctx, cCtx, config, instance, updated)
+	}
+
+	// Running isn't deployed, the boot script may still be going or have failed
+	if err == nil {
+		err = checkDeployHealth(ctx, cCtx, config, instance, !updated)
+	}
+
+	record.finish(instance, updated, err)
+
+	if historyErr := saveDeployRecord(ctx, client, config.History, &record); historyErr != nil {
+		color.Yellow("× Couldn't save deploy history: " + historyErr.Error())
+	}
+
+	if err != nil {
+		return err
+	}
 
 	color.Magenta("--------------------------------------------------")
-	color.Magenta("🎉            DEPLOYMENT STARTED                🎉")
+	color.Magenta("🎉            DEPLOYMENT COMPLETE               🎉")
 	color.Magenta("--------------------------------------------------")
 
-	// Check if instance is running and wait until it is
-	color.Magenta("Checking if instance is running")
+	// Get IP of the new instance
+	instancePublicIpAddress := instance.PublicIP
+
+	url := "http://" + instancePublicIpAddress
+	if config.Bootstrap.Domain != "" {
+		url = "https://" + config.Bootstrap.Domain
+	}
+
+	// Print URL
+	color.White(url)
+
+	return printResult(DeployResult{
+		Project:    ProjectName,
+		DeployID:   record.ID,
+		Commit:     commit,
+		InstanceID: instance.ID,
+		State:      instance.State,
+		PublicIP:   instancePublicIpAddress,
+		URL:        url,
+		Domain:     config.Bootstrap.Domain,
+		Updated:    updated,
+
+		DeployConfig: config,
+	})
+}
+
+// deployInstance puts the record's commit on the server the project is
+// already deployed to, or launches a new one. It reports whether an existing
+// server was updated.
+func deployInstance(ctx context.Context, cCtx *cli.Context, client *AWSClient, config DeployConfig, repo string, record *DeployRecord) (Instance, bool, error) {
+	commit := record.Commit
+
+	// Update the server the project is already on rather than launching another
+	if !cCtx.Bool("new-instance") {
+		instance, err := findDeployedInstance(ctx, client, config)
+
+		if err == nil {
+			// Back up the database first so the deploy can be rolled back
+			if dbBackupCommand(ProjectType, "") != "" {
+				record.Backup = dbBackupPath(record.ID)
+			}
+
+			instance, err = updateDeployment(ctx, cCtx, client, instance, updateScript(ProjectType, commit, record.Backup, ""))
+
+			return instance, true, err
+		}
 
-	var instanceState string = "pending"
+		if !errors.Is(err, ErrInstanceNotFound) {
+			return instance, false, err
+		}
+	}
+
+	// The instance clones with a deploy key rather than anyone's GitHub token
+	if err := provisionDeployKey(ctx, client, repo); err != nil {
+		return Instance{}, false, err
+	}
+
+	// Only the names are needed, the instance gets the values itself
+	env, err := getEnvParameters(ctx, client, ProjectName, false)
+	if err != nil {
+		return Instance{}, false, err
+	}
 
-	// Set spinner message
-	s.Suffix = " Instance Status: " + instanceState
+	data, err := renderBootstrap(config.Bootstrap, repo, client.Region, commit, config.Target == ProviderEC2, sortedKeys(env))
+	if err != nil {
+		return Instance{}, false, err
+	}
 
-	// Start the spinner
-	s.Start()
+	var instance Instance
+
+	if config.Target == ProviderLightsail {
+		instance, err = deployToLightsail(ctx, cCtx, client, config, data)
+	} else {
+		instance, err = deployToEC2(ctx, client, config, data)
+	}
 
-	for instanceState != "running" {
-		cmd = exec.Command("aws", "ec2", "describe-instances", "--instance-ids", instanceID, "--profile", profileName)
+	return instance, false, err
+}
+
+// deployToEC2 launches an EC2 instance from the launch template that runs
+// script at boot, and waits for it to be running
+func deployToEC2(ctx context.Context, client *AWSClient, config DeployConfig, script string) (Instance, error) {
+	// Run a EC2 instance using the git repo from the current directory
+	var instanceID string
 
-		out, err = cmd.Output()
+	err := awsChange([]string{"ec2", "run-instances", "--launch-template", "LaunchTemplateName=" + config.LaunchTemplate, "--instance-type", config.InstanceType, "--user-data", "(deploy script)", "--tag-specifications", "ResourceType=instance,Tags=[{Key=Name,Value=" + ProjectName + "},{Key=matrix:project,Value=" + ProjectName + "}]", "ResourceType=volume,Tags=[{Key=Name,Value=" + ProjectName + "},{Key=matrix:project,Value=" + ProjectName + "}]", "--profile", config.Profile, "--region", config.Region}, func() error {
+		tags := []ec2types.Tag{
+			{Key: aws.String("Name"), Value: aws.String(ProjectName)},
+			{Key: aws.String("matrix:project"), Value: aws.String(ProjectName)},
+		}
+
+		out, err := client.EC2.RunInstances(ctx, &ec2.RunInstancesInput{
+			LaunchTemplate: &ec2types.LaunchTemplateSpecification{LaunchTemplateName: aws.String(config.LaunchTemplate)},
+			InstanceType:   ec2types.InstanceType(config.InstanceType),
+			MinCount:       aws.Int32(1),
+			MaxCount:       aws.Int32(1),
+			UserData:       aws.String(base64.StdEncoding.EncodeToString([]byte(script))),
+			// Volumes are tagged too so teardown can find them once the
+			// instance is gone
+			TagSpecifications: []ec2types.TagSpecification{
+				{ResourceType: ec2types.ResourceTypeInstance, Tags: tags},
+				{ResourceType: ec2types.ResourceTypeVolume, Tags: tags},
+			},
+		})
 		if err != nil {
-			color.Red("× Error Running: " + cmd.String())
-			color.Red("× " + err.Error())
-			os.Exit(1)
+			return awsError("ec2 run-instances", err)
 		}
 
-		// Get ['Reservations'][0]['Instances'][0]['State']['Name']
-		var result map[string]interface{}
-		json.Unmarshal([]byte(out), &result)
-		instanceState = result["Reservations"].([]interface{})[0].(map[string]interface{})["Instances"].([]interface{})[0].(map[string]interface{})["State"].(map[string]interface{})["Name"].(string)
+		instanceID = aws.ToString(out.Instances[0].InstanceId)
 
-		// Update spinner status
-		s.Suffix = " Instance Status: " + instanceState
+		return nil
+	})
+	if err != nil {
+		return Instance{}, err
+	}
 
-		// Wait 10 seconds
-		time.Sleep(10 * time.Second)
+	// Nothing was launched so there is nothing to wait for
+	if dryRun {
+		return Instance{}, nil
 	}
 
-	// Stop the spinner
-	s.Stop()
+	color.White("Instance ID: " + instanceID)
 
-	color.Green("✓ Success: Instance is running")
+	color.Green("✓ Completed: Started new EC2 instance")
 
 	color.Magenta("--------------------------------------------------")
-	color.Magenta("🎉            DEPLOYMENT COMPLETE               🎉")
+	color.Magenta("🎉            DEPLOYMENT STARTED                🎉")
 	color.Magenta("--------------------------------------------------")
 
-	// Get IP of the new instance as a var
-	cmd = exec.Command("aws", "ec2", "describe-instances", "--filters", "Name=tag:Name,Values="+ProjectName, "--profile", profileName)
+	// Check if instance is running and wait until it is
+	color.Magenta("Checking if instance is running")
 
-	out, err = cmd.Output()
+	instance, err := waitForInstanceState(ctx, client, Instance{Provider: ProviderEC2, Name: ProjectName, ID: instanceID, State: "pending", Region: config.Region, Profile: config.Profile}, "running", instanceWaitTimeout)
 	if err != nil {
-		color.Red("× Error Running: " + cmd.String())
-		color.Red("× " + err.Error())
-		os.Exit(1)
+		return instance, err
 	}
 
-	// Get ['Reservations'][0]['Instances'][0]['PublicIpAddress']
-	instancePublicIpAddress := strings.Split(string(out), "\"PublicIpAddress\": \"")[1]
-	instancePublicIpAddress = strings.Split(instancePublicIpAddress, "\"")[0]
+	color.Green("✓ Success: Instance is running")
+
+	forgetHostKey(instance)
 
-	// Print IP
-	color.White("http://" + instancePublicIpAddress)
+	return instance, nil
 }
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/urfave/cli/v2"
+)
+
+// How long a new instance's boot script gets to clone and install the project
+const cloudInitTimeout = 20 * time.Minute
+
+// How long sshd on a new instance gets to start accepting connections
+const sshStartupTimeout = 5 * time.Minute
+
+// Where cloud-init logs the output of the boot script
+const cloudInitLog = "/var/log/cloud-init-output.log"
+
+// HealthCheck is how deploy tells the site is up once it has been deployed
+type HealthCheck struct {
+	// A full URL, or a path on the instance's public IP
+	URL     string
+	Status  int
+	Match   *regexp.Regexp
+	Timeout time.Duration
+}
+
+func loadHealthCheck(settings Settings) (HealthCheck, error) {
+	check := HealthCheck{URL: settings.Get("health-url", "deploy_health_url", "/")}
+
+	status := settings.Get("health-status", "deploy_health_status", "200")
+
+	var err error
+	if check.Status, err = strconv.Atoi(status); err != nil {
+		return check, newError(ErrConfig, "health check status '"+status+"' is not a number", nil)
+	}
+
+	if match := settings.Get("health-match", "deploy_health_match", ""); match != "" {
+		if check.Match, err = regexp.Compile(match); err != nil {
+			return check, newError(ErrConfig, "health check match '"+match+"' is not a valid regular expression", err)
+		}
+	}
+
+	timeout := settings.Get("health-timeout", "deploy_health_timeout", "5m")
+	if check.Timeout, err = time.ParseDuration(timeout); err != nil {
+		return check, newError(ErrConfig, "health check timeout '"+timeout+"' is not a duration like 5m", nil)
+	}
+
+	return check, nil
+}
+
+// deployHealthFlags are the flags of the commands that check a deploy worked
+func deployHealthFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "health-url",
+			Usage: "URL, or path on the instance's public IP, that should respond once deployed (default: deploy_health_url in .matrix/config or ~/.matrix/config, or /)",
+		},
+		&cli.StringFlag{
+			Name:  "health-status",
+			Usage: "HTTP status the health URL should respond with (default: deploy_health_status in .matrix/config or ~/.matrix/config, or 200)",
+		},
+		&cli.StringFlag{
+			Name:  "health-match",
+			Usage: "Regular expression the health URL's response should match (default: deploy_health_match in .matrix/config or ~/.matrix/config)",
+		},
+		&cli.StringFlag{
+			Name:  "health-timeout",
+			Usage: "How long to wait for the health URL (default: deploy_health_timeout in .matrix/config or ~/.matrix/config, or 5m)",
+		},
+		&cli.BoolFlag{
+			Name:  "skip-health-check",
+			Usage: "Don't wait for the boot script or check the health URL",
+		},
+	}
+}
+
+// checkDeployHealth waits for a new instance's boot script to finish and then
+// for the site to respond as configured, so a deploy is only complete once
+// the project is actually being served
+func checkDeployHealth(ctx context.Context, cCtx *cli.Context, config DeployConfig, instance Instance, launched bool) error {
+	if cCtx.Bool("skip-health-check") {
+		color.Yellow("× Skipping health check")
+
+		return nil
+	}
+
+	var target SSHTarget
+
+	if launched {
+		var err error
+		if target, err = sshTarget(ctx, cCtx, instance); err != nil {
+			return err
+		}
+
+		if err := waitForCloudInit(target, instance); err != nil {
+			printCloudInitLog(target, instance)
+
+			return err
+		}
+	}
+
+	if err := waitForHealthy(instance, config.Health); err != nil {
+		if launched {
+			printCloudInitLog(target, instance)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// waitForCloudInit waits over ssh for cloud-init, and so the boot script, to
+// finish on a new instance. sshd takes a little while to come up so
+// connection failures are retried for a few minutes, but not being let in is
+// an error straight away.
+func waitForCloudInit(target SSHTarget, instance Instance) error {
+	deadline := time.Now().Add(cloudInitTimeout)
+	sshDeadline := time.Now().Add(sshStartupTimeout)
+
+	s.Suffix = " Waiting for the boot script to finish on " + instance.Name
+	s.Start()
+	defer s.Stop()
+
+	for {
+		cmd := target.command([]string{"BatchMode=yes", "ConnectTimeout=10"}, []string{"sudo", "cloud-init", "status", "--wait"})
+
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+
+		started := time.Now()
+
+		err := executor.Run(cmd)
+		if err == nil {
+			break
+		}
+
+		// ssh itself exits 255, anything else is cloud-init's answer
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() != 255 {
+			s.Stop()
+
+			// Newer cloud-init exits 2 when it finished with recoverable errors
+			if exitErr.ExitCode() == 2 {
+				color.Yellow("× Boot script finished with warnings on " + instance.Name)
+
+				return nil
+			}
+
+			return newError(ErrHealthCheck, "boot script failed on "+instance.Name, nil)
+		}
+
+		problem := strings.TrimSpace(stderr.String())
+
+		if isSSHLoginError(problem) {
+			s.Stop()
+
+			return newError(ErrCommandFailed, "can't log in to "+instance.Name+" over ssh: "+problem, err)
+		}
+
+		// Having waited on cloud-init for a while it got in, and only lost
+		// the connection, so sshd gets another go
+		if time.Since(started) > time.Minute {
+			sshDeadline = time.Now().Add(sshStartupTimeout)
+		}
+
+		if time.Now().After(sshDeadline) {
+			s.Stop()
+
+			return newError(ErrTimeout, "can't ssh to "+instance.Name+" after "+sshStartupTimeout.String()+": "+valueOr(problem, err.Error()), err)
+		}
+
+		if time.Now().After(deadline) {
+			return newError(ErrTimeout, "boot script still running on "+instance.Name+" after "+cloudInitTimeout.String(), nil)
+		}
+
+		time.Sleep(instancePollInterval)
+	}
+
+	s.Stop()
+
+	color.Green("✓ Completed: Boot script finished on " + instance.Name)
+
+	return nil
+}
+
+// printCloudInitLog shows the end of the boot script's output, which is where
+// a failed clone or install says what went wrong
+func printCloudInitLog(target SSHTarget, instance Instance) {
+	cmd := target.command([]string{"BatchMode=yes", "ConnectTimeout=10"}, []string{"sudo", "tail", "-n", "40", cloudInitLog})
+
+	out, err := executor.Output(cmd)
+	if err != nil {
+		color.Yellow("× Couldn't read " + cloudInitLog + " on " + instance.Name + ", run 'matrix ssh " + ProjectName + "' to look")
+
+		return
+	}
+
+	color.Red("Last lines of " + cloudInitLog + " on " + instance.Name + ":")
+	printCommandOutput(out)
+}
+
+// waitForHealthy polls the health URL until it responds with the expected
+// status and body, or the timeout runs out
+func waitForHealthy(instance Instance, check HealthCheck) error {
+	url := check.URL
+	if strings.HasPrefix(url, "/") {
+		url = "http://" + instance.PublicIP + url
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	deadline := time.Now().Add(check.Timeout)
+
+	s.Suffix = " Checking " + url
+	s.Start()
+	defer s.Stop()
+
+	for {
+		problem := probeHealth(client, url, check)
+		if problem == "" {
+			break
+		}
+
+		s.Suffix = " Checking " + url + ": " + problem
+
+		if time.Now().After(deadline) {
+			return newError(ErrHealthCheck, url+" not healthy after "+check.Timeout.String()+": "+problem, nil)
+		}
+
+		time.Sleep(instancePollInterval / 2)
+	}
+
+	s.Stop()
+
+	color.Green("✓ Success: " + url + " is healthy")
+
+	return nil
+}
+
+// probeHealth requests url once and describes what is wrong with the
+// response, if anything
+func probeHealth(client *http.Client, url string, check HealthCheck) string {
+	resp, err := client.Get(url)
+	if err != nil {
+		return err.Error()
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != check.Status {
+		return "status " + strconv.Itoa(resp.StatusCode) + ", expected " + strconv.Itoa(check.Status)
+	}
+
+	if check.Match == nil {
+		return ""
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err.Error()
+	}
+
+	if !check.Match.Match(body) {
+		return "response doesn't match '" + check.Match.String() + "'"
+	}
+
+	return ""
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/fatih/color"
+	"github.com/urfave/cli/v2"
+)
+
+// Where deploy history is kept unless deploy_history says otherwise. It can be
+// a local directory or s3://bucket/prefix to share it with the team.
+const defaultDeployHistory = "~/.matrix/deploys"
+
+// Results a deploy can have
+const (
+	DeploySucceeded = "success"
+	DeployFailed    = "failed"
+)
+
+// DeployRecord is one entry in a project's deploy history
+type DeployRecord struct {
+	ID         string    `json:"id"`
+	Project    string    `json:"project"`
+	Action     string    `json:"action"`
+	Type       string    `json:"type,omitempty"`
+	User       string    `json:"user"`
+	Time       time.Time `json:"time"`
+	Ref        string    `json:"ref"`
+	Commit     string    `json:"commit"`
+	Target     string    `json:"target"`
+	InstanceID string    `json:"instanceId,omitempty"`
+	Region     string    `json:"region,omitempty"`
+	Profile    string    `json:"profile,omitempty"`
+	Backup     string    `json:"backup,omitempty"`
+	RollbackTo string    `json:"rollbackTo,omitempty"`
+	Restored   string    `json:"restored,omitempty"`
+	Result     string    `json:"result"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// DeployHistoryResult is the result of matrix deploy history
+type DeployHistoryResult struct {
+	Project string         `json:"project"`
+	Deploys []DeployRecord `json:"deploys"`
+}
+
+func newDeployRecord(config DeployConfig, commit string) DeployRecord {
+	now := time.Now().UTC()
+
+	return DeployRecord{
+		ID:      now.Format("20060102-150405"),
+		Project: ProjectName,
+		Type:    ProjectType,
+		User:    deployUser(),
+		Time:    now,
+		Ref:     valueOr(config.Ref, "HEAD"),
+		Commit:  commit,
+		Target:  config.Target,
+		Region:  config.Region,
+		Profile: config.Profile,
+	}
+}
+
+// finish fills in how the deploy went
+func (record *DeployRecord) finish(instance Instance, updated bool, err error) {
+	if record.Action == "" {
+		record.Action = "launch"
+		if updated {
+			record.Action = "update"
+		}
+	}
+
+	record.InstanceID = instance.ID
+	record.Target = valueOr(instance.Provider, record.Target)
+	record.Region = valueOr(instance.Region, record.Region)
+	record.Result = DeploySucceeded
+
+	if err != nil {
+		record.Result = DeployFailed
+		record.Error = err.Error()
+	}
+}
+
+// deployUser is who is deploying, by their git email
+func deployUser() string {
+	out, err := executor.Lookup(exec.Command("git", "config", "--get", "user.email"))
+	if err == nil && strings.TrimSpace(string(out)) != "" {
+		return strings.TrimSpace(string(out))
+	}
+
+	return os.Getenv("USER")
+}
+
+var commitPattern = regexp.MustCompile(`^[0-9a-f]{4,40}$`)
+
+// resolveDeployRef turns a branch, tag or commit into the full SHA of the
+// commit on origin, so the history records exactly what went live. An empty
+// ref is origin's default branch.
+func resolveDeployRef(ref string) (string, error) {
+	name := valueOr(ref, "HEAD")
+
+	cmd := exec.Command("git", "ls-remote", "origin", name)
+	out, err := executor.Lookup(cmd)
+	if err != nil {
+		return "", commandError(ErrGitHub, cmd, err)
+	}
+
+	// Prefer branches to tags, and the commit an annotated tag points to
+	found := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 {
+			found[fields[1]] = fields[0]
+		}
+	}
+
+	for _, candidate := range []string{name, "refs/heads/" + name, "refs/tags/" + name + "^{}", "refs/tags/" + name} {
+		if commit, ok := found[candidate]; ok {
+			return commit, nil
+		}
+	}
+
+	// Commits aren't advertised so expand them from the local clone
+	if commitPattern.MatchString(name) {
+		out, err := executor.Lookup(exec.Command("git", "rev-parse", "--verify", "--quiet", name+"^{commit}"))
+		if err == nil {
+			return strings.TrimSpace(string(out)), nil
+		}
+
+		if len(name) == 40 {
+			return name, nil
+		}
+	}
+
+	return "", newError(ErrConfig, "git ref '"+name+"' not found on origin", nil)
+}
+
+func shortCommit(commit string) string {
+	if len(commit) > 7 {
+		return commit[:7]
+	}
+
+	return commit
+}
+
+// deployHistoryLocation splits deploy_history into an S3 bucket and key, or a
+// local file, for a project's history
+func deployHistoryLocation(location string, project string) (bucket string, key string, file string) {
+	if strings.HasPrefix(location, "s3://") {
+		bucket, prefix, _ := strings.Cut(strings.TrimPrefix(location, "s3://"), "/")
+		key = strings.Trim(prefix+"/"+project+".json", "/")
+
+		return bucket, key, ""
+	}
+
+	return "", "", filepath.Join(expandHome(location), project+".json")
+}
+
+// loadDeployHistory returns a project's deploys, oldest first
+func loadDeployHistory(ctx context.Context, client *AWSClient, location string, project string) ([]DeployRecord, error) {
+	bucket, key, file := deployHistoryLocation(location, project)
+
+	var data []byte
+
+	if bucket != "" {
+		out, err := client.S3.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+
+		var noSuchKey *s3types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return []DeployRecord{}, nil
+		}
+
+		if err != nil {
+			return nil, awsError("s3 get-object", err)
+		}
+		defer out.Body.Close()
+
+		if data, err = io.ReadAll(out.Body); err != nil {
+			return nil, awsError("s3 get-object", err)
+		}
+	} else {
+		if !fileExists(file) {
+			return []DeployRecord{}, nil
+		}
+
+		var err error
+		if data, err = os.ReadFile(file); err != nil {
+			return nil, newError(ErrConfig, "reading "+file, err)
+		}
+	}
+
+	records := []DeployRecord{}
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, newError(ErrConfig, "reading deploy history of "+project, err)
+	}
+
+	return records, nil
+}
+
+// saveDeployRecord adds a deploy to its project's history, renaming it if a
+// deploy saved since it was given its ID has taken it
+func saveDeployRecord(ctx context.Context, client *AWSClient, location string, record *DeployRecord) error {
+	records, err := loadDeployHistory(ctx, client, location, record.Project)
+	if err != nil {
+		return err
+	}
+
+	record.ID = uniqueDeployID(records, record.ID)
+
+	data, err := json.MarshalIndent(append(records, *record), "", "  ")
+	if err != nil {
+		return newError(ErrGeneral, "saving deploy history", err)
+	}
+
+	bucket, key, file := deployHistoryLocation(location, record.Project)
+
+	if bucket != "" {
+		return awsChange([]string{"s3", "cp", "-", "s3://" + bucket + "/" + key}, func() error {
+			_, err := client.S3.PutObject(ctx, &s3.PutObjectInput{
+				Bucket:      aws.String(bucket),
+				Key:         aws.String(key),
+				Body:        bytes.NewReader(data),
+				ContentType: aws.String("application/json"),
+			})
+
+			return awsError("s3 put-object", err)
+		})
+	}
+
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return newError(ErrConfig, "saving deploy history", err)
+	}
+
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		return newError(ErrConfig, "saving deploy history", err)
+	}
+
+	return nil
+}
+
+// uniqueDeployID is id, suffixed with -2, -3... if a deploy in records
+// already has it, as deploys in the same second still need their own ID
+func uniqueDeployID(records []DeployRecord, id string) string {
+	unique := id
+
+	for n := 2; slices.ContainsFunc(records, func(record DeployRecord) bool { return record.ID == unique }); n++ {
+		unique = id + "-" + strconv.Itoa(n)
+	}
+
+	return unique
+}
+
+// claimDeployID makes the record's ID unique in its project's history before
+// anything, like the database backup, is named after it
+func claimDeployID(ctx context.Context, client *AWSClient, location string, record *DeployRecord) {
+	records, err := loadDeployHistory(ctx, client, location, record.Project)
+	if err != nil {
+		return
+	}
+
+	record.ID = uniqueDeployID(records, record.ID)
+}
+
+// projectNameFromArgs is the project named on the command line, or the
+// directory matrix is run in
+func projectNameFromArgs(cCtx *cli.Context) (string, error) {
+	if project := cCtx.Args().First(); project != "" {
+		return project, nil
+	}
+
+	workingDir, err := os.Getwd()
+	if err != nil {
+		return "", newError(ErrGeneral, "", err)
+	}
+
+	return filepath.Base(workingDir), nil
+}
+
+func deployHistory(cCtx *cli.Context) error {
+	project, err := projectNameFromArgs(cCtx)
+	if err != nil {
+		return err
+	}
+
+	settings, err := loadSettings(cCtx)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	client, err := newAWSClient(ctx, settings.Get("profile", "deploy_profile", AWSProfile), "")
+	if err != nil {
+		return err
+	}
+
+	records, err := loadDeployHistory(ctx, client, settings.Get("", "deploy_history", defaultDeployHistory), project)
+	if err != nil {
+		return err
+	}
+
+	// Newest first
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+
+	if limit := cCtx.Int("limit"); limit > 0 && len(records) > limit {
+		records = records[:limit]
+	}
+
+	color.Magenta("Deploy history of " + project + ":")
+
+	if len(records) == 0 {
+		color.White("  No deploys yet")
+	}
+
+	for _, record := range records {
+		line := "  - " + record.ID + "  " + record.Time.Local().Format("2006-01-02 15:04") + "  " + record.User + "  " + record.Action + " " + record.Ref + " (" + shortCommit(record.Commit) + ") on " + valueOr(record.InstanceID, "-")
+
+		if record.Result == DeploySucceeded {
+			color.Green(line)
+		} else {
+			color.Red(line + ": " + record.Error)
+		}
+	}
+
+	return printResult(DeployHistoryResult{Project: project, Deploys: records})
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/fatih/color"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/crypto/ssh"
+)
+
+// Where the instance keeps the deploy key it fetches at boot
+const deployKeyPath = "/root/.ssh/matrix_deploy_key"
+
+// projectParameter is the name of an SSM parameter belonging to a project
+func projectParameter(project string, name string) string {
+	return "/matrix/" + project + "/" + name
+}
+
+// GitHub remotes in any of the forms git accepts
+var githubRemotePattern = regexp.MustCompile(`github\.com[:/]([^/]+/[^/]+?)(\.git)?/?$`)
+
+// githubRepoFromRemote returns the owner/repo of a GitHub remote URL
+func githubRepoFromRemote(remote string) (string, error) {
+	match := githubRemotePattern.FindStringSubmatch(strings.TrimSpace(remote))
+	if match == nil {
+		return "", newError(ErrConfig, "remote.origin.url '"+strings.TrimSpace(remote)+"' is not a GitHub repository", nil)
+	}
+
+	return match[1], nil
+}
+
+// provisionDeployKey makes sure the project has a read-only deploy key that
+// its instances can clone with. A new key is registered with the GitHub repo
+// and its private half is only ever kept in SSM as a SecureString, so it never
+// touches the local disk or the instance's user data.
+func provisionDeployKey(ctx context.Context, client *AWSClient, repo string) error {
+	name := projectParameter(ProjectName, "deploy-key")
+
+	_, err := client.SSM.GetParameter(ctx, &ssm.GetParameterInput{Name: aws.String(name)})
+	if err == nil {
+		color.Green("✓ Using existing deploy key: " + name)
+
+		return nil
+	}
+
+	var notFound *ssmtypes.ParameterNotFound
+	if !errors.As(err, &notFound) {
+		return awsError("ssm get-parameter", err)
+	}
+
+	color.Magenta("Creating read-only deploy key for " + repo)
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return newError(ErrGeneral, "generating deploy key", err)
+	}
+
+	sshPublicKey, err := ssh.NewPublicKey(publicKey)
+	if err != nil {
+		return newError(ErrGeneral, "generating deploy key", err)
+	}
+
+	block, err := ssh.MarshalPrivateKey(privateKey, "matrix-"+ProjectName)
+	if err != nil {
+		return newError(ErrGeneral, "generating deploy key", err)
+	}
+
+	authorizedKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPublicKey)))
+
+	// Register the public half with the repo
+	cmd := exec.Command("gh", "api", "--method", "POST", "repos/"+repo+"/keys",
+		"-f", "title=matrix "+ProjectName,
+		"-f", "key="+authorizedKey,
+		"-F", "read_only=true")
+	out, err := executor.Output(cmd)
+	if err != nil {
+		return commandError(ErrGitHub, cmd, err)
+	}
+
+	// Nothing was added in a dry run so there is no ID
+	var key GitHubDeployKey
+	json.Unmarshal(out, &key)
+
+	color.Green("✓ Completed: Added deploy key to " + repo)
+
+	// Store the private half for the instance role to fetch at boot
+	err = awsChange([]string{"ssm", "put-parameter", "--name", name, "--type", "SecureString", "--value", "(deploy key)", "--profile", client.Profile}, func() error {
+		_, err := client.SSM.PutParameter(ctx, &ssm.PutParameterInput{
+			Name:  aws.String(name),
+			Type:  ssmtypes.ParameterTypeSecureString,
+			Value: aws.String(string(pem.EncodeToMemory(block))),
+			Tags:  []ssmtypes.Tag{{Key: aws.String("matrix:project"), Value: aws.String(ProjectName)}},
+		})
+
+		return awsError("ssm put-parameter", err)
+	})
+	if err != nil {
+		// Without the private half the key is no use, and the next deploy
+		// would add another
+		if key.ID != 0 {
+			cmd := exec.Command("gh", "api", "--method", "DELETE", "repos/"+repo+"/keys/"+strconv.FormatInt(key.ID, 10))
+			if _, deleteErr := executor.Output(cmd); deleteErr != nil {
+				color.Yellow("× Couldn't remove the deploy key from " + repo + ", delete 'matrix " + ProjectName + "' in its deploy keys")
+			}
+		}
+
+		return err
+	}
+
+	color.Green("✓ Completed: Stored deploy key in SSM: " + name)
+
+	return nil
+}
+
+// deployKeyScript is the part of the boot script that gets the deploy key and
+// clones the repo with it. With fetch the instance role fetches the key from
+// SSM, otherwise the script waits for pushDeployKey to copy it over.
+func deployKeyScript(repo string, region string, fetch bool) string {
+	name := projectParameter(ProjectName, "deploy-key")
+
+	script := "mkdir -p /root/.ssh\n"
+
+	if fetch {
+		script += "# Fetch the read-only deploy key (needs ssm:GetParameter on the instance role)\n"
+		script += "(umask 077 && aws ssm get-parameter --region " + region + " --name " + name + " --with-decryption --query Parameter.Value --output text > " + deployKeyPath + ")\n"
+	} else {
+		script += "# Wait for matrix to copy the read-only deploy key over\n"
+		script += "while [ ! -s " + deployKeyPath + " ]; do sleep 5; done\n"
+	}
+
+	script += "ssh-keyscan github.com >> /root/.ssh/known_hosts 2>/dev/null\n"
+	script += "export GIT_SSH_COMMAND=\"ssh -i " + deployKeyPath + " -o IdentitiesOnly=yes\"\n"
+
+	// git clone repo into current directory
+	script += "git clone git@github.com:" + repo + ".git .\n"
+
+	// Keep using the key for later fetches
+	script += "git config core.sshCommand \"$GIT_SSH_COMMAND\"\n"
+
+	return script
+}
+
+// pushDeployKey copies the deploy key from SSM to an instance over ssh, for
+// instances without a role to fetch it themselves
+func pushDeployKey(ctx context.Context, cCtx *cli.Context, client *AWSClient, instance Instance, timeout time.Duration) error {
+	name := projectParameter(ProjectName, "deploy-key")
+
+	out, err := client.SSM.GetParameter(ctx, &ssm.GetParameterInput{Name: aws.String(name), WithDecryption: aws.Bool(true)})
+	if err != nil {
+		return awsError("ssm get-parameter", err)
+	}
+
+	return pushSecret(ctx, cCtx, instance, deployKeyPath, aws.ToString(out.Parameter.Value), "deploy key", timeout)
+}
+
+// pushSecret writes content to path on an instance, readable only by root.
+// It is piped straight through ssh so it is never written locally. sshd takes
+// a little while to come up after the instance is running so it keeps trying
+// until timeout, unless ssh can't log in at all.
+func pushSecret(ctx context.Context, cCtx *cli.Context, instance Instance, path string, content string, description string, timeout time.Duration) error {
+	target, err := sshTarget(ctx, cCtx, instance)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so the boot script never sees half of it
+	remote := "sudo sh -c 'umask 077 && mkdir -p " + filepath.Dir(path) + " && cat > " + path + ".tmp && mv " + path + ".tmp " + path + "'"
+
+	deadline := time.Now().Add(timeout)
+
+	s.Suffix = " Copying " + description + " to " + instance.Name
+	s.Start()
+	defer s.Stop()
+
+	for {
+		cmd := target.command([]string{"BatchMode=yes", "ConnectTimeout=10"}, []string{remote})
+		cmd.Stdin = strings.NewReader(content)
+
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+
+		err := executor.Run(cmd)
+		if err == nil {
+			break
+		}
+
+		problem := strings.TrimSpace(stderr.String())
+
+		if isSSHLoginError(problem) {
+			s.Stop()
+
+			return newError(ErrCommandFailed, "can't log in to "+instance.Name+" over ssh: "+problem, err)
+		}
+
+		if time.Now().After(deadline) {
+			return newError(ErrCommandFailed, cmd.String()+": "+valueOr(problem, err.Error()), err)
+		}
+
+		time.Sleep(instancePollInterval)
+	}
+
+	s.Stop()
+
+	color.Green("✓ Completed: Copied " + description + " to " + instance.Name)
+
+	return nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/lightsail"
+	lightsailtypes "github.com/aws/aws-sdk-go-v2/service/lightsail/types"
+	"github.com/fatih/color"
+	"github.com/urfave/cli/v2"
+)
+
+// Ports opened on Lightsail instances, on top of the ssh port they start with
+var lightsailPublicPorts = []int32{80, 443}
+
+// validateLightsailDeployConfig checks the blueprint and bundle exist in the
+// region before anything is created
+func validateLightsailDeployConfig(ctx context.Context, client *AWSClient, config DeployConfig) error {
+	found := false
+
+	blueprints := &lightsail.GetBlueprintsInput{}
+	for !found {
+		out, err := client.Lightsail.GetBlueprints(ctx, blueprints)
+		if err != nil {
+			return awsError("lightsail get-blueprints", err)
+		}
+
+		for _, blueprint := range out.Blueprints {
+			found = found || aws.ToString(blueprint.BlueprintId) == config.Blueprint
+		}
+
+		if aws.ToString(out.NextPageToken) == "" {
+			break
+		}
+
+		blueprints.PageToken = out.NextPageToken
+	}
+
+	if !found {
+		return newError(ErrConfig, "Lightsail blueprint '"+config.Blueprint+"' not found in "+client.Region, nil)
+	}
+
+	found = false
+
+	bundles := &lightsail.GetBundlesInput{}
+	for !found {
+		out, err := client.Lightsail.GetBundles(ctx, bundles)
+		if err != nil {
+			return awsError("lightsail get-bundles", err)
+		}
+
+		for _, bundle := range out.Bundles {
+			found = found || aws.ToString(bundle.BundleId) == config.Bundle
+		}
+
+		if aws.ToString(out.NextPageToken) == "" {
+			break
+		}
+
+		bundles.PageToken = out.NextPageToken
+	}
+
+	if !found {
+		return newError(ErrConfig, "Lightsail bundle '"+config.Bundle+"' not found in "+client.Region, nil)
+	}
+
+	return nil
+}
+
+// deployToLightsail creates a Lightsail instance that runs script at boot,
+// gives it a static IP, opens the web ports and copies the environment and
+// deploy key over
+func deployToLightsail(ctx context.Context, cCtx *cli.Context, client *AWSClient, config DeployConfig, script string) (Instance, error) {
+	profileArgs := []string{"--profile", config.Profile, "--region", config.Region}
+
+	err := awsChange(append([]string{"lightsail", "create-instances", "--instance-names", ProjectName, "--availability-zone", config.Zone, "--blueprint-id", config.Blueprint, "--bundle-id", config.Bundle, "--user-data", "(deploy script)", "--tags", "key=matrix:project,value=" + ProjectName}, profileArgs...), func() error {
+		_, err := client.Lightsail.CreateInstances(ctx, &lightsail.CreateInstancesInput{
+			InstanceNames:    []string{ProjectName},
+			AvailabilityZone: aws.String(config.Zone),
+			BlueprintId:      aws.String(config.Blueprint),
+			BundleId:         aws.String(config.Bundle),
+			UserData:         aws.String(script),
+			Tags:             []lightsailtypes.Tag{{Key: aws.String("matrix:project"), Value: aws.String(ProjectName)}},
+		})
+
+		return awsError("lightsail create-instances", err)
+	})
+	if err != nil {
+		return Instance{}, err
+	}
+
+	instance := Instance{Provider: ProviderLightsail, Name: ProjectName, ID: ProjectName, State: "pending", Region: config.Region, Profile: config.Profile}
+
+	if !dryRun {
+		color.Green("✓ Completed: Created new Lightsail instance")
+
+		color.Magenta("--------------------------------------------------")
+		color.Magenta("🎉            DEPLOYMENT STARTED                🎉")
+		color.Magenta("--------------------------------------------------")
+
+		// A static IP can only be attached once the instance is running
+		color.Magenta("Checking if instance is running")
+
+		instance, err = waitForInstanceState(ctx, client, instance, "running", instanceWaitTimeout)
+		if err != nil {
+			return instance, err
+		}
+
+		color.Green("✓ Success: Instance is running")
+	}
+
+	if err := attachLightsailStaticIP(ctx, client, config); err != nil {
+		return instance, err
+	}
+
+	for _, port := range lightsailPublicPorts {
+		err := awsChange(append([]string{"lightsail", "open-instance-public-ports", "--instance-name", ProjectName, "--port-info", "fromPort=" + strconv.Itoa(int(port)) + ",toPort=" + strconv.Itoa(int(port)) + ",protocol=tcp"}, profileArgs...), func() error {
+			_, err := client.Lightsail.OpenInstancePublicPorts(ctx, &lightsail.OpenInstancePublicPortsInput{
+				InstanceName: aws.String(ProjectName),
+				PortInfo: &lightsailtypes.PortInfo{
+					FromPort: port,
+					ToPort:   port,
+					Protocol: lightsailtypes.NetworkProtocolTcp,
+				},
+			})
+
+			return awsError("lightsail open-instance-public-ports", err)
+		})
+		if err != nil {
+			return instance, err
+		}
+	}
+
+	if dryRun {
+		return instance, nil
+	}
+
+	color.Green("✓ Completed: Opened ports 80 and 443")
+
+	// Pick up the static IP
+	instance, err = getInstanceState(ctx, client, instance)
+	if err != nil {
+		return instance, err
+	}
+
+	forgetHostKey(instance)
+
+	// The environment goes first, the boot script starts once it has the key
+	if err := pushEnv(ctx, cCtx, client, instance, instanceWaitTimeout); err != nil {
+		return instance, err
+	}
+
+	if err := pushDeployKey(ctx, cCtx, client, instance, instanceWaitTimeout); err != nil {
+		return instance, err
+	}
+
+	return instance, nil
+}
+
+// attachLightsailStaticIP attaches the project's static IP to its instance,
+// allocating it first if this is the project's first deploy
+func attachLightsailStaticIP(ctx context.Context, client *AWSClient, config DeployConfig) error {
+	name := ProjectName + "-ip"
+	profileArgs := []string{"--profile", config.Profile, "--region", config.Region}
+
+	_, err := client.Lightsail.GetStaticIp(ctx, &lightsail.GetStaticIpInput{StaticIpName: aws.String(name)})
+
+	var notFound *lightsailtypes.NotFoundException
+	if errors.As(err, &notFound) {
+		err = awsChange(append([]string{"lightsail", "allocate-static-ip", "--static-ip-name", name}, profileArgs...), func() error {
+			_, err := client.Lightsail.AllocateStaticIp(ctx, &lightsail.AllocateStaticIpInput{StaticIpName: aws.String(name)})
+
+			return awsError("lightsail allocate-static-ip", err)
+		})
+	} else if err != nil {
+		err = awsError("lightsail get-static-ip", err)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	err = awsChange(append([]string{"lightsail", "attach-static-ip", "--static-ip-name", name, "--instance-name", ProjectName}, profileArgs...), func() error {
+		_, err := client.Lightsail.AttachStaticIp(ctx, &lightsail.AttachStaticIpInput{
+			StaticIpName: aws.String(name),
+			InstanceName: aws.String(ProjectName),
+		})
+
+		return awsError("lightsail attach-static-ip", err)
+	})
+	if err != nil {
+		return err
+	}
+
+	if !dryRun {
+		color.Green("✓ Completed: Attached static IP " + name)
+	}
+
+	return nil
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/fatih/color"
+	"github.com/urfave/cli/v2"
+)
+
+// Where deployed projects are cloned to on the server
+const deployDir = "/var/www/html"
+
+// Ways of running the update on an existing server
+const (
+	UpdateViaSSH = "ssh"
+	UpdateViaSSM = "ssm"
+)
+
+// findDeployedInstance looks for the instance the project is already deployed
+// to in the deploy profile and region
+func findDeployedInstance(ctx context.Context, client *AWSClient, config DeployConfig) (Instance, error) {
+	inventory, err := collectInventory(ctx, client)
+	if err != nil {
+		return Instance{}, err
+	}
+
+	instance, err := matchProjectInstance(inventory.Instances, ProjectName)
+	if err != nil {
+		return instance, err
+	}
+
+	instance.Profile = config.Profile
+
+	return instance, nil
+}
+
+// Where database backups taken before each deploy are kept on the server,
+// outside the web root
+const dbBackupDir = "/var/www/matrix-backups"
+
+func dbBackupPath(deployID string) string {
+	return dbBackupDir + "/" + deployID + ".sql"
+}
+
+// dbBackupCommand dumps the project's database to path, for project types
+// that have a way to
+func dbBackupCommand(projectType string, path string) string {
+	switch projectType {
+	case "craft":
+		return "php craft db/backup " + path + " --interactive=0"
+	case "wordpress":
+		return "wp db export " + path + " --allow-root"
+	}
+
+	return ""
+}
+
+// dbRestoreCommand imports a backup made by dbBackupCommand
+func dbRestoreCommand(projectType string, path string) string {
+	switch projectType {
+	case "craft":
+		return "php craft db/restore " + path + " --interactive=0"
+	case "wordpress":
+		return "wp db import " + path + " --allow-root"
+	}
+
+	return ""
+}
+
+// webWritable is the folders of a project type the web server writes to,
+// which the bootstrap script gives to the web server's user
+func webWritable(projectType string) string {
+	switch projectType {
+	case "craft":
+		return "storage web/cpresources"
+	case "wordpress":
+		return "wp-content"
+	case "laravel":
+		return "storage bootstrap/cache"
+	}
+
+	return ""
+}
+
+// updateScript checks out commit in the clone on the server and runs the
+// project type's install and migration steps. The database is backed up to
+// backup first, and restored from restore after the checkout, when they are
+// given. Everything that could fail without changing anything runs first.
+func updateScript(projectType string, commit string, backup string, restore string) string {
+	script := "set -e\n"
+	script += "cd " + deployDir + "\n"
+	script += "git fetch --all --tags --prune\n"
+	script += "git cat-file -e " + commit + "^{commit}\n"
+
+	if restore != "" {
+		script += "test -s " + restore + " || { echo 'Backup " + restore + " is missing' >&2; exit 1; }\n"
+	}
+
+	if backup != "" {
+		script += "mkdir -p -m 700 " + dbBackupDir + "\n"
+		script += dbBackupCommand(projectType, backup) + "\n"
+		script += "echo 'Backed up database to " + backup + "'\n"
+	}
+
+	script += "git checkout --force " + commit + "\n"
+
+	script += "git log -1 --format='Deployed %h %s'\n"
+
+	// The steps below run as root, so what they write is given back to the
+	// web server like the bootstrap script does, even if one fails
+	if writable := webWritable(projectType); writable != "" {
+		script += "if [ -d /opt/bitnami ]; then WEB_USER=daemon; else WEB_USER=www-data; fi\n"
+		script += "trap 'mkdir -p " + writable + " && chown -R $WEB_USER " + writable + "' EXIT\n"
+	}
+
+	script += "if [ -f composer.json ]; then composer install --no-dev --no-interaction --optimize-autoloader; fi\n"
+
+	if restore != "" {
+		script += dbRestoreCommand(projectType, restore) + "\n"
+		script += "echo 'Restored database from " + restore + "'\n"
+	}
+
+	switch projectType {
+	case "craft":
+		script += "php craft migrate/all --interactive=0\n"
+		script += "php craft project-config/apply --interactive=0\n"
+		script += "php craft clear-caches/all --interactive=0\n"
+	case "wordpress":
+		script += "if command -v wp > /dev/null; then wp cache flush --allow-root; fi\n"
+	case "laravel":
+		script += "php artisan migrate --force\n"
+		script += "php artisan config:cache\n"
+	}
+
+	return script
+}
+
+// updateDeployment runs an update script on an instance the project is
+// already deployed to, instead of launching a new one
+func updateDeployment(ctx context.Context, cCtx *cli.Context, client *AWSClient, instance Instance, script string) (Instance, error) {
+	color.Magenta("Updating " + instance.Name + " (" + instance.ID + ") in place")
+
+	if instance.State != "running" {
+		return instance, newError(ErrGeneral, instance.Name+" is "+instance.State+", run 'matrix aws start "+instance.Name+"' first or deploy with --new-instance", nil)
+	}
+
+	var err error
+
+	switch via := cCtx.String("via"); via {
+	case UpdateViaSSH:
+		err = updateViaSSH(ctx, cCtx, instance, script)
+	case UpdateViaSSM:
+		if instance.Provider != ProviderEC2 {
+			return instance, newError(ErrUnsupported, "updating a "+instance.Provider+" instance via SSM, use --via ssh", nil)
+		}
+
+		err = updateViaSSM(ctx, client, instance, script)
+	default:
+		return instance, newError(ErrConfig, "unknown update method '"+via+"', use ssh or ssm", nil)
+	}
+
+	if err != nil {
+		return instance, err
+	}
+
+	if !dryRun {
+		color.Green("✓ Completed: Updated " + instance.Name)
+	}
+
+	return instance, nil
+}
+
+// updateViaSSH pipes the update script to a root shell on the instance
+func updateViaSSH(ctx context.Context, cCtx *cli.Context, instance Instance, script string) error {
+	target, err := sshTarget(ctx, cCtx, instance)
+	if err != nil {
+		return err
+	}
+
+	cmd := target.command([]string{"BatchMode=yes"}, []string{"sudo", "bash", "-s"})
+	cmd.Stdin = strings.NewReader(script)
+	cmd.Stdout = color.Output
+	cmd.Stderr = os.Stderr
+
+	if err := executor.Run(cmd); err != nil {
+		return commandError(ErrCommandFailed, cmd, err)
+	}
+
+	return nil
+}
+
+// updateViaSSM runs the update script with SSM Run Command, which needs the
+// SSM agent and the AmazonSSMManagedInstanceCore policy on the instance role
+// but no ssh access
+func updateViaSSM(ctx context.Context, client *AWSClient, instance Instance, script string) error {
+	var commandID string
+
+	err := awsChange([]string{"ssm", "send-command", "--document-name", "AWS-RunShellScript", "--instance-ids", instance.ID, "--parameters", "commands=(update script)", "--profile", instance.Profile, "--region", instance.Region}, func() error {
+		out, err := client.SSM.SendCommand(ctx, &ssm.SendCommandInput{
+			DocumentName: aws.String("AWS-RunShellScript"),
+			InstanceIds:  []string{instance.ID},
+			Comment:      aws.String("matrix deploy " + ProjectName),
+			Parameters:   map[string][]string{"commands": {script}},
+		})
+		if err != nil {
+			return awsError("ssm send-command", err)
+		}
+
+		commandID = aws.ToString(out.Command.CommandId)
+
+		return nil
+	})
+	if err != nil || dryRun {
+		return err
+	}
+
+	s.Suffix = " Running update on " + instance.Name
+	s.Start()
+	defer s.Stop()
+
+	for {
+		time.Sleep(instancePollInterval / 2)
+
+		out, err := client.SSM.GetCommandInvocation(ctx, &ssm.GetCommandInvocationInput{
+			CommandId:  aws.String(commandID),
+			InstanceId: aws.String(instance.ID),
+		})
+
+		// The invocation takes a moment to show up
+		var notYet *ssmtypes.InvocationDoesNotExist
+		if errors.As(err, &notYet) {
+			continue
+		}
+
+		if err != nil {
+			return awsError("ssm get-command-invocation", err)
+		}
+
+		switch out.Status {
+		case ssmtypes.CommandInvocationStatusPending, ssmtypes.CommandInvocationStatusInProgress, ssmtypes.CommandInvocationStatusDelayed:
+			continue
+		}
+
+		s.Stop()
+
+		printCommandOutput([]byte(aws.ToString(out.StandardOutputContent)))
+
+		if out.Status != ssmtypes.CommandInvocationStatusSuccess {
+			color.Red(aws.ToString(out.StandardErrorContent))
+
+			return newError(ErrCommandFailed, "update on "+instance.Name+" "+strings.ToLower(string(out.Status)), nil)
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,639 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/lightsail"
+	lightsailtypes "github.com/aws/aws-sdk-go-v2/service/lightsail/types"
+	"github.com/aws/aws-sdk-go-v2/service/route53"
+	route53types "github.com/aws/aws-sdk-go-v2/service/route53/types"
+	"github.com/fatih/color"
+	"github.com/urfave/cli/v2"
+)
+
+// Where a domain's DNS can be kept
+const (
+	DNSRoute53   = "route53"
+	DNSLightsail = "lightsail"
+)
+
+// Lightsail DNS zones are all kept in us-east-1, and Route 53 is global
+const dnsRegion = "us-east-1"
+
+// TTL of the A records matrix creates, short enough to move a site quickly
+const dnsTTL = 300
+
+// DNSZone is a public hosted zone that records can be created in
+type DNSZone struct {
+	Provider string `json:"provider"`
+	ZoneID   string `json:"zoneId"`
+	Zone     string `json:"zone"`
+}
+
+// DNSRecord is the A record of a domain
+type DNSRecord struct {
+	Domain string   `json:"domain"`
+	Values []string `json:"values"`
+	TTL    int64    `json:"ttl,omitempty"`
+
+	DNSZone
+
+	// Lightsail entries are changed and deleted by ID
+	entryID string
+}
+
+// DomainResult is the result of the matrix domain commands
+type DomainResult struct {
+	Project    string      `json:"project"`
+	InstanceID string      `json:"instanceId"`
+	PublicIP   string      `json:"publicIp"`
+	Domains    []DNSRecord `json:"domains"`
+	DryRun     bool        `json:"dryRun,omitempty"`
+}
+
+// domainCommands are the subcommands of matrix domain
+func domainCommands() []*cli.Command {
+	dnsProfile := &cli.StringFlag{
+		Name:  "dns-profile",
+		Usage: "AWS profile the DNS zones are in (default: dns_profile in .matrix/config or ~/.matrix/config, or the instance's profile)",
+	}
+
+	yes := &cli.BoolFlag{
+		Name:    "yes",
+		Aliases: []string{"y"},
+		Usage:   "Don't ask for confirmation",
+	}
+
+	return []*cli.Command{
+		{
+			Name:      "list",
+			Usage:     "List the domains pointing at a project's instance",
+			ArgsUsage: "<project>",
+			Flags:     append(awsTargetFlags(), dnsProfile),
+			Action: func(cCtx *cli.Context) error {
+				return domainList(cCtx)
+			},
+		},
+		{
+			Name:      "set",
+			Usage:     "Point a domain at a project's instance and get a certificate for it",
+			ArgsUsage: "<project> <domain>",
+			Flags: append(awsTargetFlags(), dnsProfile, yes,
+				&cli.StringFlag{
+					Name:  "email",
+					Usage: "Email for Let's Encrypt to send expiry notices to (default: deploy_certbot_email in .matrix/config or ~/.matrix/config)",
+				},
+				&cli.BoolFlag{
+					Name:  "skip-tls",
+					Usage: "Only set up DNS, without getting a certificate",
+				},
+			),
+			Action: func(cCtx *cli.Context) error {
+				return domainSet(cCtx)
+			},
+		},
+		{
+			Name:      "remove",
+			Usage:     "Delete the A record pointing a domain at a project's instance",
+			ArgsUsage: "<project> <domain>",
+			Flags:     append(awsTargetFlags(), dnsProfile, yes),
+			Action: func(cCtx *cli.Context) error {
+				return domainRemove(cCtx)
+			},
+		},
+	}
+}
+
+// domainInstance finds the instance of the project named in the arguments,
+// and the domain after it when wanted
+func domainInstance(ctx context.Context, cCtx *cli.Context, needDomain bool) (Instance, string, error) {
+	ProjectName = cCtx.Args().Get(0)
+	if ProjectName == "" {
+		return Instance{}, "", newError(ErrMissingProjectName, "", nil)
+	}
+
+	domain := strings.TrimSuffix(strings.ToLower(cCtx.Args().Get(1)), ".")
+	if needDomain && domain == "" {
+		return Instance{}, "", newError(ErrConfig, "missing domain, use 'matrix domain "+cCtx.Command.Name+" "+ProjectName+" example.com'", nil)
+	}
+
+	instance, err := findProjectInstance(ctx, cCtx, ProjectName)
+	if err != nil {
+		return instance, domain, err
+	}
+
+	if instance.PublicIP == "" {
+		return instance, domain, newError(ErrGeneral, instance.Name+" has no public IP, it is "+instance.State, nil)
+	}
+
+	return instance, domain, nil
+}
+
+// dnsClient connects to where the DNS zones are kept, which is the instance's
+// account unless dns_profile says otherwise
+func dnsClient(ctx context.Context, cCtx *cli.Context, instance Instance) (*AWSClient, error) {
+	settings, err := loadSettings(cCtx)
+	if err != nil {
+		return nil, err
+	}
+
+	return newAWSClient(ctx, settings.Get("dns-profile", "dns_profile", valueOr(instance.Profile, AWSProfile)), dnsRegion)
+}
+
+func domainList(cCtx *cli.Context) error {
+	ctx := context.Background()
+
+	instance, _, err := domainInstance(ctx, cCtx, false)
+	if err != nil {
+		return err
+	}
+
+	client, err := dnsClient(ctx, cCtx, instance)
+	if err != nil {
+		return err
+	}
+
+	records, err := listDNSRecords(ctx, client, instance.PublicIP)
+	if err != nil {
+		return err
+	}
+
+	color.Magenta("Domains pointing at " + instance.Name + " (" + instance.PublicIP + "):")
+
+	if len(records) == 0 {
+		color.White("  None, add one with 'matrix domain set " + ProjectName + " example.com'")
+	}
+
+	for _, record := range records {
+		color.White("  - " + record.Domain + "  (" + record.Provider + " zone " + record.Zone + ")")
+	}
+
+	return printResult(DomainResult{Project: ProjectName, InstanceID: instance.ID, PublicIP: instance.PublicIP, Domains: records})
+}
+
+func domainSet(cCtx *cli.Context) error {
+	ctx := context.Background()
+
+	instance, domain, err := domainInstance(ctx, cCtx, true)
+	if err != nil {
+		return err
+	}
+
+	settings, err := loadSettings(cCtx)
+	if err != nil {
+		return err
+	}
+
+	record, err := pointDomain(ctx, cCtx, instance, domain)
+	if err != nil {
+		return err
+	}
+
+	if !cCtx.Bool("skip-tls") {
+		if err := getCertificate(ctx, cCtx, instance, domain, settings.Get("email", "deploy_certbot_email", "")); err != nil {
+			return err
+		}
+	}
+
+	return printResult(DomainResult{Project: ProjectName, InstanceID: instance.ID, PublicIP: instance.PublicIP, Domains: []DNSRecord{record}, DryRun: dryRun})
+}
+
+func domainRemove(cCtx *cli.Context) error {
+	ctx := context.Background()
+
+	instance, domain, err := domainInstance(ctx, cCtx, true)
+	if err != nil {
+		return err
+	}
+
+	client, err := dnsClient(ctx, cCtx, instance)
+	if err != nil {
+		return err
+	}
+
+	zone, err := findDNSZone(ctx, client, domain)
+	if err != nil {
+		return err
+	}
+
+	record, err := getDNSRecord(ctx, client, zone, domain)
+	if err != nil {
+		return err
+	}
+
+	// Only ever remove the project's own records
+	if record == nil || !slices.Contains(record.Values, instance.PublicIP) {
+		return newError(ErrConfig, domain+" doesn't point at "+instance.Name+" ("+instance.PublicIP+")", nil)
+	}
+
+	if !dryRun && !cCtx.Bool("yes") {
+		if err := confirmName("This will take "+domain+" offline.", domain); err != nil {
+			return err
+		}
+	}
+
+	if err := deleteDNSRecord(ctx, client, *record); err != nil {
+		return err
+	}
+
+	if !dryRun {
+		color.Green("✓ Completed: Removed " + domain)
+	}
+
+	return printResult(DomainResult{Project: ProjectName, InstanceID: instance.ID, PublicIP: instance.PublicIP, Domains: []DNSRecord{*record}, DryRun: dryRun})
+}
+
+// pointDomain creates or updates domain's A record to point at instance,
+// asking first if it points somewhere else
+func pointDomain(ctx context.Context, cCtx *cli.Context, instance Instance, domain string) (DNSRecord, error) {
+	client, err := dnsClient(ctx, cCtx, instance)
+	if err != nil {
+		return DNSRecord{}, err
+	}
+
+	zone, err := findDNSZone(ctx, client, domain)
+	if err != nil {
+		return DNSRecord{}, err
+	}
+
+	record, err := getDNSRecord(ctx, client, zone, domain)
+	if err != nil {
+		return DNSRecord{}, err
+	}
+
+	if record != nil && slices.Equal(record.Values, []string{instance.PublicIP}) {
+		color.Green("✓ " + domain + " already points at " + instance.PublicIP)
+
+		return *record, nil
+	}
+
+	// Moving a live site is easy to do by mistake
+	if record != nil && !dryRun && !cCtx.Bool("yes") {
+		if err := confirm(domain + " points at " + strings.Join(record.Values, ", ") + ", point it at " + instance.Name + " (" + instance.PublicIP + ") instead?"); err != nil {
+			return *record, err
+		}
+	}
+
+	if err := upsertDNSRecord(ctx, client, zone, domain, instance.PublicIP, record); err != nil {
+		return DNSRecord{}, err
+	}
+
+	if !dryRun {
+		color.Green("✓ Completed: Pointed " + domain + " at " + instance.PublicIP + " (" + zone.Provider + " zone " + zone.Zone + ")")
+	}
+
+	return DNSRecord{Domain: domain, Values: []string{instance.PublicIP}, TTL: dnsTTL, DNSZone: zone}, nil
+}
+
+// getCertificate runs the bootstrap script's certbot steps on an instance
+// that is already set up
+func getCertificate(ctx context.Context, cCtx *cli.Context, instance Instance, domain string, email string) error {
+	script, err := renderTLSScript(domain, email)
+	if err != nil {
+		return err
+	}
+
+	color.Magenta("Getting a certificate for " + domain + " on " + instance.Name)
+
+	if err := updateViaSSH(ctx, cCtx, instance, script); err != nil {
+		return err
+	}
+
+	if !dryRun {
+		color.Green("✓ Completed: https://" + domain + " is set up")
+	}
+
+	return nil
+}
+
+// domainInZone reports whether domain belongs in zone
+func domainInZone(domain string, zone string) bool {
+	return domain == zone || strings.HasSuffix(domain, "."+zone)
+}
+
+// findDNSZone finds the most specific public zone domain belongs in, in
+// Route 53 and then Lightsail DNS
+func findDNSZone(ctx context.Context, client *AWSClient, domain string) (DNSZone, error) {
+	found := DNSZone{}
+
+	zones, err := listRoute53Zones(ctx, client)
+	if err != nil {
+		return found, err
+	}
+
+	for _, zone := range zones {
+		if domainInZone(domain, zone.Zone) && len(zone.Zone) > len(found.Zone) {
+			found = zone
+		}
+	}
+
+	if found.Zone != "" {
+		return found, nil
+	}
+
+	zones, err = listLightsailZones(ctx, client)
+	if err != nil {
+		return found, err
+	}
+
+	for _, zone := range zones {
+		if domainInZone(domain, zone.Zone) && len(zone.Zone) > len(found.Zone) {
+			found = zone
+		}
+	}
+
+	if found.Zone == "" {
+		return found, newError(ErrConfig, "no Route 53 hosted zone or Lightsail DNS zone for "+domain+" in profile "+client.Profile, nil)
+	}
+
+	return found, nil
+}
+
+func listRoute53Zones(ctx context.Context, client *AWSClient) ([]DNSZone, error) {
+	zones := []DNSZone{}
+
+	input := &route53.ListHostedZonesInput{}
+	for {
+		out, err := client.Route53.ListHostedZones(ctx, input)
+		if err != nil {
+			return nil, awsError("route53 list-hosted-zones", err)
+		}
+
+		for _, zone := range out.HostedZones {
+			if zone.Config != nil && zone.Config.PrivateZone {
+				continue
+			}
+
+			zones = append(zones, DNSZone{
+				Provider: DNSRoute53,
+				ZoneID:   strings.TrimPrefix(aws.ToString(zone.Id), "/hostedzone/"),
+				Zone:     strings.TrimSuffix(aws.ToString(zone.Name), "."),
+			})
+		}
+
+		if !out.IsTruncated {
+			break
+		}
+
+		input.Marker = out.NextMarker
+	}
+
+	return zones, nil
+}
+
+func listLightsailZones(ctx context.Context, client *AWSClient) ([]DNSZone, error) {
+	zones := []DNSZone{}
+
+	input := &lightsail.GetDomainsInput{}
+	for {
+		out, err := client.Lightsail.GetDomains(ctx, input)
+		if err != nil {
+			return nil, awsError("lightsail get-domains", err)
+		}
+
+		for _, domain := range out.Domains {
+			zones = append(zones, DNSZone{Provider: DNSLightsail, ZoneID: aws.ToString(domain.Name), Zone: aws.ToString(domain.Name)})
+		}
+
+		if aws.ToString(out.NextPageToken) == "" {
+			break
+		}
+
+		input.PageToken = out.NextPageToken
+	}
+
+	return zones, nil
+}
+
+// getDNSRecord returns domain's A record in zone, or nil if it has none
+func getDNSRecord(ctx context.Context, client *AWSClient, zone DNSZone, domain string) (*DNSRecord, error) {
+	if zone.Provider == DNSLightsail {
+		entries, err := getLightsailDomainEntries(ctx, client, zone)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, record := range entries {
+			if record.Domain == domain {
+				return &record, nil
+			}
+		}
+
+		return nil, nil
+	}
+
+	out, err := client.Route53.ListResourceRecordSets(ctx, &route53.ListResourceRecordSetsInput{
+		HostedZoneId:    aws.String(zone.ZoneID),
+		StartRecordName: aws.String(domain),
+		StartRecordType: route53types.RRTypeA,
+		MaxItems:        aws.Int32(1),
+	})
+	if err != nil {
+		return nil, awsError("route53 list-resource-record-sets", err)
+	}
+
+	for _, set := range out.ResourceRecordSets {
+		if record, ok := route53Record(zone, set); ok && record.Domain == domain {
+			return &record, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// route53Record converts an A record set, leaving out aliases which don't
+// point at an IP
+func route53Record(zone DNSZone, set route53types.ResourceRecordSet) (DNSRecord, bool) {
+	if set.Type != route53types.RRTypeA || set.AliasTarget != nil {
+		return DNSRecord{}, false
+	}
+
+	record := DNSRecord{
+		Domain:  strings.TrimSuffix(aws.ToString(set.Name), "."),
+		TTL:     aws.ToInt64(set.TTL),
+		DNSZone: zone,
+	}
+
+	for _, value := range set.ResourceRecords {
+		record.Values = append(record.Values, aws.ToString(value.Value))
+	}
+
+	return record, true
+}
+
+// getLightsailDomainEntries returns the A records of a Lightsail DNS zone
+func getLightsailDomainEntries(ctx context.Context, client *AWSClient, zone DNSZone) ([]DNSRecord, error) {
+	out, err := client.Lightsail.GetDomain(ctx, &lightsail.GetDomainInput{DomainName: aws.String(zone.Zone)})
+	if err != nil {
+		return nil, awsError("lightsail get-domain", err)
+	}
+
+	records := []DNSRecord{}
+
+	for _, entry := range out.Domain.DomainEntries {
+		if aws.ToString(entry.Type) != "A" || aws.ToBool(entry.IsAlias) {
+			continue
+		}
+
+		records = append(records, DNSRecord{
+			Domain:  strings.TrimSuffix(aws.ToString(entry.Name), "."),
+			Values:  []string{aws.ToString(entry.Target)},
+			DNSZone: zone,
+			entryID: aws.ToString(entry.Id),
+		})
+	}
+
+	return records, nil
+}
+
+// upsertDNSRecord points domain at ip, replacing its existing record if it has
+// one
+func upsertDNSRecord(ctx context.Context, client *AWSClient, zone DNSZone, domain string, ip string, existing *DNSRecord) error {
+	if zone.Provider == DNSLightsail {
+		entry := &lightsailtypes.DomainEntry{Name: aws.String(domain), Type: aws.String("A"), Target: aws.String(ip)}
+
+		if existing != nil {
+			entry.Id = aws.String(existing.entryID)
+
+			return awsChange([]string{"lightsail", "update-domain-entry", "--domain-name", zone.Zone, "--domain-entry", "id=" + existing.entryID + ",name=" + domain + ",type=A,target=" + ip, "--profile", client.Profile, "--region", dnsRegion}, func() error {
+				_, err := client.Lightsail.UpdateDomainEntry(ctx, &lightsail.UpdateDomainEntryInput{DomainName: aws.String(zone.Zone), DomainEntry: entry})
+
+				return awsError("lightsail update-domain-entry", err)
+			})
+		}
+
+		return awsChange([]string{"lightsail", "create-domain-entry", "--domain-name", zone.Zone, "--domain-entry", "name=" + domain + ",type=A,target=" + ip, "--profile", client.Profile, "--region", dnsRegion}, func() error {
+			_, err := client.Lightsail.CreateDomainEntry(ctx, &lightsail.CreateDomainEntryInput{DomainName: aws.String(zone.Zone), DomainEntry: entry})
+
+			return awsError("lightsail create-domain-entry", err)
+		})
+	}
+
+	return changeRoute53Record(ctx, client, zone, route53types.ChangeActionUpsert, DNSRecord{Domain: domain, Values: []string{ip}, TTL: dnsTTL})
+}
+
+// deleteDNSRecord deletes a record as it was found
+func deleteDNSRecord(ctx context.Context, client *AWSClient, record DNSRecord) error {
+	if record.Provider == DNSLightsail {
+		return awsChange([]string{"lightsail", "delete-domain-entry", "--domain-name", record.Zone, "--domain-entry", "id=" + record.entryID + ",name=" + record.Domain + ",type=A,target=" + record.Values[0], "--profile", client.Profile, "--region", dnsRegion}, func() error {
+			_, err := client.Lightsail.DeleteDomainEntry(ctx, &lightsail.DeleteDomainEntryInput{
+				DomainName: aws.String(record.Zone),
+				DomainEntry: &lightsailtypes.DomainEntry{
+					Id:     aws.String(record.entryID),
+					Name:   aws.String(record.Domain),
+					Type:   aws.String("A"),
+					Target: aws.String(record.Values[0]),
+				},
+			})
+
+			return awsError("lightsail delete-domain-entry", err)
+		})
+	}
+
+	return changeRoute53Record(ctx, client, record.DNSZone, route53types.ChangeActionDelete, record)
+}
+
+func changeRoute53Record(ctx context.Context, client *AWSClient, zone DNSZone, action route53types.ChangeAction, record DNSRecord) error {
+	values := []route53types.ResourceRecord{}
+	for _, value := range record.Values {
+		values = append(values, route53types.ResourceRecord{Value: aws.String(value)})
+	}
+
+	return awsChange([]string{"route53", "change-resource-record-sets", "--hosted-zone-id", zone.ZoneID, "--change-batch", string(action) + " A " + record.Domain + " " + strings.Join(record.Values, ",") + " ttl=" + strconv.FormatInt(record.TTL, 10), "--profile", client.Profile}, func() error {
+		_, err := client.Route53.ChangeResourceRecordSets(ctx, &route53.ChangeResourceRecordSetsInput{
+			HostedZoneId: aws.String(zone.ZoneID),
+			ChangeBatch: &route53types.ChangeBatch{
+				Comment: aws.String("matrix " + ProjectName),
+				Changes: []route53types.Change{{
+					Action: action,
+					ResourceRecordSet: &route53types.ResourceRecordSet{
+						Name:            aws.String(record.Domain),
+						Type:            route53types.RRTypeA,
+						TTL:             aws.Int64(record.TTL),
+						ResourceRecords: values,
+					},
+				}},
+			},
+		})
+
+		return awsError("route53 change-resource-record-sets", err)
+	})
+}
+
+// listDNSRecords finds the A records pointing at ip in every zone
+func listDNSRecords(ctx context.Context, client *AWSClient, ip string) ([]DNSRecord, error) {
+	records := []DNSRecord{}
+
+	zones, err := listRoute53Zones(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, zone := range zones {
+		input := &route53.ListResourceRecordSetsInput{HostedZoneId: aws.String(zone.ZoneID)}
+		for {
+			out, err := client.Route53.ListResourceRecordSets(ctx, input)
+			if err != nil {
+				return nil, awsError("route53 list-resource-record-sets", err)
+			}
+
+			for _, set := range out.ResourceRecordSets {
+				if record, ok := route53Record(zone, set); ok && slices.Contains(record.Values, ip) {
+					records = append(records, record)
+				}
+			}
+
+			if !out.IsTruncated {
+				break
+			}
+
+			input.StartRecordName = out.NextRecordName
+			input.StartRecordType = out.NextRecordType
+			input.StartRecordIdentifier = out.NextRecordIdentifier
+		}
+	}
+
+	// Lightsail DNS is optional, not having access to it isn't a failure
+	zones, err = listLightsailZones(ctx, client)
+	if errors.Is(err, ErrAWSAccessDenied) {
+		return records, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, zone := range zones {
+		entries, err := getLightsailDomainEntries(ctx, client, zone)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, record := range entries {
+			if slices.Contains(record.Values, ip) {
+				records = append(records, record)
+			}
+		}
+	}
+
+	return records, nil
+}
+
+// deployDomain points the deploy's domain at the instance. A new instance's
+// boot script gets the certificate, an existing one gets it over ssh.
+func deployDomain(ctx context.Context, cCtx *cli.Context, config DeployConfig, instance Instance, updated bool) error {
+	if _, err := pointDomain(ctx, cCtx, instance, config.Bootstrap.Domain); err != nil {
+		return err
+	}
+
+	if !updated {
+		return nil
+	}
+
+	return getCertificate(ctx, cCtx, instance, config.Bootstrap.Domain, config.Bootstrap.CertbotEmail)
+}
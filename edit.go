@@ -1,30 +1,30 @@
 package main
 
 import (
-	"os"
-
 	"github.com/fatih/color"
 	"github.com/urfave/cli/v2"
 )
 
-func edit(cCtx *cli.Context) {
+func edit(cCtx *cli.Context) error {
 	var shallowMode = cCtx.Bool("shallow")
 
 	ProjectName = cCtx.Args().First()
 
 	if ProjectName == "" {
-		color.Red("× Error: Missing project name")
-		os.Exit(1)
+		return newError(ErrMissingProjectName, "", nil)
 	}
 
 	if fileExists(ProjectName) {
-		color.Red("× Error: Project directory already exists")
-		os.Exit(2)
+		return newError(ErrProjectExists, ProjectName, nil)
 	}
 
 	color.Magenta("Setting up existing project to edit: " + ProjectName)
 
-	setupProject(false, shallowMode)
+	if err := setupProject(false, shallowMode); err != nil {
+		return err
+	}
 
 	color.Magenta("Project Ready! cd " + ProjectName)
+
+	return printResult(ActionResult{Action: "edit", Project: ProjectName, Path: "./" + ProjectName, DryRun: dryRun})
 }
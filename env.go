@@ -0,0 +1,495 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/fatih/color"
+	"github.com/joho/godotenv"
+	"github.com/urfave/cli/v2"
+)
+
+// Where Lightsail instances get their environment copied to, as they have no
+// instance role to fetch it with
+const pushedEnvPath = "/root/.matrix/env"
+
+// Names that can be used as environment variables
+var envKeyPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// EnvResult is the result of matrix env push
+type EnvResult struct {
+	Project   string   `json:"project"`
+	File      string   `json:"file"`
+	Added     []string `json:"added"`
+	Changed   []string `json:"changed"`
+	Removed   []string `json:"removed"`
+	Unchanged []string `json:"unchanged"`
+	DryRun    bool     `json:"dryRun,omitempty"`
+}
+
+// EnvDiffResult is the result of matrix env diff. Only keys are ever shown,
+// never values.
+type EnvDiffResult struct {
+	Project    string   `json:"project"`
+	File       string   `json:"file"`
+	OnlyLocal  []string `json:"onlyLocal"`
+	OnlyRemote []string `json:"onlyRemote"`
+	Different  []string `json:"different"`
+	Same       []string `json:"same"`
+}
+
+// EnvPullResult is the result of matrix env pull
+type EnvPullResult struct {
+	Project string   `json:"project"`
+	File    string   `json:"file"`
+	Keys    []string `json:"keys"`
+}
+
+// envParameterPath is where a project's environment variables are kept in
+// SSM, one SecureString parameter per variable
+func envParameterPath(project string) string {
+	return projectParameter(project, "env") + "/"
+}
+
+// envCommands are the subcommands of matrix env
+func envCommands() []*cli.Command {
+	flags := func(extra ...cli.Flag) []cli.Flag {
+		return append(extra,
+			&cli.StringFlag{
+				Name:  "region",
+				Usage: "AWS region the parameters are kept in (default: deploy_region in .matrix/config or ~/.matrix/config, or the profile's region)",
+			},
+			&cli.StringFlag{
+				Name:  "profile",
+				Usage: "AWS profile to use (default: deploy_profile in .matrix/config or ~/.matrix/config, or matrix)",
+			},
+		)
+	}
+
+	return []*cli.Command{
+		{
+			Name:      "push",
+			Usage:     "Store a project's environment variables in SSM Parameter Store",
+			ArgsUsage: "[project]",
+			Flags: flags(
+				&cli.StringFlag{
+					Name:    "file",
+					Aliases: []string{"f"},
+					Usage:   "Env file to push",
+					Value:   ".env",
+				},
+				&cli.StringSliceFlag{
+					Name:  "set",
+					Usage: "Set KEY=value on top of the env file, can be given more than once",
+				},
+				&cli.BoolFlag{
+					Name:  "prune",
+					Usage: "Delete variables in SSM that aren't in the env file",
+				},
+				&cli.BoolFlag{
+					Name:    "yes",
+					Aliases: []string{"y"},
+					Usage:   "Don't ask for confirmation",
+				},
+			),
+			Action: func(cCtx *cli.Context) error {
+				return envPush(cCtx)
+			},
+		},
+		{
+			Name:      "pull",
+			Usage:     "Download a project's environment variables from SSM Parameter Store",
+			ArgsUsage: "[project]",
+			Flags: flags(
+				&cli.StringFlag{
+					Name:  "out",
+					Usage: "File to save the variables to (default: stdout)",
+				},
+				&cli.BoolFlag{
+					Name:    "yes",
+					Aliases: []string{"y"},
+					Usage:   "Overwrite the file without asking",
+				},
+			),
+			Action: func(cCtx *cli.Context) error {
+				return envPull(cCtx)
+			},
+		},
+		{
+			Name:      "diff",
+			Usage:     "Compare the keys of an env file with those in SSM Parameter Store, without showing values",
+			ArgsUsage: "[project]",
+			Flags: flags(
+				&cli.StringFlag{
+					Name:    "file",
+					Aliases: []string{"f"},
+					Usage:   "Env file to compare",
+					Value:   ".env",
+				},
+			),
+			Action: func(cCtx *cli.Context) error {
+				return envDiff(cCtx)
+			},
+		},
+	}
+}
+
+// envClient sets the project from the arguments and connects to where its
+// parameters are kept, which is where it deploys to
+func envClient(cCtx *cli.Context) (*AWSClient, error) {
+	project, err := projectNameFromArgs(cCtx)
+	if err != nil {
+		return nil, err
+	}
+
+	ProjectName = project
+
+	settings, err := loadSettings(cCtx)
+	if err != nil {
+		return nil, err
+	}
+
+	return newAWSClient(context.Background(), settings.Get("profile", "deploy_profile", AWSProfile), settings.Get("region", "deploy_region", ""))
+}
+
+// getEnvParameters returns a project's environment variables from SSM. Without
+// decrypt the values are left encrypted, for when only the keys are needed.
+func getEnvParameters(ctx context.Context, client *AWSClient, project string, decrypt bool) (map[string]string, error) {
+	path := envParameterPath(project)
+	values := map[string]string{}
+
+	input := &ssm.GetParametersByPathInput{Path: aws.String(path), WithDecryption: aws.Bool(decrypt)}
+	for {
+		out, err := client.SSM.GetParametersByPath(ctx, input)
+		if err != nil {
+			return nil, awsError("ssm get-parameters-by-path", err)
+		}
+
+		for _, parameter := range out.Parameters {
+			values[strings.TrimPrefix(aws.ToString(parameter.Name), path)] = aws.ToString(parameter.Value)
+		}
+
+		if aws.ToString(out.NextToken) == "" {
+			break
+		}
+
+		input.NextToken = out.NextToken
+	}
+
+	return values, nil
+}
+
+// readEnvFile reads the variables to push from file, with any KEY=value
+// overrides on top
+func readEnvFile(file string, overrides []string) (map[string]string, error) {
+	values := map[string]string{}
+
+	if file != "" {
+		if !fileExists(file) {
+			return nil, newError(ErrConfig, file+" not found", nil)
+		}
+
+		var err error
+		if values, err = godotenv.Read(file); err != nil {
+			return nil, newError(ErrConfig, "reading "+file, err)
+		}
+	}
+
+	for _, override := range overrides {
+		key, value, ok := strings.Cut(override, "=")
+		if !ok {
+			return nil, newError(ErrConfig, "--set '"+override+"' should be KEY=value", nil)
+		}
+
+		values[key] = value
+	}
+
+	set := map[string]string{}
+
+	for _, key := range sortedKeys(values) {
+		if !envKeyPattern.MatchString(key) {
+			return nil, newError(ErrConfig, "'"+key+"' is not a valid environment variable name", nil)
+		}
+
+		// SSM can't store empty values, and an empty variable is the same as
+		// a missing one to most apps
+		if values[key] == "" {
+			color.Yellow("× Skipping " + key + ", it is empty")
+			continue
+		}
+
+		set[key] = values[key]
+	}
+
+	return set, nil
+}
+
+func sortedKeys(values map[string]string) []string {
+	keys := []string{}
+	for key := range values {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+func envPush(cCtx *cli.Context) error {
+	client, err := envClient(cCtx)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	file := cCtx.String("file")
+
+	local, err := readEnvFile(file, cCtx.StringSlice("set"))
+	if err != nil {
+		return err
+	}
+
+	remote, err := getEnvParameters(ctx, client, ProjectName, true)
+	if err != nil {
+		return err
+	}
+
+	result := EnvResult{Project: ProjectName, File: file, Added: []string{}, Changed: []string{}, Removed: []string{}, Unchanged: []string{}}
+
+	for _, key := range sortedKeys(local) {
+		value, ok := remote[key]
+
+		switch {
+		case !ok:
+			result.Added = append(result.Added, key)
+		case value != local[key]:
+			result.Changed = append(result.Changed, key)
+		default:
+			result.Unchanged = append(result.Unchanged, key)
+		}
+	}
+
+	if cCtx.Bool("prune") {
+		for _, key := range sortedKeys(remote) {
+			if _, ok := local[key]; !ok {
+				result.Removed = append(result.Removed, key)
+			}
+		}
+	}
+
+	color.Magenta("Pushing " + file + " to " + envParameterPath(ProjectName) + " in " + client.Region)
+
+	for _, key := range result.Added {
+		color.Green("  + " + key)
+	}
+
+	for _, key := range result.Changed {
+		color.Yellow("  ~ " + key)
+	}
+
+	for _, key := range result.Removed {
+		color.Red("  - " + key)
+	}
+
+	color.White("  " + strconv.Itoa(len(result.Unchanged)) + " unchanged")
+
+	changes := len(result.Added) + len(result.Changed) + len(result.Removed)
+	if changes == 0 {
+		color.Green("✓ Already up to date")
+
+		return printResult(result)
+	}
+
+	// Nothing changes in a dry run so there is nothing to confirm
+	if !dryRun && !cCtx.Bool("yes") {
+		if err := confirm("Push these changes to SSM?"); err != nil {
+			return err
+		}
+	}
+
+	for _, key := range append(result.Added, result.Changed...) {
+		name := envParameterPath(ProjectName) + key
+		overwrite := remote[key] != ""
+
+		err := awsChange([]string{"ssm", "put-parameter", "--name", name, "--type", "SecureString", "--value", "(hidden)", "--overwrite=" + strconv.FormatBool(overwrite), "--profile", client.Profile, "--region", client.Region}, func() error {
+			input := &ssm.PutParameterInput{
+				Name:      aws.String(name),
+				Type:      ssmtypes.ParameterTypeSecureString,
+				Value:     aws.String(local[key]),
+				Overwrite: aws.Bool(overwrite),
+			}
+
+			// Tags can only be given when the parameter is created
+			if !overwrite {
+				input.Tags = []ssmtypes.Tag{{Key: aws.String("matrix:project"), Value: aws.String(ProjectName)}}
+			}
+
+			_, err := client.SSM.PutParameter(ctx, input)
+
+			return awsError("ssm put-parameter", err)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// DeleteParameters takes at most 10 names at a time
+	for start := 0; start < len(result.Removed); start += 10 {
+		names := []string{}
+		for _, key := range result.Removed[start:min(start+10, len(result.Removed))] {
+			names = append(names, envParameterPath(ProjectName)+key)
+		}
+
+		err := awsChange(append(append([]string{"ssm", "delete-parameters", "--names"}, names...), "--profile", client.Profile, "--region", client.Region), func() error {
+			_, err := client.SSM.DeleteParameters(ctx, &ssm.DeleteParametersInput{Names: names})
+
+			return awsError("ssm delete-parameters", err)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if dryRun {
+		result.DryRun = true
+	} else {
+		color.Green("✓ Completed: Pushed " + file + " to SSM")
+		color.White("New instances write these to .env at boot, servers already running keep the .env they have")
+	}
+
+	return printResult(result)
+}
+
+func envPull(cCtx *cli.Context) error {
+	out := cCtx.String("out")
+
+	// Keep stdout for the variables themselves
+	if out == "" {
+		color.Output = color.Error
+	}
+
+	client, err := envClient(cCtx)
+	if err != nil {
+		return err
+	}
+
+	remote, err := getEnvParameters(context.Background(), client, ProjectName, true)
+	if err != nil {
+		return err
+	}
+
+	if len(remote) == 0 {
+		return newError(ErrConfig, "no variables in "+envParameterPath(ProjectName)+" in "+client.Region+", run 'matrix env push' first", nil)
+	}
+
+	content := marshalEnv(remote)
+
+	if out == "" {
+		fmt.Print(content)
+
+		return nil
+	}
+
+	if fileExists(out) && !cCtx.Bool("yes") {
+		if err := confirm("Overwrite " + out + "?"); err != nil {
+			return err
+		}
+	}
+
+	if err := os.WriteFile(out, []byte(content), 0600); err != nil {
+		return newError(ErrGeneral, "writing "+out, err)
+	}
+
+	color.Green("✓ Completed: Saved " + strconv.Itoa(len(remote)) + " variables to " + out)
+
+	return printResult(EnvPullResult{Project: ProjectName, File: out, Keys: sortedKeys(remote)})
+}
+
+func envDiff(cCtx *cli.Context) error {
+	client, err := envClient(cCtx)
+	if err != nil {
+		return err
+	}
+
+	file := cCtx.String("file")
+
+	local, err := readEnvFile(file, nil)
+	if err != nil {
+		return err
+	}
+
+	remote, err := getEnvParameters(context.Background(), client, ProjectName, true)
+	if err != nil {
+		return err
+	}
+
+	result := EnvDiffResult{Project: ProjectName, File: file, OnlyLocal: []string{}, OnlyRemote: []string{}, Different: []string{}, Same: []string{}}
+
+	for _, key := range sortedKeys(local) {
+		value, ok := remote[key]
+
+		switch {
+		case !ok:
+			result.OnlyLocal = append(result.OnlyLocal, key)
+		case value != local[key]:
+			result.Different = append(result.Different, key)
+		default:
+			result.Same = append(result.Same, key)
+		}
+	}
+
+	for _, key := range sortedKeys(remote) {
+		if _, ok := local[key]; !ok {
+			result.OnlyRemote = append(result.OnlyRemote, key)
+		}
+	}
+
+	color.Magenta("Comparing " + file + " with " + envParameterPath(ProjectName) + " in " + client.Region)
+
+	for _, key := range result.OnlyLocal {
+		color.Green("  + " + key + " (only in " + file + ")")
+	}
+
+	for _, key := range result.OnlyRemote {
+		color.Red("  - " + key + " (only in SSM)")
+	}
+
+	for _, key := range result.Different {
+		color.Yellow("  ~ " + key + " (different values)")
+	}
+
+	color.White("  " + strconv.Itoa(len(result.Same)) + " the same")
+
+	return printResult(result)
+}
+
+// pushEnv copies a project's environment from SSM to an instance that can't
+// fetch it itself, for its boot script to write to .env
+func pushEnv(ctx context.Context, cCtx *cli.Context, client *AWSClient, instance Instance, timeout time.Duration) error {
+	remote, err := getEnvParameters(ctx, client, ProjectName, true)
+	if err != nil || len(remote) == 0 {
+		return err
+	}
+
+	return pushSecret(ctx, cCtx, instance, pushedEnvPath, marshalEnv(remote), "environment", timeout)
+}
+
+// marshalEnv writes variables in .env format, quoted so they are read back
+// as they are
+func marshalEnv(values map[string]string) string {
+	content := ""
+	for _, key := range sortedKeys(values) {
+		content += key + "=" + dotenvValue(values[key]) + "\n"
+	}
+
+	return content
+}
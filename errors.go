@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"strings"
+)
+
+// Kinds of error a command can fail with. Each kind maps to a stable exit
+// code (see exitCodes) so scripts wrapping matrix can tell them apart.
+var (
+	ErrGeneral            = errors.New("error")
+	ErrMissingProjectName = errors.New("missing project name")
+	ErrProjectExists      = errors.New("project directory already exists")
+	ErrProjectNotFound    = errors.New("project directory not found")
+	ErrToolNotInstalled   = errors.New("required tool not installed")
+	ErrConfig             = errors.New("invalid or missing configuration")
+	ErrUnsupported        = errors.New("not supported")
+	ErrCancelled          = errors.New("cancelled")
+	ErrTimeout            = errors.New("timed out")
+	ErrCommandFailed      = errors.New("command failed")
+	ErrGitCloneFailed     = errors.New("git clone failed")
+	ErrGitHub             = errors.New("github request failed")
+	ErrDatabaseDump       = errors.New("database dump failed")
+	ErrArchive            = errors.New("creating archive failed")
+	ErrAWSAuthExpired     = errors.New("aws auth expired")
+	ErrAWS                = errors.New("aws request failed")
+	ErrAWSThrottled       = errors.New("aws request throttled")
+	ErrAWSAccessDenied    = errors.New("aws access denied")
+	ErrInstanceNotFound   = errors.New("no instance found for project")
+	ErrAmbiguousInstance  = errors.New("more than one instance found for project")
+	ErrDeployNotFound     = errors.New("deploy not found")
+	ErrBackupNotFound     = errors.New("backup not found")
+	ErrHealthCheck        = errors.New("health check failed")
+	ErrBackupDamaged      = errors.New("backup damaged")
+	ErrBackupKey          = errors.New("can't decrypt backup")
+)
+
+// Exit codes, in the order they are matched. These are part of the public
+// interface of matrix so never renumber an existing entry.
+var exitCodes = []struct {
+	kind error
+	code int
+}{
+	{ErrGeneral, 1},
+	{ErrMissingProjectName, 2},
+	{ErrProjectExists, 3},
+	{ErrProjectNotFound, 4},
+	{ErrToolNotInstalled, 5},
+	{ErrConfig, 6},
+	{ErrUnsupported, 7},
+	{ErrCancelled, 8},
+	{ErrTimeout, 9},
+	{ErrCommandFailed, 10},
+	{ErrGitCloneFailed, 11},
+	{ErrGitHub, 12},
+	{ErrDatabaseDump, 13},
+	{ErrArchive, 14},
+	{ErrAWSAuthExpired, 20},
+	{ErrAWS, 21},
+	{ErrAWSThrottled, 22},
+	{ErrAWSAccessDenied, 23},
+	{ErrInstanceNotFound, 24},
+	{ErrAmbiguousInstance, 25},
+	{ErrDeployNotFound, 26},
+	{ErrBackupNotFound, 27},
+	{ErrHealthCheck, 28},
+	{ErrBackupDamaged, 29},
+	{ErrBackupKey, 30},
+}
+
+// Tips shown underneath an error of a given kind
+var errorHints = map[error]string{
+	ErrAWSAuthExpired:    "Your AWS token probably has expired. Run 'matrix configure' to setup AWS CLI Auth again",
+	ErrCommandFailed:     "Tip: Run the above command separately for more info to find out what went wrong",
+	ErrGitHub:            "Run 'matrix configure' to login to Github CLI again",
+	ErrAWSThrottled:      "AWS is rate limiting requests, wait a minute and try again",
+	ErrCancelled:         "Pass --yes to skip the confirmation",
+	ErrInstanceNotFound:  "Run 'matrix aws --list' to see the instances, use --profile and --region to search other accounts and regions",
+	ErrAmbiguousInstance: "Use --profile and --region to pick one",
+	ErrDeployNotFound:    "Run 'matrix deploy history' to see the deploys and pick one with --to",
+	ErrHealthCheck:       "Run 'matrix ssh' to look around the server, or 'matrix rollback' to go back to the previous deploy",
+	ErrBackupDamaged:     "Restore another backup with --backup",
+	ErrBackupKey:         "Give the key the backup was encrypted with, or check your AWS role can use its KMS key",
+	ErrAWSAccessDenied:   "Your AWS role doesn't have permission for this, ask an admin to check the IAM Identity Center permission set",
+}
+
+// Error is the error returned by all matrix commands
+type Error struct {
+	Kind error
+	Msg  string
+	Err  error
+}
+
+func newError(kind error, msg string, err error) *Error {
+	return &Error{Kind: kind, Msg: msg, Err: err}
+}
+
+func (e *Error) Error() string {
+	message := e.Kind.Error()
+
+	if e.Msg != "" {
+		message += ": " + e.Msg
+	}
+
+	if e.Err != nil {
+		message += ": " + e.Err.Error()
+	}
+
+	return message
+}
+
+func (e *Error) Is(target error) bool {
+	return e.Kind == target
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// exitCode maps an error to its exit code using the outermost matrix Error
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	var matrixErr *Error
+	if !errors.As(err, &matrixErr) {
+		return 1
+	}
+
+	for _, exitCode := range exitCodes {
+		if matrixErr.Kind == exitCode.kind {
+			return exitCode.code
+		}
+	}
+
+	return 1
+}
+
+// errorHint returns the tip for the outermost matrix Error, if it has one
+func errorHint(err error) string {
+	var matrixErr *Error
+	if !errors.As(err, &matrixErr) {
+		return ""
+	}
+
+	return errorHints[matrixErr.Kind]
+}
+
+// commandError wraps the error from running cmd, including anything it wrote
+// to stderr, and picks the kind from what went wrong
+func commandError(kind error, cmd *exec.Cmd, err error) *Error {
+	if errors.Is(err, exec.ErrNotFound) {
+		return newError(ErrToolNotInstalled, cmd.Args[0], err)
+	}
+
+	msg := cmd.String()
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+		stderr := strings.TrimSpace(string(exitErr.Stderr))
+		msg += ": " + stderr
+
+		if cmd.Args[0] == "aws" && isAWSAuthError(stderr) {
+			kind = ErrAWSAuthExpired
+		}
+	}
+
+	return newError(kind, msg, err)
+}
+
+// isAWSAuthError spots the messages the AWS CLI prints when the SSO session
+// or its token has expired
+func isAWSAuthError(stderr string) bool {
+	for _, message := range []string{
+		"Token has expired",
+		"session associated with this profile has expired",
+		"Error loading SSO Token",
+		"ExpiredToken",
+		"Unable to locate credentials",
+	} {
+		if strings.Contains(stderr, message) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// Executor runs the external commands (git, ddev, aws, gh...) that matrix
+// shells out to. Every command goes through the package level executor so
+// that it can be previewed with --dry-run or captured with --record.
+type Executor interface {
+	// Run executes a command that may change something, using whatever
+	// stdin/stdout/stderr the caller has attached to it.
+	Run(cmd *exec.Cmd) error
+
+	// Output executes a command that may change something and returns its stdout.
+	Output(cmd *exec.Cmd) ([]byte, error)
+
+	// Lookup executes a read-only command (gh api user, git config --get...)
+	// and returns its stdout. Lookups still run in dry-run mode so the preview
+	// shows the real values the command would use.
+	Lookup(cmd *exec.Cmd) ([]byte, error)
+
+	// Call makes an API request that changes something. args describe the
+	// request like the equivalent CLI command so it can be previewed and
+	// recorded the same way as a command.
+	Call(args []string, call func() error) error
+}
+
+var executor Executor = realExecutor{}
+var dryRun bool = false
+
+// realExecutor runs every command for real
+type realExecutor struct{}
+
+func (realExecutor) Run(cmd *exec.Cmd) error {
+	return cmd.Run()
+}
+
+func (realExecutor) Output(cmd *exec.Cmd) ([]byte, error) {
+	return cmd.Output()
+}
+
+func (realExecutor) Lookup(cmd *exec.Cmd) ([]byte, error) {
+	return cmd.Output()
+}
+
+func (realExecutor) Call(args []string, call func() error) error {
+	return call()
+}
+
+// dryRunExecutor prints the commands that would change something instead of
+// running them
+type dryRunExecutor struct {
+	lookup Executor
+}
+
+func (e dryRunExecutor) Run(cmd *exec.Cmd) error {
+	printDryRun(cmd)
+
+	return nil
+}
+
+func (e dryRunExecutor) Output(cmd *exec.Cmd) ([]byte, error) {
+	printDryRun(cmd)
+
+	return []byte{}, nil
+}
+
+func (e dryRunExecutor) Lookup(cmd *exec.Cmd) ([]byte, error) {
+	return e.lookup.Lookup(cmd)
+}
+
+func (e dryRunExecutor) Call(args []string, call func() error) error {
+	color.Cyan("» Dry Run: " + strings.Join(args, " "))
+
+	return nil
+}
+
+func printDryRun(cmd *exec.Cmd) {
+	if cmd.Dir != "" {
+		color.Cyan("» Dry Run: (cd " + cmd.Dir + " && " + cmd.String() + ")")
+	} else {
+		color.Cyan("» Dry Run: " + cmd.String())
+	}
+}
+
+// Recording is a single line of a --record file
+type Recording struct {
+	Time    time.Time `json:"time"`
+	Mode    string    `json:"mode"`
+	Dir     string    `json:"dir,omitempty"`
+	Args    []string  `json:"args"`
+	DryRun  bool      `json:"dryRun,omitempty"`
+	Error   string    `json:"error,omitempty"`
+	Elapsed string    `json:"elapsed"`
+}
+
+// recordingExecutor appends every invocation as a JSON line to a file and
+// then hands the command on to the wrapped executor
+type recordingExecutor struct {
+	next Executor
+	file *os.File
+	mu   sync.Mutex
+}
+
+func newRecordingExecutor(next Executor, fileName string) (*recordingExecutor, error) {
+	f, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &recordingExecutor{next: next, file: f}, nil
+}
+
+func (e *recordingExecutor) Run(cmd *exec.Cmd) error {
+	start := time.Now()
+	err := e.next.Run(cmd)
+	e.record("run", cmd, start, err)
+
+	return err
+}
+
+func (e *recordingExecutor) Output(cmd *exec.Cmd) ([]byte, error) {
+	start := time.Now()
+	out, err := e.next.Output(cmd)
+	e.record("output", cmd, start, err)
+
+	return out, err
+}
+
+func (e *recordingExecutor) Lookup(cmd *exec.Cmd) ([]byte, error) {
+	start := time.Now()
+	out, err := e.next.Lookup(cmd)
+	e.record("lookup", cmd, start, err)
+
+	return out, err
+}
+
+func (e *recordingExecutor) Call(args []string, call func() error) error {
+	start := time.Now()
+	err := e.next.Call(args, call)
+	e.write(Recording{Time: start, Mode: "call", Args: args, DryRun: dryRun}, start, err)
+
+	return err
+}
+
+func (e *recordingExecutor) record(mode string, cmd *exec.Cmd, start time.Time, err error) {
+	e.write(Recording{
+		Time:   start,
+		Mode:   mode,
+		Dir:    cmd.Dir,
+		Args:   cmd.Args,
+		DryRun: dryRun && mode != "lookup",
+	}, start, err)
+}
+
+func (e *recordingExecutor) write(r Recording, start time.Time, err error) {
+	r.Elapsed = time.Since(start).String()
+
+	if err != nil {
+		r.Error = strings.TrimSpace(err.Error())
+	}
+
+	line, jsonErr := json.Marshal(r)
+	if jsonErr != nil {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.file.Write(append(line, '\n'))
+}
+
+func (e *recordingExecutor) Close() error {
+	return e.file.Close()
+}
+
+// setupExecutor picks the executor for this run from the global flags
+func setupExecutor(dryRunMode bool, recordFile string) error {
+	dryRun = dryRunMode
+
+	executor = realExecutor{}
+
+	if dryRun {
+		executor = dryRunExecutor{lookup: realExecutor{}}
+
+		color.Cyan("» Dry Run: no changes will be made")
+	}
+
+	if recordFile != "" {
+		recorder, err := newRecordingExecutor(executor, recordFile)
+		if err != nil {
+			return err
+		}
+
+		executor = recorder
+	}
+
+	return nil
+}
+
+// closeExecutor flushes anything the executor holds open
+func closeExecutor() {
+	if recorder, ok := executor.(*recordingExecutor); ok {
+		recorder.Close()
+	}
+}
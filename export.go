@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"html/template"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/urfave/cli/v2"
+)
+
+// exportColumn is a column that can be picked with --columns
+type exportColumn struct {
+	Key     string
+	Header  string
+	Numeric bool
+	Value   func(instance Instance) string
+}
+
+var exportColumns = []exportColumn{
+	{"provider", "Provider", false, func(i Instance) string { return i.Provider }},
+	{"name", "Name", false, func(i Instance) string { return i.Name }},
+	{"id", "ID", false, func(i Instance) string { return i.ID }},
+	{"state", "State", false, func(i Instance) string { return i.State }},
+	{"type", "Type", false, func(i Instance) string { return i.Type }},
+	{"public-ip", "Public IP", false, func(i Instance) string { return i.PublicIP }},
+	{"private-ip", "Private IP", false, func(i Instance) string { return i.PrivateIP }},
+	{"cpus", "CPUs", true, func(i Instance) string { return strconv.Itoa(int(i.CPUs)) }},
+	{"ram", "RAM (GB)", true, func(i Instance) string { return strconv.FormatFloat(i.RAMGB, 'f', -1, 64) }},
+	{"disk", "Disk (GB)", true, func(i Instance) string { return strconv.Itoa(int(i.DiskGB)) }},
+	{"region", "Region", false, func(i Instance) string { return i.Region }},
+	{"zone", "Zone", false, func(i Instance) string { return i.Zone }},
+	{"account", "Account", false, func(i Instance) string { return i.Account }},
+	{"profile", "Profile", false, func(i Instance) string { return i.Profile }},
+	{"launched", "Launched", false, func(i Instance) string {
+		if i.LaunchTime == nil {
+			return ""
+		}
+
+		return i.LaunchTime.UTC().Format(time.RFC3339)
+	}},
+}
+
+var defaultExportColumns = "provider,name,id,state,type,public-ip,private-ip,region,account"
+
+// Formats for --export
+var exportFormats = map[string]func(w io.Writer, columns []exportColumn, instances []Instance) error{
+	"csv":  exportCSV,
+	"md":   exportMarkdown,
+	"html": exportHTML,
+	"json": exportJSON,
+}
+
+// exportInventory renders the instance inventory in the --export format to
+// --out, or stdout when no file is given. It returns the file written to.
+func exportInventory(cCtx *cli.Context) (string, error) {
+	format := cCtx.String("export")
+	fileName := cCtx.String("out")
+
+	render, ok := exportFormats[format]
+	if !ok {
+		return "", newError(ErrConfig, "unknown export format '"+format+"', use csv, md, html or json", nil)
+	}
+
+	columns, err := pickExportColumns(cCtx.String("columns"))
+	if err != nil {
+		return "", err
+	}
+
+	// Keep stdout for the export itself
+	if fileName == "" {
+		color.Output = color.Error
+	}
+
+	inventory, err := getInventory(context.Background(), cCtx, false)
+	if err != nil {
+		return "", err
+	}
+
+	instances := inventory.Instances
+
+	if err := sortInstances(instances, cCtx.String("sort")); err != nil {
+		return "", err
+	}
+
+	var w io.Writer = os.Stdout
+
+	if fileName != "" {
+		f, err := os.Create(fileName)
+		if err != nil {
+			return "", newError(ErrGeneral, "creating "+fileName, err)
+		}
+		defer f.Close()
+
+		w = f
+	}
+
+	if err := render(w, columns, instances); err != nil {
+		return "", newError(ErrGeneral, "exporting "+format, err)
+	}
+
+	if fileName != "" {
+		color.Green("✓ Completed: Exported " + strconv.Itoa(len(instances)) + " instances to " + fileName)
+	}
+
+	return fileName, nil
+}
+
+// pickExportColumns turns a comma separated list of column keys into columns
+func pickExportColumns(keys string) ([]exportColumn, error) {
+	if keys == "" {
+		keys = defaultExportColumns
+	}
+
+	var columns []exportColumn
+
+	for _, key := range configList(keys) {
+		column, ok := findExportColumn(key)
+		if !ok {
+			return nil, newError(ErrConfig, "unknown column '"+key+"', use "+exportColumnKeys(), nil)
+		}
+
+		columns = append(columns, column)
+	}
+
+	return columns, nil
+}
+
+func findExportColumn(key string) (exportColumn, bool) {
+	for _, column := range exportColumns {
+		if column.Key == key {
+			return column, true
+		}
+	}
+
+	return exportColumn{}, false
+}
+
+func exportColumnKeys() string {
+	var keys []string
+	for _, column := range exportColumns {
+		keys = append(keys, column.Key)
+	}
+
+	return strings.Join(keys, ", ")
+}
+
+// sortInstances sorts by a comma separated list of column keys, each
+// prefixed with - to sort that column in descending order
+func sortInstances(instances []Instance, keys string) error {
+	type sortKey struct {
+		column     exportColumn
+		descending bool
+	}
+
+	var sortKeys []sortKey
+
+	for _, key := range configList(keys) {
+		descending := strings.HasPrefix(key, "-")
+
+		column, ok := findExportColumn(strings.TrimPrefix(key, "-"))
+		if !ok {
+			return newError(ErrConfig, "unknown sort column '"+key+"', use "+exportColumnKeys(), nil)
+		}
+
+		sortKeys = append(sortKeys, sortKey{column, descending})
+	}
+
+	sort.SliceStable(instances, func(i, j int) bool {
+		for _, key := range sortKeys {
+			a, b := key.column.Value(instances[i]), key.column.Value(instances[j])
+			if a == b {
+				continue
+			}
+
+			less := a < b
+			if key.column.Numeric {
+				x, _ := strconv.ParseFloat(a, 64)
+				y, _ := strconv.ParseFloat(b, 64)
+				less = x < y
+			}
+
+			if key.descending {
+				return !less
+			}
+
+			return less
+		}
+
+		return false
+	})
+
+	return nil
+}
+
+func exportRows(columns []exportColumn, instances []Instance) [][]string {
+	var rows [][]string
+
+	for _, instance := range instances {
+		row := make([]string, len(columns))
+		for i, column := range columns {
+			row[i] = column.Value(instance)
+		}
+
+		rows = append(rows, row)
+	}
+
+	return rows
+}
+
+func exportHeaders(columns []exportColumn) []string {
+	headers := make([]string, len(columns))
+	for i, column := range columns {
+		headers[i] = column.Header
+	}
+
+	return headers
+}
+
+func exportCSV(w io.Writer, columns []exportColumn, instances []Instance) error {
+	writer := csv.NewWriter(w)
+
+	if err := writer.Write(exportHeaders(columns)); err != nil {
+		return err
+	}
+
+	if err := writer.WriteAll(exportRows(columns, instances)); err != nil {
+		return err
+	}
+
+	return writer.Error()
+}
+
+func exportMarkdown(w io.Writer, columns []exportColumn, instances []Instance) error {
+	escape := strings.NewReplacer("|", "\\|", "\n", " ")
+
+	line := func(cells []string) string {
+		for i, cell := range cells {
+			cells[i] = escape.Replace(cell)
+		}
+
+		return "| " + strings.Join(cells, " | ") + " |\n"
+	}
+
+	separators := make([]string, len(columns))
+	for i, column := range columns {
+		separators[i] = "---"
+		if column.Numeric {
+			separators[i] = "--:"
+		}
+	}
+
+	out := line(exportHeaders(columns)) + "| " + strings.Join(separators, " | ") + " |\n"
+
+	for _, row := range exportRows(columns, instances) {
+		out += line(row)
+	}
+
+	_, err := io.WriteString(w, out)
+
+	return err
+}
+
+var exportHTMLTemplate = template.Must(template.New("export").Parse(`<table>
+  <thead>
+    <tr>{{range .Headers}}<th>{{.}}</th>{{end}}</tr>
+  </thead>
+  <tbody>
+{{- range .Rows}}
+    <tr>{{range .}}<td>{{.}}</td>{{end}}</tr>
+{{- end}}
+  </tbody>
+</table>
+`))
+
+func exportHTML(w io.Writer, columns []exportColumn, instances []Instance) error {
+	return exportHTMLTemplate.Execute(w, struct {
+		Headers []string
+		Rows    [][]string
+	}{exportHeaders(columns), exportRows(columns, instances)})
+}
+
+func exportJSON(w io.Writer, columns []exportColumn, instances []Instance) error {
+	objects := []map[string]string{}
+
+	for _, row := range exportRows(columns, instances) {
+		object := map[string]string{}
+		for i, column := range columns {
+			object[column.Key] = row[i]
+		}
+
+		objects = append(objects, object)
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(objects)
+}
@@ -1,58 +1,73 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
 	"os"
 	"os/exec"
+	"strings"
 
 	"github.com/fatih/color"
+	"github.com/mattn/go-isatty"
 )
 
-func runCommand(cmd *exec.Cmd, showOutput bool, inProject bool, exitOnError bool) {
+// runCommand runs cmd with the spinner going. When exitOnError is set a
+// failure is returned as an ErrCommandFailed error, otherwise it is only
+// reported as a warning and nil is returned.
+func runCommand(cmd *exec.Cmd, showOutput bool, inProject bool, exitOnError bool) error {
 	s.Start()
 
 	if inProject {
 		cmd.Dir = "./" + ProjectName
 	}
 
+	if dryRun {
+		s.Stop()
+		executor.Run(cmd)
+
+		return nil
+	}
+
 	color.White("Running: " + cmd.String())
 
+	var out []byte
+	var err error
+
 	if showOutput {
-		out, err := cmd.Output()
-		if err != nil {
-			s.Stop()
-
-			if exitOnError {
-				color.Red("× Error Running: " + cmd.String())
-				color.Red("× " + err.Error())
-				os.Exit(commandCount)
-			} else {
-				color.Yellow("× Error Running: " + cmd.String())
-				color.Yellow("× " + err.Error())
-			}
-		}
-		fmt.Println(string(out))
+		out, err = executor.Output(cmd)
 	} else {
-		err := cmd.Run()
-		if err != nil {
-			s.Stop()
-
-			if exitOnError {
-				color.Red("× Error Running: " + cmd.String())
-				color.Red("× " + err.Error())
-				color.White("Tip: Run the above command separately for more info to find out what went wrong")
-				os.Exit(commandCount)
-			} else {
-				color.Yellow("× Error Running: " + cmd.String())
-				color.Yellow(err.Error())
-			}
-		} else {
-			s.Stop()
-			color.Green("✓ Completed: " + cmd.String())
+		err = executor.Run(cmd)
+	}
+
+	s.Stop()
+
+	if err != nil {
+		if exitOnError {
+			color.Red("× Error Running: " + cmd.String())
+
+			return commandError(ErrCommandFailed, cmd, err)
 		}
+
+		color.Yellow("× Error Running: " + cmd.String())
+		color.Yellow("× " + err.Error())
+	} else if !showOutput {
+		color.Green("✓ Completed: " + cmd.String())
 	}
 
-	commandCount++
+	if showOutput {
+		printCommandOutput(out)
+	}
+
+	return nil
+}
+
+// ActionResult is the result of the commands that don't have anything more to
+// report than what they did (create, edit, delete, update, configure)
+type ActionResult struct {
+	Action  string `json:"action"`
+	Project string `json:"project,omitempty"`
+	Path    string `json:"path,omitempty"`
+	DryRun  bool   `json:"dryRun,omitempty"`
 }
 
 func fileExists(fileName string) bool {
@@ -62,3 +77,40 @@ func fileExists(fileName string) bool {
 		return false
 	}
 }
+
+// confirm asks a yes/no question, returning an ErrCancelled error unless it is
+// answered yes
+func confirm(question string) error {
+	answer := strings.ToLower(ask(question + " [y/N] "))
+
+	if answer != "y" && answer != "yes" {
+		return newError(ErrCancelled, "", nil)
+	}
+
+	return nil
+}
+
+// confirmName asks for name to be typed out before doing something that
+// can't be undone
+func confirmName(question string, name string) error {
+	if ask(question+" Type '"+name+"' to confirm: ") != name {
+		return newError(ErrCancelled, "", nil)
+	}
+
+	return nil
+}
+
+// ask prompts on the progress output and reads a line from stdin. Without a
+// terminal attached the answer is empty.
+func ask(prompt string) string {
+	color.New(color.FgYellow).Fprint(color.Output, prompt)
+
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+
+	// The answer wasn't typed out so finish the prompt line
+	if err != nil || !isatty.IsTerminal(os.Stdin.Fd()) {
+		fmt.Fprintln(color.Output)
+	}
+
+	return strings.TrimSpace(answer)
+}
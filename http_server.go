@@ -13,15 +13,8 @@ import (
 	"github.com/fatih/color"
 )
 
-type Instance struct {
-	Name         string
-	State        string
-	PublicIP     string
-	PrivateIP    string
-	InstanceType string
-}
-
-type Instances struct {
+// IndexPage is the data for html/index.html
+type IndexPage struct {
 	Instances []Instance
 }
 
@@ -32,39 +25,13 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
 		fmt.Println(err)
 	}
 
-	var lightsailInstancesJSON map[string]interface{} = getLightsailInstancesAsJSON()
-	var ec2InstancesJSON map[string]interface{} = getEC2InstancesAsJSON()
-
-	data := Instances{}
-
-	for _, raw := range lightsailInstancesJSON["instances"].([]interface{}) {
-		m := raw.(map[string]interface{})
-		state := m["state"].(map[string]interface{})["name"].(string)
-
-		data.Instances = append(data.Instances, Instance{
-			Name:         m["name"].(string),
-			State:        state,
-			PublicIP:     m["publicIpAddress"].(string),
-			PrivateIP:    m["privateIpAddress"].(string),
-			InstanceType: "lightsail",
-		})
+	inventory, err := getInventory(r.Context(), nil, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
 	}
 
-	for _, raw := range ec2InstancesJSON["Reservations"].([]interface{}) {
-		m := raw.(map[string]interface{})
-		for _, raw2 := range m["Instances"].([]interface{}) {
-			m2 := raw2.(map[string]interface{})
-			state := m2["State"].(map[string]interface{})["Name"].(string)
-
-			data.Instances = append(data.Instances, Instance{
-				Name:         m2["Tags"].([]interface{})[0].(map[string]interface{})["Value"].(string),
-				State:        state,
-				PublicIP:     m2["PublicIpAddress"].(string),
-				PrivateIP:    m2["PrivateIpAddress"].(string),
-				InstanceType: "ec2",
-			})
-		}
-	}
+	data := IndexPage{Instances: inventory.Instances}
 
 	tmpl.Execute(w, data)
 
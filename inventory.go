@@ -0,0 +1,599 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/lightsail"
+	lightsailtypes "github.com/aws/aws-sdk-go-v2/service/lightsail/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Providers an Instance can come from
+const (
+	ProviderEC2       = "ec2"
+	ProviderLightsail = "lightsail"
+)
+
+// Instance is a single server in the AWS inventory, normalized so EC2 and
+// Lightsail instances can be listed side by side. Anything AWS doesn't report
+// for an instance (a stopped instance has no public IP) is left empty.
+type Instance struct {
+	Provider   string            `json:"provider"`
+	Name       string            `json:"name"`
+	ID         string            `json:"id"`
+	State      string            `json:"state"`
+	Type       string            `json:"type"`
+	PublicIP   string            `json:"publicIp,omitempty"`
+	PrivateIP  string            `json:"privateIp,omitempty"`
+	CPUs       int32             `json:"cpus,omitempty"`
+	RAMGB      float64           `json:"ramGb,omitempty"`
+	DiskGB     int32             `json:"diskGb,omitempty"`
+	Region     string            `json:"region"`
+	Account    string            `json:"account,omitempty"`
+	Profile    string            `json:"profile,omitempty"`
+	Zone       string            `json:"zone,omitempty"`
+	Image      string            `json:"image,omitempty"`
+	KeyName    string            `json:"keyName,omitempty"`
+	Tags       map[string]string `json:"tags,omitempty"`
+	LaunchTime *time.Time        `json:"launchTime,omitempty"`
+}
+
+// Volume is an EBS volume
+type Volume struct {
+	ID         string            `json:"id"`
+	Name       string            `json:"name,omitempty"`
+	State      string            `json:"state"`
+	Type       string            `json:"type"`
+	SizeGB     int32             `json:"sizeGb"`
+	IOPS       int32             `json:"iops,omitempty"`
+	Encrypted  bool              `json:"encrypted"`
+	InstanceID string            `json:"instanceId,omitempty"`
+	Zone       string            `json:"zone,omitempty"`
+	Region     string            `json:"region"`
+	Account    string            `json:"account,omitempty"`
+	Profile    string            `json:"profile,omitempty"`
+	Tags       map[string]string `json:"tags,omitempty"`
+	CreateTime *time.Time        `json:"createTime,omitempty"`
+
+	// Whether the volume goes when the instance it is attached to does
+	DeleteOnTermination bool `json:"deleteOnTermination,omitempty"`
+}
+
+// Bucket is an S3 bucket. Buckets belong to the account rather than a region
+// so they are only collected once per profile.
+type Bucket struct {
+	Name         string     `json:"name"`
+	Region       string     `json:"region,omitempty"`
+	Account      string     `json:"account,omitempty"`
+	Profile      string     `json:"profile,omitempty"`
+	CreationDate *time.Time `json:"creationDate,omitempty"`
+}
+
+// StaticIP is a Lightsail static IP
+type StaticIP struct {
+	Name       string     `json:"name"`
+	IP         string     `json:"ip"`
+	Attached   bool       `json:"attached"`
+	AttachedTo string     `json:"attachedTo,omitempty"`
+	Region     string     `json:"region"`
+	Account    string     `json:"account,omitempty"`
+	Profile    string     `json:"profile,omitempty"`
+	CreatedAt  *time.Time `json:"createdAt,omitempty"`
+}
+
+// Inventory is everything collected from AWS. Volumes, Buckets and StaticIPs
+// are only filled in when collecting with resources.
+type Inventory struct {
+	Instances []Instance       `json:"instances"`
+	Volumes   []Volume         `json:"volumes,omitempty"`
+	Buckets   []Bucket         `json:"buckets,omitempty"`
+	StaticIPs []StaticIP       `json:"staticIps,omitempty"`
+	Errors    []InventoryError `json:"errors,omitempty"`
+}
+
+// InventoryTarget is one profile (account) and region to collect from
+type InventoryTarget struct {
+	Profile string `json:"profile"`
+	Region  string `json:"region"`
+
+	// Collect the account wide resources (S3 buckets) from this target
+	Global bool `json:"-"`
+}
+
+// InventoryError records a profile and region that couldn't be collected so
+// the rest of the inventory can still be shown
+type InventoryError struct {
+	Profile string `json:"profile"`
+	Region  string `json:"region"`
+	Error   string `json:"error"`
+}
+
+// inventoryTargets works out which profiles and regions to collect from. Flags
+// win over aws_profiles and aws_regions in ~/.matrix/config, and with neither
+// the matrix profile's default region is used.
+func inventoryTargets(profiles []string, regions []string) ([]InventoryTarget, error) {
+	config, err := readMatrixConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(profiles) == 0 {
+		profiles = configList(config["aws_profiles"])
+	}
+	if len(profiles) == 0 {
+		profiles = []string{AWSProfile}
+	}
+
+	if len(regions) == 0 {
+		regions = configList(config["aws_regions"])
+	}
+	if len(regions) == 0 {
+		// Empty region uses the profile's default
+		regions = []string{""}
+	}
+
+	var targets []InventoryTarget
+	for _, profile := range profiles {
+		for i, region := range regions {
+			targets = append(targets, InventoryTarget{Profile: profile, Region: region, Global: i == 0})
+		}
+	}
+
+	return targets, nil
+}
+
+// collectInventoryAcross collects every target concurrently and merges the
+// results. A target that fails is recorded in Inventory.Errors, and an error
+// is only returned when every target failed.
+func collectInventoryAcross(ctx context.Context, targets []InventoryTarget, resources bool) (Inventory, error) {
+	inventory := Inventory{Instances: []Instance{}}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var firstErr error
+
+	for _, target := range targets {
+		wg.Add(1)
+
+		go func(target InventoryTarget) {
+			defer wg.Done()
+
+			targetInventory, err := collectTarget(ctx, target, resources)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+
+				inventory.Errors = append(inventory.Errors, InventoryError{
+					Profile: target.Profile,
+					Region:  valueOr(target.Region, "default"),
+					Error:   err.Error(),
+				})
+
+				return
+			}
+
+			inventory.Instances = append(inventory.Instances, targetInventory.Instances...)
+			inventory.Volumes = append(inventory.Volumes, targetInventory.Volumes...)
+			inventory.Buckets = append(inventory.Buckets, targetInventory.Buckets...)
+			inventory.StaticIPs = append(inventory.StaticIPs, targetInventory.StaticIPs...)
+		}(target)
+	}
+
+	wg.Wait()
+
+	sort.SliceStable(inventory.Instances, func(i, j int) bool {
+		a, b := inventory.Instances[i], inventory.Instances[j]
+
+		if a.Account != b.Account {
+			return a.Account < b.Account
+		}
+		if a.Region != b.Region {
+			return a.Region < b.Region
+		}
+		if a.Provider != b.Provider {
+			return a.Provider < b.Provider
+		}
+
+		return a.Name < b.Name
+	})
+
+	sort.SliceStable(inventory.Volumes, func(i, j int) bool {
+		return inventory.Volumes[i].Account+inventory.Volumes[i].Region+inventory.Volumes[i].ID < inventory.Volumes[j].Account+inventory.Volumes[j].Region+inventory.Volumes[j].ID
+	})
+
+	sort.SliceStable(inventory.Buckets, func(i, j int) bool {
+		return inventory.Buckets[i].Account+inventory.Buckets[i].Name < inventory.Buckets[j].Account+inventory.Buckets[j].Name
+	})
+
+	sort.SliceStable(inventory.StaticIPs, func(i, j int) bool {
+		return inventory.StaticIPs[i].Account+inventory.StaticIPs[i].Region+inventory.StaticIPs[i].Name < inventory.StaticIPs[j].Account+inventory.StaticIPs[j].Region+inventory.StaticIPs[j].Name
+	})
+
+	sort.Slice(inventory.Errors, func(i, j int) bool {
+		return inventory.Errors[i].Profile+inventory.Errors[i].Region < inventory.Errors[j].Profile+inventory.Errors[j].Region
+	})
+
+	if len(inventory.Errors) == len(targets) && firstErr != nil {
+		return inventory, firstErr
+	}
+
+	return inventory, nil
+}
+
+// collectTarget collects the inventory of a single profile and region,
+// labelling everything with the account it belongs to
+func collectTarget(ctx context.Context, target InventoryTarget, resources bool) (Inventory, error) {
+	client, err := newAWSClient(ctx, target.Profile, target.Region)
+	if err != nil {
+		return Inventory{}, err
+	}
+
+	account, err := getAWSAccountID(ctx, client)
+	if err != nil {
+		return Inventory{}, err
+	}
+
+	inventory, err := collectInventory(ctx, client)
+	if err != nil {
+		return Inventory{}, err
+	}
+
+	if resources {
+		if inventory.Volumes, err = getVolumes(ctx, client); err != nil {
+			return Inventory{}, err
+		}
+
+		if inventory.StaticIPs, err = getStaticIPs(ctx, client); err != nil {
+			return Inventory{}, err
+		}
+
+		if target.Global {
+			if inventory.Buckets, err = getBuckets(ctx, client); err != nil {
+				return Inventory{}, err
+			}
+		}
+	}
+
+	for i := range inventory.Instances {
+		inventory.Instances[i].Account = account
+		inventory.Instances[i].Profile = target.Profile
+	}
+
+	for i := range inventory.Volumes {
+		inventory.Volumes[i].Account = account
+		inventory.Volumes[i].Profile = target.Profile
+	}
+
+	for i := range inventory.Buckets {
+		inventory.Buckets[i].Account = account
+		inventory.Buckets[i].Profile = target.Profile
+	}
+
+	for i := range inventory.StaticIPs {
+		inventory.StaticIPs[i].Account = account
+		inventory.StaticIPs[i].Profile = target.Profile
+	}
+
+	return inventory, nil
+}
+
+// collectInventory gathers the Lightsail and EC2 instances for a client into
+// one Inventory
+func collectInventory(ctx context.Context, client *AWSClient) (Inventory, error) {
+	inventory := Inventory{Instances: []Instance{}}
+
+	lightsailInstances, err := getLightsailInstances(ctx, client)
+	if err != nil {
+		return inventory, err
+	}
+
+	for _, instance := range lightsailInstances {
+		normalized := instanceFromLightsail(instance)
+
+		if normalized.Region == "" {
+			normalized.Region = client.Region
+		}
+
+		inventory.Instances = append(inventory.Instances, normalized)
+	}
+
+	ec2Instances, err := getEC2Instances(ctx, client)
+	if err != nil {
+		return inventory, err
+	}
+
+	instanceTypes, err := getEC2InstanceTypes(ctx, client, ec2Instances)
+	if err != nil {
+		return inventory, err
+	}
+
+	volumeSizes, err := getEC2VolumeSizes(ctx, client, ec2Instances)
+	if err != nil {
+		return inventory, err
+	}
+
+	for _, instance := range ec2Instances {
+		normalized := instanceFromEC2(instance, client.Region)
+
+		if instanceType, ok := instanceTypes[normalized.Type]; ok && instanceType.MemoryInfo != nil {
+			normalized.RAMGB = float64(aws.ToInt64(instanceType.MemoryInfo.SizeInMiB)) / 1024
+		}
+
+		for _, mapping := range instance.BlockDeviceMappings {
+			if mapping.Ebs != nil {
+				normalized.DiskGB += volumeSizes[aws.ToString(mapping.Ebs.VolumeId)]
+			}
+		}
+
+		inventory.Instances = append(inventory.Instances, normalized)
+	}
+
+	return inventory, nil
+}
+
+func instanceFromLightsail(instance lightsailtypes.Instance) Instance {
+	normalized := Instance{
+		Provider:   ProviderLightsail,
+		Name:       aws.ToString(instance.Name),
+		ID:         aws.ToString(instance.Name),
+		Type:       aws.ToString(instance.BundleId),
+		Image:      aws.ToString(instance.BlueprintId),
+		KeyName:    aws.ToString(instance.SshKeyName),
+		PublicIP:   aws.ToString(instance.PublicIpAddress),
+		PrivateIP:  aws.ToString(instance.PrivateIpAddress),
+		LaunchTime: instance.CreatedAt,
+		Tags:       map[string]string{},
+	}
+
+	if instance.State != nil {
+		normalized.State = aws.ToString(instance.State.Name)
+	}
+
+	if instance.Hardware != nil {
+		normalized.CPUs = aws.ToInt32(instance.Hardware.CpuCount)
+		normalized.RAMGB = float64(aws.ToFloat32(instance.Hardware.RamSizeInGb))
+
+		for _, disk := range instance.Hardware.Disks {
+			normalized.DiskGB += aws.ToInt32(disk.SizeInGb)
+		}
+	}
+
+	if instance.Location != nil {
+		normalized.Region = string(instance.Location.RegionName)
+		normalized.Zone = aws.ToString(instance.Location.AvailabilityZone)
+	}
+
+	for _, tag := range instance.Tags {
+		normalized.Tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+
+	return normalized
+}
+
+func instanceFromEC2(instance ec2types.Instance, region string) Instance {
+	normalized := Instance{
+		Provider:   ProviderEC2,
+		ID:         aws.ToString(instance.InstanceId),
+		Type:       string(instance.InstanceType),
+		Image:      aws.ToString(instance.ImageId),
+		KeyName:    aws.ToString(instance.KeyName),
+		PublicIP:   aws.ToString(instance.PublicIpAddress),
+		PrivateIP:  aws.ToString(instance.PrivateIpAddress),
+		Region:     region,
+		LaunchTime: instance.LaunchTime,
+		Tags:       map[string]string{},
+	}
+
+	if instance.State != nil {
+		normalized.State = string(instance.State.Name)
+	}
+
+	if instance.CpuOptions != nil {
+		normalized.CPUs = aws.ToInt32(instance.CpuOptions.CoreCount) * aws.ToInt32(instance.CpuOptions.ThreadsPerCore)
+	}
+
+	if instance.Placement != nil {
+		normalized.Zone = aws.ToString(instance.Placement.AvailabilityZone)
+	}
+
+	for _, tag := range instance.Tags {
+		normalized.Tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+
+	// Untagged instances are listed by their ID
+	normalized.Name = normalized.Tags["Name"]
+	if normalized.Name == "" {
+		normalized.Name = normalized.ID
+	}
+
+	return normalized
+}
+
+// getEC2InstanceTypes looks up the hardware of every instance type in use
+func getEC2InstanceTypes(ctx context.Context, client *AWSClient, instances []ec2types.Instance) (map[string]ec2types.InstanceTypeInfo, error) {
+	instanceTypes := map[string]ec2types.InstanceTypeInfo{}
+
+	var names []ec2types.InstanceType
+	for _, instance := range instances {
+		if _, ok := instanceTypes[string(instance.InstanceType)]; !ok {
+			instanceTypes[string(instance.InstanceType)] = ec2types.InstanceTypeInfo{}
+			names = append(names, instance.InstanceType)
+		}
+	}
+
+	if len(names) == 0 {
+		return instanceTypes, nil
+	}
+
+	paginator := ec2.NewDescribeInstanceTypesPaginator(client.EC2, &ec2.DescribeInstanceTypesInput{InstanceTypes: names})
+
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, awsError("ec2 describe-instance-types", err)
+		}
+
+		for _, instanceType := range out.InstanceTypes {
+			instanceTypes[string(instanceType.InstanceType)] = instanceType
+		}
+	}
+
+	return instanceTypes, nil
+}
+
+// getEC2VolumeSizes returns the size in GB of every EBS volume attached to instances
+func getEC2VolumeSizes(ctx context.Context, client *AWSClient, instances []ec2types.Instance) (map[string]int32, error) {
+	sizes := map[string]int32{}
+
+	var volumeIDs []string
+	for _, instance := range instances {
+		for _, mapping := range instance.BlockDeviceMappings {
+			if mapping.Ebs != nil && mapping.Ebs.VolumeId != nil {
+				volumeIDs = append(volumeIDs, aws.ToString(mapping.Ebs.VolumeId))
+			}
+		}
+	}
+
+	if len(volumeIDs) == 0 {
+		return sizes, nil
+	}
+
+	paginator := ec2.NewDescribeVolumesPaginator(client.EC2, &ec2.DescribeVolumesInput{
+		Filters: []ec2types.Filter{{Name: aws.String("volume-id"), Values: volumeIDs}},
+	})
+
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, awsError("ec2 describe-volumes", err)
+		}
+
+		for _, volume := range out.Volumes {
+			sizes[aws.ToString(volume.VolumeId)] = aws.ToInt32(volume.Size)
+		}
+	}
+
+	return sizes, nil
+}
+
+// getVolumes returns every EBS volume in the client's region
+func getVolumes(ctx context.Context, client *AWSClient) ([]Volume, error) {
+	var volumes []Volume
+
+	paginator := ec2.NewDescribeVolumesPaginator(client.EC2, &ec2.DescribeVolumesInput{})
+
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, awsError("ec2 describe-volumes", err)
+		}
+
+		for _, volume := range out.Volumes {
+			normalized := Volume{
+				ID:         aws.ToString(volume.VolumeId),
+				State:      string(volume.State),
+				Type:       string(volume.VolumeType),
+				SizeGB:     aws.ToInt32(volume.Size),
+				IOPS:       aws.ToInt32(volume.Iops),
+				Encrypted:  aws.ToBool(volume.Encrypted),
+				Zone:       aws.ToString(volume.AvailabilityZone),
+				Region:     client.Region,
+				Tags:       map[string]string{},
+				CreateTime: volume.CreateTime,
+			}
+
+			for _, tag := range volume.Tags {
+				normalized.Tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+			}
+
+			normalized.Name = normalized.Tags["Name"]
+
+			for _, attachment := range volume.Attachments {
+				normalized.InstanceID = aws.ToString(attachment.InstanceId)
+				normalized.DeleteOnTermination = aws.ToBool(attachment.DeleteOnTermination)
+			}
+
+			volumes = append(volumes, normalized)
+		}
+	}
+
+	return volumes, nil
+}
+
+// getStaticIPs returns every Lightsail static IP in the client's region
+func getStaticIPs(ctx context.Context, client *AWSClient) ([]StaticIP, error) {
+	var staticIPs []StaticIP
+
+	input := &lightsail.GetStaticIpsInput{}
+
+	for {
+		out, err := client.Lightsail.GetStaticIps(ctx, input)
+		if err != nil {
+			return nil, awsError("lightsail get-static-ips", err)
+		}
+
+		for _, staticIP := range out.StaticIps {
+			staticIPs = append(staticIPs, StaticIP{
+				Name:       aws.ToString(staticIP.Name),
+				IP:         aws.ToString(staticIP.IpAddress),
+				Attached:   aws.ToBool(staticIP.IsAttached),
+				AttachedTo: aws.ToString(staticIP.AttachedTo),
+				Region:     client.Region,
+				CreatedAt:  staticIP.CreatedAt,
+			})
+		}
+
+		if aws.ToString(out.NextPageToken) == "" {
+			break
+		}
+
+		input.PageToken = out.NextPageToken
+	}
+
+	return staticIPs, nil
+}
+
+// getBuckets returns every S3 bucket in the client's account
+func getBuckets(ctx context.Context, client *AWSClient) ([]Bucket, error) {
+	var buckets []Bucket
+
+	paginator := s3.NewListBucketsPaginator(client.S3, &s3.ListBucketsInput{})
+
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, awsError("s3 list-buckets", err)
+		}
+
+		for _, bucket := range out.Buckets {
+			buckets = append(buckets, Bucket{
+				Name:         aws.ToString(bucket.Name),
+				Region:       aws.ToString(bucket.BucketRegion),
+				CreationDate: bucket.CreationDate,
+			})
+		}
+	}
+
+	return buckets, nil
+}
+
+// valueOr returns value, or fallback when it's empty, for showing optional
+// fields like the public IP of a stopped instance
+func valueOr(value string, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+
+	return value
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/lightsail"
+	lightsailtypes "github.com/aws/aws-sdk-go-v2/service/lightsail/types"
+	"github.com/aws/smithy-go"
+	"github.com/fatih/color"
+	"github.com/urfave/cli/v2"
+)
+
+// The state a deleted Lightsail instance is reported in, as Lightsail forgets
+// about it rather than keeping it around like a terminated EC2 instance
+const instanceStateDeleted = "deleted"
+
+// How often to check on an instance and how long to wait for it by default
+var instancePollInterval = 10 * time.Second
+var instanceWaitTimeout = 10 * time.Minute
+
+// InstanceActionResult is the result of matrix aws start|stop|reboot|terminate
+type InstanceActionResult struct {
+	Action   string   `json:"action"`
+	Project  string   `json:"project"`
+	Instance Instance `json:"instance"`
+	DryRun   bool     `json:"dryRun,omitempty"`
+}
+
+// instanceAction is one of the lifecycle actions on a project's instance
+type instanceAction struct {
+	Name  string
+	Usage string
+
+	// The state the instance is waited for once the action has been sent, if
+	// it changes state at all
+	TargetState string
+
+	// How sure we need to be before going ahead
+	Confirm     bool
+	ConfirmName bool
+
+	EC2       func(ctx context.Context, client *AWSClient, id string) error
+	Lightsail func(ctx context.Context, client *AWSClient, name string) error
+}
+
+var instanceActions = []instanceAction{
+	{
+		Name:        "start",
+		Usage:       "Start a project's instance",
+		TargetState: "running",
+		EC2: func(ctx context.Context, client *AWSClient, id string) error {
+			_, err := client.EC2.StartInstances(ctx, &ec2.StartInstancesInput{InstanceIds: []string{id}})
+			return awsError("ec2 start-instances", err)
+		},
+		Lightsail: func(ctx context.Context, client *AWSClient, name string) error {
+			_, err := client.Lightsail.StartInstance(ctx, &lightsail.StartInstanceInput{InstanceName: aws.String(name)})
+			return awsError("lightsail start-instance", err)
+		},
+	},
+	{
+		Name:        "stop",
+		Usage:       "Stop a project's instance",
+		TargetState: "stopped",
+		Confirm:     true,
+		EC2: func(ctx context.Context, client *AWSClient, id string) error {
+			_, err := client.EC2.StopInstances(ctx, &ec2.StopInstancesInput{InstanceIds: []string{id}})
+			return awsError("ec2 stop-instances", err)
+		},
+		Lightsail: func(ctx context.Context, client *AWSClient, name string) error {
+			_, err := client.Lightsail.StopInstance(ctx, &lightsail.StopInstanceInput{InstanceName: aws.String(name)})
+			return awsError("lightsail stop-instance", err)
+		},
+	},
+	{
+		Name:    "reboot",
+		Usage:   "Reboot a project's instance, without waiting for it to come back up",
+		Confirm: true,
+		EC2: func(ctx context.Context, client *AWSClient, id string) error {
+			_, err := client.EC2.RebootInstances(ctx, &ec2.RebootInstancesInput{InstanceIds: []string{id}})
+			return awsError("ec2 reboot-instances", err)
+		},
+		Lightsail: func(ctx context.Context, client *AWSClient, name string) error {
+			_, err := client.Lightsail.RebootInstance(ctx, &lightsail.RebootInstanceInput{InstanceName: aws.String(name)})
+			return awsError("lightsail reboot-instance", err)
+		},
+	},
+	{
+		Name:        "terminate",
+		Usage:       "Terminate (delete) a project's instance",
+		TargetState: "terminated",
+		ConfirmName: true,
+		EC2: func(ctx context.Context, client *AWSClient, id string) error {
+			_, err := client.EC2.TerminateInstances(ctx, &ec2.TerminateInstancesInput{InstanceIds: []string{id}})
+			return awsError("ec2 terminate-instances", err)
+		},
+		Lightsail: func(ctx context.Context, client *AWSClient, name string) error {
+			_, err := client.Lightsail.DeleteInstance(ctx, &lightsail.DeleteInstanceInput{InstanceName: aws.String(name)})
+			return awsError("lightsail delete-instance", err)
+		},
+	},
+}
+
+// instanceActionCommands builds the matrix aws subcommands for instanceActions
+func instanceActionCommands() []*cli.Command {
+	var commands []*cli.Command
+
+	for _, action := range instanceActions {
+		action := action
+
+		flags := append(awsTargetFlags(), &cli.BoolFlag{
+			Name:    "yes",
+			Aliases: []string{"y"},
+			Usage:   "Don't ask for confirmation",
+		})
+
+		if action.TargetState != "" {
+			flags = append(flags, &cli.DurationFlag{
+				Name:  "timeout",
+				Usage: "How long to wait for the instance to be " + action.TargetState,
+				Value: instanceWaitTimeout,
+			})
+		}
+
+		commands = append(commands, &cli.Command{
+			Name:      action.Name,
+			Usage:     action.Usage,
+			ArgsUsage: "<project>",
+			Flags:     flags,
+			Action: func(cCtx *cli.Context) error {
+				return runInstanceAction(cCtx, action)
+			},
+		})
+	}
+
+	return commands
+}
+
+// awsTargetFlags pick the profiles and regions to look in
+func awsTargetFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:  "region",
+			Usage: "AWS region to look in, can be repeated (default: aws_regions in ~/.matrix/config)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "profile",
+			Usage: "AWS profile (account) to look in, can be repeated (default: aws_profiles in ~/.matrix/config)",
+		},
+	}
+}
+
+func runInstanceAction(cCtx *cli.Context, action instanceAction) error {
+	ProjectName = cCtx.Args().First()
+
+	if ProjectName == "" {
+		return newError(ErrMissingProjectName, "", nil)
+	}
+
+	ctx := context.Background()
+
+	instance, err := findProjectInstance(ctx, cCtx, ProjectName)
+	if err != nil {
+		return err
+	}
+
+	color.Magenta("Project " + ProjectName + " is on " + instance.Provider + " instance:")
+	printInstance(instance)
+
+	// Nothing changes in a dry run so there is nothing to confirm
+	if !dryRun && !cCtx.Bool("yes") {
+		if action.ConfirmName {
+			err = confirmName("This will "+action.Name+" "+instance.ID+" and can't be undone.", ProjectName)
+		} else if action.Confirm {
+			err = confirm("Are you sure you want to " + action.Name + " " + instance.ID + "?")
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	client, err := newAWSClient(ctx, instance.Profile, instance.Region)
+	if err != nil {
+		return err
+	}
+
+	targetState := action.TargetState
+
+	if instance.Provider == ProviderLightsail {
+		command := action.Name + "-instance"
+
+		if targetState == "terminated" {
+			command = "delete-instance"
+			targetState = instanceStateDeleted
+		}
+
+		err = awsChange([]string{"lightsail", command, "--instance-name", instance.ID, "--profile", instance.Profile, "--region", instance.Region}, func() error {
+			return action.Lightsail(ctx, client, instance.ID)
+		})
+	} else {
+		err = awsChange([]string{"ec2", action.Name + "-instances", "--instance-ids", instance.ID, "--profile", instance.Profile, "--region", instance.Region}, func() error {
+			return action.EC2(ctx, client, instance.ID)
+		})
+	}
+
+	if err != nil {
+		return err
+	}
+
+	result := InstanceActionResult{Action: action.Name, Project: ProjectName, Instance: instance, DryRun: dryRun}
+
+	if dryRun {
+		return printResult(result)
+	}
+
+	// A reboot keeps an EC2 instance running, and is too quick for its state
+	// or status checks to be relied on to show it happening
+	if targetState == "" {
+		color.Green("✓ Completed: " + instance.Name + " is rebooting")
+
+		return printResult(result)
+	}
+
+	result.Instance, err = waitForInstanceState(ctx, client, instance, targetState, cCtx.Duration("timeout"))
+	if err != nil {
+		return err
+	}
+
+	color.Green("✓ Completed: " + instance.Name + " is " + targetState)
+
+	return printResult(result)
+}
+
+// waitForInstanceState polls an instance with the spinner going until it
+// reaches state, returning it as it was last seen
+func waitForInstanceState(ctx context.Context, client *AWSClient, instance Instance, state string, timeout time.Duration) (Instance, error) {
+	deadline := time.Now().Add(timeout)
+
+	s.Suffix = " Instance Status: " + instance.State
+	s.Start()
+	defer s.Stop()
+
+	for {
+		current, err := getInstanceState(ctx, client, instance)
+		if err != nil {
+			return instance, err
+		}
+
+		instance = current
+
+		s.Suffix = " Instance Status: " + instance.State
+
+		if instance.State == state {
+			return instance, nil
+		}
+
+		if time.Now().After(deadline) {
+			return instance, newError(ErrTimeout, instance.Name+" is "+instance.State+" after "+timeout.String()+", waiting to be "+state, nil)
+		}
+
+		time.Sleep(instancePollInterval)
+	}
+}
+
+// getInstanceState looks an instance up again, keeping the account details it
+// was found with
+func getInstanceState(ctx context.Context, client *AWSClient, instance Instance) (Instance, error) {
+	var current Instance
+
+	if instance.Provider == ProviderLightsail {
+		out, err := client.Lightsail.GetInstance(ctx, &lightsail.GetInstanceInput{InstanceName: aws.String(instance.ID)})
+
+		var notFound *lightsailtypes.NotFoundException
+		if errors.As(err, &notFound) {
+			instance.State = instanceStateDeleted
+			return instance, nil
+		}
+
+		if err != nil {
+			return instance, awsError("lightsail get-instance", err)
+		}
+
+		current = instanceFromLightsail(*out.Instance)
+	} else {
+		instances, err := describeEC2Instances(ctx, client, &ec2.DescribeInstancesInput{InstanceIds: []string{instance.ID}})
+
+		// Instances can take a moment to show up after being launched, and
+		// until they do looking them up by ID fails rather than finding none
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidInstanceID.NotFound" || err == nil && len(instances) == 0 {
+			return instance, nil
+		}
+
+		if err != nil {
+			return instance, err
+		}
+
+		current = instanceFromEC2(instances[0], client.Region)
+	}
+
+	current.Region = valueOr(current.Region, instance.Region)
+	current.Account = instance.Account
+	current.Profile = instance.Profile
+
+	// Keep the hardware details only the full inventory looks up
+	if current.RAMGB == 0 {
+		current.RAMGB = instance.RAMGB
+	}
+
+	if current.DiskGB == 0 {
+		current.DiskGB = instance.DiskGB
+	}
+
+	return current, nil
+}
@@ -1,11 +1,11 @@
 package main
 
 import (
-	"log"
 	"os"
 	"time"
 
 	"github.com/briandowns/spinner"
+	"github.com/fatih/color"
 	"github.com/urfave/cli/v2"
 )
 
@@ -14,7 +14,6 @@ var GithubRepoUser string = "matrixcreate"
 var ProjectName string = ""
 var ProjectType string = ""
 
-var commandCount int = 0
 var s *spinner.Spinner = spinner.New(spinner.CharSets[25], 100*time.Millisecond)
 
 func main() {
@@ -33,15 +32,41 @@ func main() {
 		Version:   "v2.0.0",
 		Copyright: "(c) 2023 Matrix Create",
 		Usage:     "Project Management CLI Tool",
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "Print the git/ddev/aws/gh commands that would be run without running them",
+			},
+			&cli.StringFlag{
+				Name:    "output",
+				Aliases: []string{"o"},
+				Value:   OutputText,
+				Usage:   "Output format: text or json",
+			},
+			&cli.StringFlag{
+				Name:  "record",
+				Usage: "Append every command that is run to `FILE` as JSON lines",
+			},
+		},
+		Before: func(cCtx *cli.Context) error {
+			if err := setupOutput(cCtx.String("output")); err != nil {
+				return err
+			}
+
+			return setupExecutor(cCtx.Bool("dry-run"), cCtx.String("record"))
+		},
+		After: func(cCtx *cli.Context) error {
+			closeExecutor()
+
+			return nil
+		},
 		Commands: []*cli.Command{
 			{
 				Name:    "status",
 				Aliases: []string{"s"},
 				Usage:   "Show status of Matrix CLI",
 				Action: func(cCtx *cli.Context) error {
-					status()
-
-					return nil
+					return status()
 				},
 			},
 			{
@@ -49,11 +74,19 @@ func main() {
 				Aliases: []string{"c", "config"},
 				Usage:   "Configure Matrix CLI with AWS IAM Identity Center and Github CLI",
 				Action: func(cCtx *cli.Context) error {
-					configureMatrix()
-					configureAWS()
-					configureGithub()
+					if err := configureMatrix(); err != nil {
+						return err
+					}
 
-					return nil
+					if err := configureAWS(); err != nil {
+						return err
+					}
+
+					if err := configureGithub(); err != nil {
+						return err
+					}
+
+					return printResult(ActionResult{Action: "configure", DryRun: dryRun})
 				},
 			},
 			{
@@ -61,9 +94,7 @@ func main() {
 				Aliases: []string{"c"},
 				Usage:   "Create a new Craft CMS project",
 				Action: func(cCtx *cli.Context) error {
-					create(cCtx)
-
-					return nil
+					return create(cCtx)
 				},
 			},
 			{
@@ -78,9 +109,7 @@ func main() {
 					},
 				},
 				Action: func(cCtx *cli.Context) error {
-					edit(cCtx)
-
-					return nil
+					return edit(cCtx)
 				},
 			},
 			{
@@ -88,29 +117,253 @@ func main() {
 				Aliases: []string{"rm"},
 				Usage:   "Stop and delete project",
 				Action: func(cCtx *cli.Context) error {
-					delete(cCtx)
-
-					return nil
+					return delete(cCtx)
+				},
+			},
+			{
+				Name:      "teardown",
+				Usage:     "Back up a project and delete everything it has in AWS",
+				ArgsUsage: "<project>",
+				Flags: append([]cli.Flag{
+					&cli.BoolFlag{
+						Name:    "yes",
+						Aliases: []string{"y"},
+						Usage:   "Don't ask for confirmation",
+					},
+					&cli.BoolFlag{
+						Name:  "skip-backup",
+						Usage: "Don't take a final backup first",
+					},
+					&cli.StringFlag{
+						Name:  "repo",
+						Usage: "GitHub owner/repo to remove the deploy key from (default: the current directory's)",
+					},
+					&cli.StringFlag{
+						Name:  "dns-profile",
+						Usage: "AWS profile the project's DNS zones are in (default: dns_profile in .matrix/config or ~/.matrix/config, or the instance's profile)",
+					},
+					&cli.StringFlag{
+						Name:    "user",
+						Aliases: []string{"u"},
+						Usage:   "User to log in as for the final backup (default: ssh_user in ~/.matrix/config, or picked from the instance's image)",
+					},
+					&cli.StringFlag{
+						Name:    "identity",
+						Aliases: []string{"i"},
+						Usage:   "Private key to log in with for the final backup (default: ssh_key in ~/.matrix/config, or the instance's key pair in ~/.ssh)",
+					},
+					&cli.DurationFlag{
+						Name:  "timeout",
+						Usage: "How long to wait for each instance to be deleted",
+						Value: instanceWaitTimeout,
+					},
+				}, awsTargetFlags()...),
+				Action: func(cCtx *cli.Context) error {
+					return teardown(cCtx)
 				},
 			},
 			{
 				Name:    "deploy",
 				Aliases: []string{"d"},
-				Usage:   "Deploy project to AWS Lightsail",
+				Usage:   "Deploy project to AWS EC2 or Lightsail",
+				Subcommands: []*cli.Command{
+					{
+						Name:      "history",
+						Usage:     "Show a project's deploys",
+						ArgsUsage: "[project]",
+						Flags: []cli.Flag{
+							&cli.IntFlag{
+								Name:  "limit",
+								Usage: "Number of deploys to show",
+								Value: 20,
+							},
+							&cli.StringFlag{
+								Name:  "profile",
+								Usage: "AWS profile to read S3 deploy history with (default: deploy_profile in .matrix/config or ~/.matrix/config, or matrix)",
+							},
+						},
+						Action: func(cCtx *cli.Context) error {
+							return deployHistory(cCtx)
+						},
+					},
+				},
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:  "ref",
+						Usage: "Git branch, tag or commit to deploy (default: deploy_ref in .matrix/config or ~/.matrix/config, or origin's default branch)",
+					},
+					&cli.BoolFlag{
+						Name:  "new-instance",
+						Usage: "Launch a new instance even if the project is already deployed",
+					},
+					&cli.BoolFlag{
+						Name:  "print-user-data",
+						Usage: "Print the bootstrap script a new instance would run, without deploying",
+					},
+					&cli.StringFlag{
+						Name:  "via",
+						Usage: "Update an existing instance over ssh or with SSM Run Command (ssm)",
+						Value: UpdateViaSSH,
+					},
+					&cli.StringFlag{
+						Name:  "target",
+						Usage: "Deploy to ec2 or lightsail (default: deploy_target in .matrix/config or ~/.matrix/config, or ec2)",
+					},
+					&cli.StringFlag{
+						Name:  "launch-template",
+						Usage: "EC2 launch template to launch from (default: deploy_launch_template in .matrix/config or ~/.matrix/config, or matrix-2023-10-01)",
+					},
+					&cli.StringFlag{
+						Name:  "instance-type",
+						Usage: "EC2 instance type (default: deploy_instance_type in .matrix/config or ~/.matrix/config, or t2.micro)",
+					},
+					&cli.StringFlag{
+						Name:  "region",
+						Usage: "AWS region to deploy to (default: deploy_region in .matrix/config or ~/.matrix/config, or the profile's region)",
+					},
+					&cli.StringFlag{
+						Name:  "profile",
+						Usage: "AWS profile to deploy with (default: deploy_profile in .matrix/config or ~/.matrix/config, or matrix)",
+					},
+					&cli.StringFlag{
+						Name:  "blueprint",
+						Usage: "Lightsail blueprint to create the instance from (default: deploy_blueprint in .matrix/config or ~/.matrix/config, or lamp_8_bitnami)",
+					},
+					&cli.StringFlag{
+						Name:  "bundle",
+						Usage: "Lightsail bundle (size) of the instance (default: deploy_bundle in .matrix/config or ~/.matrix/config, or small_3_0)",
+					},
+					&cli.StringFlag{
+						Name:  "zone",
+						Usage: "Lightsail availability zone (default: deploy_zone in .matrix/config or ~/.matrix/config, or the region's first zone)",
+					},
+					&cli.StringFlag{
+						Name:  "domain",
+						Usage: "Point this domain at the instance and get a Let's Encrypt certificate for it (default: deploy_domain in .matrix/config or ~/.matrix/config)",
+					},
+					&cli.StringFlag{
+						Name:  "dns-profile",
+						Usage: "AWS profile the domain's DNS zone is in (default: dns_profile in .matrix/config or ~/.matrix/config, or the deploy profile)",
+					},
+					&cli.BoolFlag{
+						Name:    "yes",
+						Aliases: []string{"y"},
+						Usage:   "Don't ask before pointing a domain that points somewhere else at the instance",
+					},
+				}, deployHealthFlags()...),
 				Action: func(cCtx *cli.Context) error {
-					deploy(cCtx)
-
-					return nil
+					return deploy(cCtx)
 				},
 			},
+			{
+				Name:      "rollback",
+				Usage:     "Roll a project back to a previous deploy",
+				ArgsUsage: "[project]",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:  "to",
+						Usage: "ID of the deploy to roll back to, from 'matrix deploy history' (default: the one before the live deploy)",
+					},
+					&cli.BoolFlag{
+						Name:  "restore-db",
+						Usage: "Also restore the database backup taken before the project moved on from that deploy",
+					},
+					&cli.BoolFlag{
+						Name:    "yes",
+						Aliases: []string{"y"},
+						Usage:   "Don't ask for confirmation",
+					},
+					&cli.StringFlag{
+						Name:  "via",
+						Usage: "Roll back over ssh or with SSM Run Command (ssm)",
+						Value: UpdateViaSSH,
+					},
+					&cli.StringFlag{
+						Name:  "profile",
+						Usage: "AWS profile to read S3 deploy history with (default: deploy_profile in .matrix/config or ~/.matrix/config, or matrix)",
+					},
+				}, deployHealthFlags()...),
+				Action: func(cCtx *cli.Context) error {
+					return rollback(cCtx)
+				},
+			},
+			{
+				Name:        "domain",
+				Usage:       "Manage the domains pointing at a deployed project",
+				Subcommands: domainCommands(),
+			},
+			{
+				Name:        "env",
+				Usage:       "Manage a deployed project's environment variables in SSM Parameter Store",
+				Subcommands: envCommands(),
+			},
 			{
 				Name:    "backup",
 				Aliases: []string{"b"},
 				Usage:   "Backup project to S3",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "age-recipient",
+						Usage: "Encrypt the backup to these age public keys, separated by commas (default: backup_age_recipients in .matrix/config or ~/.matrix/config)",
+					},
+					&cli.StringFlag{
+						Name:  "kms-key",
+						Usage: "Encrypt the backup with a data key from this KMS key ID, ARN or alias (default: backup_kms_key in .matrix/config or ~/.matrix/config)",
+					},
+					&cli.StringFlag{
+						Name:  "keyfile",
+						Usage: "Encrypt the backup with the 32 byte key in this file (default: backup_keyfile in .matrix/config or ~/.matrix/config)",
+					},
+				},
 				Action: func(cCtx *cli.Context) error {
-					backup(cCtx)
-
-					return nil
+					return backup(cCtx)
+				},
+				Subcommands: backupCommands(),
+			},
+			{
+				Name:      "restore",
+				Usage:     "Restore a project from a backup in S3, locally or on its server",
+				ArgsUsage: "<project>",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:  "backup",
+						Usage: "Timestamp of the backup to restore, like 2024-01-31-17-45-00 (default: the latest)",
+					},
+					&cli.BoolFlag{
+						Name:  "latest",
+						Usage: "Restore the latest backup",
+					},
+					&cli.StringFlag{
+						Name:  "target",
+						Usage: "Restore into the local DDEV project (local) or the project's server (remote)",
+						Value: RestoreLocal,
+					},
+					&cli.BoolFlag{
+						Name:    "yes",
+						Aliases: []string{"y"},
+						Usage:   "Don't ask for confirmation",
+					},
+					&cli.StringFlag{
+						Name:    "user",
+						Aliases: []string{"u"},
+						Usage:   "User to log in to the server as (default: ssh_user in ~/.matrix/config, or picked from the instance's image)",
+					},
+					&cli.StringFlag{
+						Name:    "identity",
+						Aliases: []string{"i"},
+						Usage:   "Private key to log in to the server with (default: ssh_key in ~/.matrix/config, or the instance's key pair in ~/.ssh)",
+					},
+					&cli.StringFlag{
+						Name:  "age-identity",
+						Usage: "age identity file to decrypt a backup encrypted with age (default: backup_age_identity in .matrix/config or ~/.matrix/config)",
+					},
+					&cli.StringFlag{
+						Name:  "keyfile",
+						Usage: "File with the key to decrypt a backup encrypted with a keyfile (default: backup_keyfile in .matrix/config or ~/.matrix/config)",
+					},
+				}, awsTargetFlags()...),
+				Action: func(cCtx *cli.Context) error {
+					return restore(cCtx)
 				},
 			},
 			{
@@ -118,15 +371,13 @@ func main() {
 				Aliases: []string{"self-update"},
 				Usage:   "Self Update Matrix CLI",
 				Action: func(cCtx *cli.Context) error {
-					update()
-
-					return nil
+					return update()
 				},
 			},
 			{
 				Name:  "aws",
 				Usage: "AWS Helper Commands",
-				Flags: []cli.Flag{
+				Flags: append([]cli.Flag{
 					&cli.BoolFlag{
 						Name:    "list",
 						Aliases: []string{"l", "ls"},
@@ -137,17 +388,81 @@ func main() {
 						Aliases: []string{"s"},
 						Usage:   "Create a spreadsheet of AWS instances",
 					},
-				},
+					&cli.StringFlag{
+						Name:  "out",
+						Usage: "File to save the spreadsheet or export to (default: aws-instances.xlsx for spreadsheets, stdout for exports)",
+					},
+					&cli.StringFlag{
+						Name:  "export",
+						Usage: "Export AWS instances as csv, md, html or json",
+					},
+					&cli.StringFlag{
+						Name:  "columns",
+						Usage: "Comma separated columns to export (default: " + defaultExportColumns + ")",
+					},
+					&cli.StringFlag{
+						Name:  "sort",
+						Usage: "Comma separated columns to sort the export by, prefix with - for descending",
+					},
+				}, awsTargetFlags()...),
+				Subcommands: instanceActionCommands(),
 				Action: func(cCtx *cli.Context) error {
+					result := AWSResult{}
+
 					if cCtx.Bool("list") {
-						listInstances()
+						inventory, err := listInstances(cCtx)
+						if err != nil {
+							return err
+						}
+
+						result.Instances = inventory.Instances
+						result.Errors = inventory.Errors
 					}
 
 					if cCtx.Bool("spreadsheet") {
-						createSpreadsheetOfInstances(cCtx)
+						fileName, err := createSpreadsheetOfInstances(cCtx)
+						if err != nil {
+							return err
+						}
+
+						result.Spreadsheet = fileName
 					}
 
-					return nil
+					if cCtx.String("export") != "" {
+						fileName, err := exportInventory(cCtx)
+						if err != nil {
+							return err
+						}
+
+						// An export to stdout is the output
+						if fileName == "" {
+							return nil
+						}
+
+						result.Export = fileName
+					}
+
+					return printResult(result)
+				},
+			},
+			{
+				Name:      "ssh",
+				Usage:     "SSH into a project's server, or run a command on it",
+				ArgsUsage: "<project> [-- <command>]",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:    "user",
+						Aliases: []string{"u"},
+						Usage:   "User to log in as (default: ssh_user in ~/.matrix/config, or picked from the instance's image)",
+					},
+					&cli.StringFlag{
+						Name:    "identity",
+						Aliases: []string{"i"},
+						Usage:   "Private key to log in with (default: ssh_key in ~/.matrix/config, or the instance's key pair in ~/.ssh)",
+					},
+				}, awsTargetFlags()...),
+				Action: func(cCtx *cli.Context) error {
+					return sshToProject(cCtx)
 				},
 			},
 			{
@@ -176,6 +491,16 @@ func main() {
 	}
 
 	if err := app.Run(os.Args); err != nil {
-		log.Fatal(err)
+		s.Stop()
+
+		printErrorResult(err)
+
+		color.Red("× Error: " + err.Error())
+
+		if hint := errorHint(err); hint != "" {
+			color.White(hint)
+		}
+
+		os.Exit(exitCode(err))
 	}
 }
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/fatih/color"
+	"github.com/mattn/go-isatty"
+)
+
+// Output formats for the global --output flag
+const (
+	OutputText = "text"
+	OutputJSON = "json"
+)
+
+var outputFormat string = OutputText
+var resultPrinted bool = false
+
+// setupOutput switches matrix into the given output format. In JSON mode all
+// of the coloured progress messages are moved to stderr and the spinner is
+// turned off, so stdout only ever carries the single JSON result.
+func setupOutput(format string) error {
+	switch format {
+	case "", OutputText:
+		outputFormat = OutputText
+	case OutputJSON:
+		outputFormat = OutputJSON
+
+		color.Output = color.Error
+		color.NoColor = color.NoColor || !isatty.IsTerminal(os.Stderr.Fd())
+
+		s.Disable()
+	default:
+		return newError(ErrConfig, "unknown output format '"+format+"', use text or json", nil)
+	}
+
+	return nil
+}
+
+func jsonOutput() bool {
+	return outputFormat == OutputJSON
+}
+
+// printResult writes the result of a command to stdout when in JSON mode. In
+// text mode the command has already printed everything as it went.
+func printResult(result interface{}) error {
+	if !jsonOutput() {
+		return nil
+	}
+
+	resultPrinted = true
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(result)
+}
+
+// ErrorResult is printed in place of a command result when it fails in JSON mode
+type ErrorResult struct {
+	Error struct {
+		Message  string `json:"message"`
+		ExitCode int    `json:"exitCode"`
+		Hint     string `json:"hint,omitempty"`
+	} `json:"error"`
+}
+
+func printErrorResult(err error) {
+	if resultPrinted {
+		return
+	}
+
+	result := ErrorResult{}
+	result.Error.Message = err.Error()
+	result.Error.ExitCode = exitCode(err)
+	result.Error.Hint = errorHint(err)
+
+	printResult(result)
+}
+
+// printCommandOutput shows the stdout of a command alongside the other
+// progress messages
+func printCommandOutput(out []byte) {
+	fmt.Fprintln(color.Output, string(out))
+}
@@ -0,0 +1,627 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/fatih/color"
+	"github.com/urfave/cli/v2"
+)
+
+// Where a backup can be restored to
+const (
+	RestoreLocal  = "local"
+	RestoreRemote = "remote"
+)
+
+// Files a restore never overwrites, as they belong to where the project is
+// restored to rather than where it was backed up from
+var restorePreserved = []string{".env"}
+
+// RestoreResult is the result of matrix restore
+type RestoreResult struct {
+	Project    string         `json:"project"`
+	Backup     string         `json:"backup"`
+	Target     string         `json:"target"`
+	InstanceID string         `json:"instanceId,omitempty"`
+	Archives   []BackupUpload `json:"archives"`
+	DryRun     bool           `json:"dryRun,omitempty"`
+}
+
+func restore(cCtx *cli.Context) error {
+	ProjectName = cCtx.Args().First()
+	if ProjectName == "" {
+		return newError(ErrMissingProjectName, "", nil)
+	}
+
+	target := cCtx.String("target")
+	if target != RestoreLocal && target != RestoreRemote {
+		return newError(ErrConfig, "unknown restore target '"+target+"', use local or remote", nil)
+	}
+
+	if cCtx.String("backup") != "" && cCtx.Bool("latest") {
+		return newError(ErrConfig, "use either --backup or --latest", nil)
+	}
+
+	ctx := context.Background()
+
+	client, err := newAWSClient(ctx, AWSProfile, "")
+	if err != nil {
+		return err
+	}
+
+	sets, err := listBackupSets(ctx, client)
+	if err != nil {
+		return err
+	}
+
+	set, err := pickBackupSet(sets, cCtx.String("backup"))
+	if err != nil {
+		return err
+	}
+
+	result := RestoreResult{Project: ProjectName, Backup: set.Timestamp, Target: target, Archives: set.Archives, DryRun: dryRun}
+
+	color.Magenta("Restoring " + ProjectName + " from the backup taken " + set.Time.Format("2006-01-02 15:04:05"))
+	for _, archive := range set.Archives {
+		color.White("  - " + archive.URL + " (" + strconv.FormatInt(archive.Size, 10) + " bytes)")
+	}
+
+	var instance Instance
+
+	if target == RestoreRemote {
+		if instance, err = findProjectInstance(ctx, cCtx, ProjectName); err != nil {
+			return err
+		}
+
+		result.InstanceID = instance.ID
+
+		color.White("To: " + instance.Name + " (" + instance.ID + ")")
+	} else {
+		// Restoring locally goes through DDEV, like matrix backup it is run in
+		// the project
+		if !fileExists(".ddev") {
+			return newError(ErrConfig, "no .ddev directory here, run 'matrix restore' in the project", nil)
+		}
+
+		cmd := exec.Command("ddev", "--version")
+		if _, err := executor.Lookup(cmd); err != nil {
+			return commandError(ErrToolNotInstalled, cmd, err)
+		}
+
+		color.White("To: this directory, and its DDEV database")
+	}
+
+	// Nothing changes in a dry run so there is nothing to confirm
+	if !dryRun && !cCtx.Bool("yes") {
+		if target == RestoreRemote {
+			err = confirmName("This will replace the database and files of "+ProjectName+" on "+instance.Name+".", ProjectName)
+		} else {
+			err = confirm("Replace the local database and files with this backup?")
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	dir, err := os.MkdirTemp("", "matrix-restore-")
+	if err != nil {
+		return newError(ErrArchive, "", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Everything is downloaded and checked before anything is replaced
+	files := map[string]string{}
+	sqlFile := ""
+
+	settings, err := loadSettings(cCtx)
+	if err != nil {
+		return err
+	}
+
+	keys := backupKeys{settings: settings, client: client}
+
+	for i := range set.Archives {
+		archive := &set.Archives[i]
+		path := filepath.Join(dir, filepath.Base(archive.Key))
+
+		if err := downloadBackupArchive(ctx, client, keys, archive, path); err != nil {
+			return err
+		}
+
+		if archive.Encryption != "" {
+			color.Green("✓ Decrypted " + filepath.Base(archive.Key) + ", encrypted with " + archive.Encryption + " (" + archive.KeyID + ")")
+		}
+
+		files[archive.Key] = path
+
+		if dryRun {
+			continue
+		}
+
+		// A dump on its own only needs its checksum checking
+		if strings.HasSuffix(archive.Key, ".sql.gz") {
+			if err := verifyBackupDump(path); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		names, err := verifyBackupArchive(path)
+		if err != nil {
+			return err
+		}
+
+		if sql := set.database(); sql != nil && sql.Key == archive.Key {
+			for _, name := range names {
+				if strings.HasSuffix(name, ".sql") {
+					sqlFile = name
+				}
+			}
+
+			if sqlFile == "" {
+				return newError(ErrBackupDamaged, archive.URL+" has no .sql file in it", nil)
+			}
+		}
+	}
+
+	if !dryRun {
+		color.Green("✓ Completed: Downloaded and checked the backup")
+	}
+
+	if target == RestoreRemote {
+		err = restoreRemote(ctx, cCtx, instance, set, files, sqlFile)
+	} else {
+		err = restoreLocal(set, files, sqlFile, dir)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if !dryRun {
+		color.Green("✓ Completed: Restored " + ProjectName + " from " + set.Timestamp)
+	}
+
+	return printResult(result)
+}
+
+// pickBackupSet finds the backup with the given timestamp, or the latest one
+func pickBackupSet(sets []BackupSet, timestamp string) (BackupSet, error) {
+	if len(sets) == 0 {
+		return BackupSet{}, newError(ErrBackupNotFound, "no backups of "+ProjectName+" in s3://"+ProjectName+"/backups/", nil)
+	}
+
+	if timestamp == "" {
+		return sets[len(sets)-1], nil
+	}
+
+	for _, set := range sets {
+		if set.Timestamp == timestamp {
+			return set, nil
+		}
+	}
+
+	return BackupSet{}, newError(ErrBackupNotFound, "no backup of "+ProjectName+" taken at "+timestamp+", see 'matrix backup list "+ProjectName+"'", nil)
+}
+
+// downloadBackupArchive downloads an archive to path, decrypting it if it
+// was encrypted, and checks it is as big as S3 says it is. The key it was
+// encrypted with is recorded on archive.
+func downloadBackupArchive(ctx context.Context, client *AWSClient, keys backupKeys, archive *BackupUpload, path string) error {
+	return awsChange([]string{"s3", "cp", archive.URL, path}, func() error {
+		s.Suffix = " Downloading " + archive.URL
+		s.Start()
+		defer s.Stop()
+
+		out, err := client.S3.GetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(ProjectName),
+			Key:    aws.String(archive.Key),
+		})
+		if err != nil {
+			return awsError("s3 get-object "+archive.URL, err)
+		}
+		defer out.Body.Close()
+
+		archive.Encryption, archive.KeyID = out.Metadata["encryption"], out.Metadata["key-id"]
+
+		body := &countingReader{reader: out.Body}
+
+		decrypted, err := keys.decrypt(ctx, body)
+		if err != nil {
+			return err
+		}
+
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+		if err != nil {
+			return newError(ErrArchive, path, err)
+		}
+		defer file.Close()
+
+		if _, err := io.Copy(file, decrypted); err != nil {
+			var matrixErr *Error
+			if errors.As(err, &matrixErr) {
+				return err
+			}
+
+			return newError(ErrArchive, "downloading "+archive.URL, err)
+		}
+
+		if body.read != archive.Size {
+			return newError(ErrBackupDamaged, "downloaded "+strconv.FormatInt(body.read, 10)+" of "+strconv.FormatInt(archive.Size, 10)+" bytes of "+archive.URL, nil)
+		}
+
+		return nil
+	})
+}
+
+type countingReader struct {
+	reader io.Reader
+	read   int64
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.reader.Read(b)
+	r.read += int64(n)
+
+	return n, err
+}
+
+// verifyBackupArchive reads an archive to the end, so a truncated or corrupt
+// one fails gzip's checksum before anything is restored from it, and returns
+// the names of the files in it
+func verifyBackupArchive(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, newError(ErrArchive, path, err)
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, newError(ErrBackupDamaged, filepath.Base(path)+" is not a gzip archive", err)
+	}
+
+	names := []string{}
+
+	reader := tar.NewReader(gz)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err == nil {
+			_, err = io.Copy(io.Discard, reader)
+		}
+
+		if err != nil {
+			return nil, newError(ErrBackupDamaged, filepath.Base(path), err)
+		}
+
+		names = append(names, header.Name)
+	}
+
+	// tar stops at its end marker, gzip's checksum comes after it
+	if _, err := io.Copy(io.Discard, gz); err != nil {
+		return nil, newError(ErrBackupDamaged, filepath.Base(path), err)
+	}
+
+	return names, nil
+}
+
+// verifyBackupDump reads a gzipped database dump to the end, so a truncated
+// or corrupt one fails gzip's checksum before it is imported
+func verifyBackupDump(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return newError(ErrArchive, path, err)
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return newError(ErrBackupDamaged, filepath.Base(path)+" is not gzipped", err)
+	}
+
+	if _, err := io.Copy(io.Discard, gz); err != nil {
+		return newError(ErrBackupDamaged, filepath.Base(path), err)
+	}
+
+	return nil
+}
+
+// extractBackupArchive extracts an archive into dir, leaving out the files in
+// skip and anything that would end up outside dir, including symlinks that
+// point outside it or could be made to. It never writes through a symlink, whether the archive
+// made it or it was already there.
+func extractBackupArchive(path string, dir string, skip []string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return newError(ErrArchive, path, err)
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return newError(ErrArchive, path, err)
+	}
+
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return newError(ErrArchive, dir, err)
+	}
+
+	reader := tar.NewReader(gz)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return newError(ErrArchive, path, err)
+		}
+
+		name := filepath.Clean(header.Name)
+		target := filepath.Join(root, name)
+
+		if slices.Contains(skip, name) || !insideDir(root, target) {
+			continue
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err = checkExtractPath(root, target); err == nil {
+				err = os.MkdirAll(target, header.FileInfo().Mode().Perm()|0700)
+			}
+		case tar.TypeReg:
+			if err = checkExtractPath(root, filepath.Dir(target)); err == nil {
+				err = extractBackupFile(reader, target, header.FileInfo().Mode().Perm())
+			}
+		case tar.TypeSymlink:
+			if !linkStaysInside(root, target, header.Linkname) {
+				continue
+			}
+
+			if err = checkExtractPath(root, filepath.Dir(target)); err == nil {
+				os.Remove(target)
+				err = os.Symlink(header.Linkname, target)
+			}
+		}
+
+		if err != nil {
+			return newError(ErrArchive, "extracting "+name, err)
+		}
+	}
+}
+
+// insideDir is whether path is root or somewhere under it
+func insideDir(root string, path string) bool {
+	return path == root || strings.HasPrefix(path, root+string(filepath.Separator))
+}
+
+// linkStaysInside is whether a symlink at path to link resolves inside root.
+// It follows link a step at a time through what is already there, and won't
+// go through a symlink or up out of a directory that doesn't exist yet, as
+// either could be made to lead outside root by a later entry.
+func linkStaysInside(root string, path string, link string) bool {
+	current := filepath.Dir(path)
+
+	if filepath.IsAbs(link) {
+		rest, ok := strings.CutPrefix(link, root)
+		if !ok || rest != "" && !strings.HasPrefix(rest, string(filepath.Separator)) {
+			return false
+		}
+
+		current, link = root, rest
+	}
+
+	for _, part := range strings.Split(link, string(filepath.Separator)) {
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if info, err := os.Lstat(current); err != nil || !info.IsDir() {
+				return false
+			}
+
+			current = filepath.Dir(current)
+		default:
+			current = filepath.Join(current, part)
+		}
+
+		if !insideDir(root, current) {
+			return false
+		}
+
+		if info, err := os.Lstat(current); err == nil && info.Mode()&fs.ModeSymlink != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// checkExtractPath makes sure nothing from under root down to path is a
+// symlink, so extracting there can't be led outside root
+func checkExtractPath(root string, path string) error {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == "." {
+		return err
+	}
+
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		root = filepath.Join(root, part)
+
+		info, err := os.Lstat(root)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if info.Mode()&fs.ModeSymlink != 0 {
+			return errors.New("refusing to write through symlink " + root)
+		}
+	}
+
+	return nil
+}
+
+func extractBackupFile(reader io.Reader, target string, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	// Whatever is there is replaced, so a symlink isn't followed
+	if err := os.Remove(target); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	file, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(file, reader)
+
+	return err
+}
+
+// restoreLocal imports the database into DDEV and extracts the files over the
+// current directory
+func restoreLocal(set BackupSet, files map[string]string, sqlFile string, dir string) error {
+	if archive := set.database(); archive != nil {
+		// DDEV imports a gzipped dump as it is
+		dump := files[archive.Key]
+
+		if strings.HasSuffix(archive.Key, ".sql.tar.gz") {
+			err := executor.Call([]string{"tar", "-xzf", files[archive.Key], "-C", dir}, func() error {
+				return extractBackupArchive(files[archive.Key], dir, nil)
+			})
+			if err != nil {
+				return err
+			}
+
+			dump = filepath.Join(dir, filepath.Clean(sqlFile))
+		}
+
+		if err := runCommand(exec.Command("ddev", "import-db", "--file="+dump), false, false, true); err != nil {
+			return err
+		}
+	}
+
+	if archive := set.archive(".tar.gz"); archive != nil {
+		err := executor.Call([]string{"tar", "-xzf", files[archive.Key], "--exclude=" + strings.Join(restorePreserved, " --exclude=")}, func() error {
+			return extractBackupArchive(files[archive.Key], ".", restorePreserved)
+		})
+		if err != nil {
+			return err
+		}
+
+		if !dryRun {
+			color.Green("✓ Completed: Restored files, keeping " + strings.Join(restorePreserved, ", "))
+		}
+	}
+
+	return nil
+}
+
+// restoreRemote copies the archives to the server and restores them there,
+// importing the database with mysql and the credentials in the server's .env
+// (or wp-cli for WordPress)
+func restoreRemote(ctx context.Context, cCtx *cli.Context, instance Instance, set BackupSet, files map[string]string, sqlFile string) error {
+	script := "set -e\n"
+	script += "cd " + deployDir + "\n"
+
+	if archive := set.database(); archive != nil {
+		remote := dbBackupDir + "/" + filepath.Base(archive.Key)
+		if err := copyToInstance(ctx, cCtx, instance, files[archive.Key], remote); err != nil {
+			return err
+		}
+
+		sql := dbBackupDir + "/" + filepath.Clean(sqlFile)
+
+		if strings.HasSuffix(archive.Key, ".sql.gz") {
+			sql = strings.TrimSuffix(remote, ".gz")
+			script += "gunzip -c " + remote + " > " + sql + "\n"
+		} else {
+			script += "tar -xzf " + remote + " -C " + dbBackupDir + "\n"
+		}
+		script += "if [ -f wp-config.php ]; then\n"
+		script += "  wp db import " + sql + " --allow-root\n"
+		script += "else\n"
+		script += "  set -a; . ./.env; set +a\n"
+		script += "  mysql -h \"${DB_SERVER:-${DB_HOST:-localhost}}\" -P \"${DB_PORT:-3306}\" -u \"${DB_USER:-$DB_USERNAME}\" -p\"$DB_PASSWORD\" \"$DB_DATABASE\" < " + sql + "\n"
+		script += "fi\n"
+		script += "rm -f " + remote + " " + sql + "\n"
+		script += "echo 'Imported database'\n"
+	}
+
+	if archive := set.archive(".tar.gz"); archive != nil {
+		remote := dbBackupDir + "/" + filepath.Base(archive.Key)
+		if err := copyToInstance(ctx, cCtx, instance, files[archive.Key], remote); err != nil {
+			return err
+		}
+
+		script += "tar -xzf " + remote + " -C " + deployDir
+		for _, name := range restorePreserved {
+			script += " --exclude=./" + name + " --exclude=" + name
+		}
+		script += "\n"
+		script += "rm -f " + remote + "\n"
+		script += "echo 'Restored files, keeping " + strings.Join(restorePreserved, ", ") + "'\n"
+	}
+
+	return updateViaSSH(ctx, cCtx, instance, script)
+}
+
+// copyToInstance copies a local file to path on the instance, readable only
+// by root
+func copyToInstance(ctx context.Context, cCtx *cli.Context, instance Instance, local string, path string) error {
+	target, err := sshTarget(ctx, cCtx, instance)
+	if err != nil {
+		return err
+	}
+
+	s.Suffix = " Copying " + filepath.Base(path) + " to " + instance.Name
+	s.Start()
+	defer s.Stop()
+
+	cmd := target.command([]string{"BatchMode=yes"}, []string{"sudo sh -c 'umask 077 && mkdir -p " + filepath.Dir(path) + " && cat > " + path + "'"})
+
+	// Nothing was downloaded in a dry run
+	if !dryRun {
+		file, err := os.Open(local)
+		if err != nil {
+			return newError(ErrArchive, local, err)
+		}
+		defer file.Close()
+
+		cmd.Stdin = file
+	}
+
+	if err := executor.Run(cmd); err != nil {
+		return commandError(ErrCommandFailed, cmd, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// writeTestArchive writes a .tar.gz of headers, with contents for the
+// regular files, and returns its path
+func writeTestArchive(t *testing.T, headers []tar.Header, contents map[string]string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "backup.tar.gz")
+
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	gz := gzip.NewWriter(file)
+	archive := tar.NewWriter(gz)
+
+	for _, header := range headers {
+		header.Size = int64(len(contents[header.Name]))
+		if header.Mode == 0 {
+			header.Mode = 0644
+		}
+
+		if err := archive.WriteHeader(&header); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := archive.Write([]byte(contents[header.Name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestExtractBackupArchive(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing map[string]string
+		headers  []tar.Header
+		contents map[string]string
+		err      bool
+		files    map[string]string
+		links    map[string]string
+		missing  []string
+	}{
+		{
+			name:     "files and directories",
+			headers:  []tar.Header{{Name: "web/", Typeflag: tar.TypeDir, Mode: 0755}, {Name: "web/index.php", Typeflag: tar.TypeReg}},
+			contents: map[string]string{"web/index.php": "<?php"},
+			files:    map[string]string{"web/index.php": "<?php"},
+		},
+		{
+			name:     "skips paths outside",
+			headers:  []tar.Header{{Name: "../outside/evil", Typeflag: tar.TypeReg}},
+			contents: map[string]string{"../outside/evil": "evil"},
+			missing:  []string{"outside/evil"},
+		},
+		{
+			name:     "skips preserved files",
+			headers:  []tar.Header{{Name: ".env", Typeflag: tar.TypeReg}},
+			contents: map[string]string{".env": "evil"},
+			existing: map[string]string{"dest/.env": "kept"},
+			files:    map[string]string{".env": "kept"},
+		},
+		{
+			name:    "keeps symlinks inside",
+			headers: []tar.Header{{Name: "current", Typeflag: tar.TypeSymlink, Linkname: "releases/1"}},
+			links:   map[string]string{"current": "releases/1"},
+		},
+		{
+			name:     "skips relative symlinks outside",
+			headers:  []tar.Header{{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "../outside"}, {Name: "link/evil", Typeflag: tar.TypeReg}},
+			contents: map[string]string{"link/evil": "evil"},
+			files:    map[string]string{"link/evil": "evil"},
+			missing:  []string{"outside/evil"},
+		},
+		{
+			name:     "skips absolute symlinks outside",
+			existing: map[string]string{"outside/": ""},
+			headers:  []tar.Header{{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "{base}/outside"}, {Name: "link/evil", Typeflag: tar.TypeReg}},
+			contents: map[string]string{"link/evil": "evil"},
+			files:    map[string]string{"link/evil": "evil"},
+			missing:  []string{"outside/evil"},
+		},
+		{
+			name:     "won't write through a symlink in the archive",
+			headers:  []tar.Header{{Name: "real/", Typeflag: tar.TypeDir}, {Name: "link", Typeflag: tar.TypeSymlink, Linkname: "real"}, {Name: "link/evil", Typeflag: tar.TypeReg}},
+			contents: map[string]string{"link/evil": "evil"},
+			err:      true,
+			missing:  []string{"dest/real/evil"},
+		},
+		{
+			name:     "won't write through a symlink already there",
+			existing: map[string]string{"outside/": "", "dest/link": "-> ../outside"},
+			headers:  []tar.Header{{Name: "link/evil", Typeflag: tar.TypeReg}},
+			contents: map[string]string{"link/evil": "evil"},
+			err:      true,
+			missing:  []string{"outside/evil"},
+		},
+		{
+			name:     "won't make a directory through a symlink already there",
+			existing: map[string]string{"outside/": "", "dest/link": "-> ../outside"},
+			headers:  []tar.Header{{Name: "link/sub/", Typeflag: tar.TypeDir}},
+			err:      true,
+			missing:  []string{"outside/sub"},
+		},
+		{
+			name:    "won't chain symlinks in the archive outside",
+			headers: []tar.Header{{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "."}, {Name: "a/b", Typeflag: tar.TypeSymlink, Linkname: ".."}},
+			links:   map[string]string{"a": "."},
+			missing: []string{"dest/b"},
+		},
+		{
+			name:     "won't point a symlink through one in the archive",
+			headers:  []tar.Header{{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "."}, {Name: "b", Typeflag: tar.TypeSymlink, Linkname: "a/.."}, {Name: "b/evil", Typeflag: tar.TypeReg}},
+			contents: map[string]string{"b/evil": "evil"},
+			files:    map[string]string{"b/evil": "evil"},
+			missing:  []string{"evil"},
+		},
+		{
+			name:     "won't point a symlink up out of a directory a later entry could make a symlink",
+			headers:  []tar.Header{{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "c/.."}, {Name: "c", Typeflag: tar.TypeSymlink, Linkname: "."}, {Name: "a/evil", Typeflag: tar.TypeReg}},
+			contents: map[string]string{"a/evil": "evil"},
+			files:    map[string]string{"a/evil": "evil"},
+			links:    map[string]string{"c": "."},
+			missing:  []string{"evil"},
+		},
+		{
+			name:     "won't point a symlink through one already there",
+			existing: map[string]string{"outside/": "", "dest/uploads": "-> ../outside"},
+			headers:  []tar.Header{{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "uploads/.."}},
+			missing:  []string{"dest/link"},
+		},
+		{
+			name:     "replaces a symlinked file rather than writing through it",
+			existing: map[string]string{"outside/secret": "safe", "dest/file": "-> ../outside/secret"},
+			headers:  []tar.Header{{Name: "file", Typeflag: tar.TypeReg}},
+			contents: map[string]string{"file": "evil"},
+			files:    map[string]string{"file": "evil", "../outside/secret": "safe"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			base := t.TempDir()
+			dest := filepath.Join(base, "dest")
+
+			if err := os.MkdirAll(dest, 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			// Paths ending in / are directories, and contents starting with ->
+			// are symlinks
+			for name, content := range test.existing {
+				path := filepath.Join(base, name)
+
+				var err error
+				switch {
+				case strings.HasSuffix(name, "/"):
+					err = os.MkdirAll(path, 0755)
+				case strings.HasPrefix(content, "-> "):
+					err = os.Symlink(content[3:], path)
+				default:
+					if err = os.MkdirAll(filepath.Dir(path), 0755); err == nil {
+						err = os.WriteFile(path, []byte(content), 0644)
+					}
+				}
+
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// {base} in a link is the test's own directory
+			headers := slices.Clone(test.headers)
+			for i := range headers {
+				headers[i].Linkname = strings.Replace(headers[i].Linkname, "{base}", base, 1)
+			}
+
+			err := extractBackupArchive(writeTestArchive(t, headers, test.contents), dest, restorePreserved)
+			if test.err != (err != nil) {
+				t.Fatalf("got error %v, want error %v", err, test.err)
+			}
+
+			for name, want := range test.files {
+				path := filepath.Join(dest, name)
+
+				if info, err := os.Lstat(path); err != nil || !info.Mode().IsRegular() {
+					t.Errorf("%s isn't a regular file: %v", name, err)
+					continue
+				}
+
+				if got, _ := os.ReadFile(path); string(got) != want {
+					t.Errorf("%s is %q, want %q", name, got, want)
+				}
+			}
+
+			for name, want := range test.links {
+				if got, err := os.Readlink(filepath.Join(dest, name)); err != nil || got != want {
+					t.Errorf("%s links to %q (%v), want %q", name, got, err, want)
+				}
+			}
+
+			// Whatever was extracted, no symlink in it leads outside
+			realDest, err := filepath.EvalSymlinks(dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			filepath.WalkDir(dest, func(path string, entry fs.DirEntry, err error) error {
+				if err != nil || entry.Type()&fs.ModeSymlink == 0 {
+					return err
+				}
+
+				if resolved, err := filepath.EvalSymlinks(path); err == nil && !insideDir(realDest, resolved) && test.existing[strings.TrimPrefix(path, base+"/")] == "" {
+					t.Errorf("%s resolves outside to %s", path, resolved)
+				}
+
+				return nil
+			})
+
+			for _, name := range test.missing {
+				if _, err := os.Lstat(filepath.Join(base, name)); err == nil {
+					t.Errorf("%s was written", name)
+				}
+			}
+		})
+	}
+}
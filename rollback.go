@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+
+	"github.com/fatih/color"
+	"github.com/urfave/cli/v2"
+)
+
+// RollbackResult is the result of matrix rollback
+type RollbackResult struct {
+	Project    string `json:"project"`
+	DeployID   string `json:"deployId,omitempty"`
+	From       string `json:"from"`
+	To         string `json:"to"`
+	Commit     string `json:"commit"`
+	InstanceID string `json:"instanceId,omitempty"`
+	Backup     string `json:"backup,omitempty"`
+	Restored   string `json:"restored,omitempty"`
+	DryRun     bool   `json:"dryRun,omitempty"`
+}
+
+// RollbackPlan is what a rollback will do, worked out from deploy history
+type RollbackPlan struct {
+	// The deploy (or rollback) that is live now
+	Current DeployRecord
+
+	// The deploy being rolled back to
+	Target DeployRecord
+
+	// The first change made after Target was last live. Its backup is the
+	// database as it was with Target's code.
+	Next *DeployRecord
+}
+
+// planRollback picks the deploy to roll back to from a project's history,
+// oldest first. Without an ID it is the last deploy before the live one that
+// put a different commit live and hasn't itself been rolled back.
+func planRollback(records []DeployRecord, to string) (RollbackPlan, error) {
+	plan := RollbackPlan{}
+
+	if len(records) == 0 {
+		return plan, newError(ErrDeployNotFound, "no deploys of "+ProjectName+" to roll back", nil)
+	}
+
+	plan.Current = records[len(records)-1]
+
+	byID := map[string]int{}
+	for i, record := range records {
+		byID[record.ID] = i
+	}
+
+	if to != "" {
+		i, ok := byID[to]
+		if !ok {
+			return plan, newError(ErrDeployNotFound, "deploy '"+to+"' not found in the history of "+ProjectName, nil)
+		}
+
+		// Rolling back to a rollback is rolling back to what it went back to
+		if records[i].RollbackTo != "" {
+			if j, ok := byID[records[i].RollbackTo]; ok {
+				i = j
+			}
+		}
+
+		if records[i].Result != DeploySucceeded {
+			return plan, newError(ErrDeployNotFound, "deploy '"+records[i].ID+"' failed, pick one that succeeded", nil)
+		}
+
+		plan.Target = records[i]
+	} else {
+		// Deploys between a rollback and where it went back to were undone
+		undone := make([]bool, len(records))
+		for i, record := range records {
+			if j, ok := byID[record.RollbackTo]; ok && record.Result == DeploySucceeded {
+				for k := j + 1; k < i; k++ {
+					undone[k] = true
+				}
+			}
+		}
+
+		found := false
+		for i := len(records) - 2; i >= 0 && !found; i-- {
+			record := records[i]
+
+			if undone[i] || record.RollbackTo != "" || record.Result != DeploySucceeded || record.Commit == plan.Current.Commit {
+				continue
+			}
+
+			plan.Target = record
+			found = true
+		}
+
+		if !found {
+			return plan, newError(ErrDeployNotFound, "no earlier deploy of "+ProjectName+" to roll back to", nil)
+		}
+	}
+
+	// The last time the target went live, by deploy or by rollback
+	live := byID[plan.Target.ID]
+	for i := live + 1; i < len(records); i++ {
+		if records[i].RollbackTo == plan.Target.ID && records[i].Result == DeploySucceeded {
+			live = i
+		}
+	}
+
+	if live+1 < len(records) {
+		plan.Next = &records[live+1]
+	}
+
+	return plan, nil
+}
+
+// backup is the database backup that goes with the target's code, if it is
+// on instance
+func (plan RollbackPlan) backup(instance Instance) string {
+	if plan.Next == nil || plan.Next.InstanceID != instance.ID {
+		return ""
+	}
+
+	return plan.Next.Backup
+}
+
+func rollback(cCtx *cli.Context) error {
+	project, err := projectNameFromArgs(cCtx)
+	if err != nil {
+		return err
+	}
+
+	ProjectName = project
+
+	config, err := loadDeployConfig(cCtx)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	client, err := newAWSClient(ctx, config.Profile, config.Region)
+	if err != nil {
+		return err
+	}
+
+	records, err := loadDeployHistory(ctx, client, config.History, project)
+	if err != nil {
+		return err
+	}
+
+	plan, err := planRollback(records, cCtx.String("to"))
+	if err != nil {
+		return err
+	}
+
+	ProjectType = valueOr(plan.Current.Type, plan.Target.Type)
+
+	// The project is where it was last deployed to, not necessarily where
+	// the current settings point
+	config.Profile = valueOr(plan.Current.Profile, config.Profile)
+	config.Region = valueOr(plan.Current.Region, client.Region)
+
+	instanceClient, err := newAWSClient(ctx, config.Profile, config.Region)
+	if err != nil {
+		return err
+	}
+
+	instance, err := findDeployedInstance(ctx, instanceClient, config)
+	if err != nil {
+		return err
+	}
+
+	restore := ""
+	if cCtx.Bool("restore-db") {
+		if dbRestoreCommand(ProjectType, "") == "" {
+			return newError(ErrUnsupported, "restoring the database of "+valueOr(ProjectType, "this")+" project, only craft and wordpress are backed up on deploy", nil)
+		}
+
+		restore = plan.backup(instance)
+		if restore == "" {
+			return newError(ErrBackupNotFound, "no database backup on "+instance.ID+" from before "+ProjectName+" moved on from "+plan.Target.ID, nil)
+		}
+	}
+
+	color.Magenta("Rolling back " + ProjectName + " on " + instance.Name + " (" + instance.ID + ")")
+	color.White("From: " + describeDeploy(plan.Current))
+	color.White("To:   " + describeDeploy(plan.Target))
+
+	if restore != "" {
+		color.Yellow("Database: restore " + restore + ", taken before deploy " + plan.Next.ID + ". Changes made since then will be lost")
+	} else if backup := plan.backup(instance); backup != "" {
+		color.White("Database: left as it is (--restore-db restores " + backup + ", taken before deploy " + plan.Next.ID + ")")
+	} else {
+		color.White("Database: left as it is")
+	}
+
+	// Nothing changes in a dry run so there is nothing to confirm
+	if !dryRun && !cCtx.Bool("yes") {
+		if err := confirm("Roll back " + ProjectName + " to " + shortCommit(plan.Target.Commit) + "?"); err != nil {
+			return err
+		}
+	}
+
+	record := newDeployRecord(DeployConfig{Target: instance.Provider, Ref: plan.Target.Ref, Region: config.Region, Profile: config.Profile}, plan.Target.Commit)
+	record.ID = uniqueDeployID(records, record.ID)
+	record.Action = "rollback"
+	record.RollbackTo = plan.Target.ID
+	record.Restored = restore
+
+	// Back up the database first, so the rollback can be undone too
+	if dbBackupCommand(ProjectType, "") != "" {
+		record.Backup = dbBackupPath(record.ID)
+	}
+
+	instance, err = updateDeployment(ctx, cCtx, instanceClient, instance, updateScript(ProjectType, plan.Target.Commit, record.Backup, restore))
+
+	result := RollbackResult{
+		Project:    ProjectName,
+		From:       plan.Current.ID,
+		To:         plan.Target.ID,
+		Commit:     plan.Target.Commit,
+		InstanceID: instance.ID,
+		Backup:     record.Backup,
+		Restored:   restore,
+	}
+
+	if dryRun {
+		if err != nil {
+			return err
+		}
+
+		result.DryRun = true
+
+		return printResult(result)
+	}
+
+	if err == nil {
+		err = checkDeployHealth(ctx, cCtx, config, instance, false)
+	}
+
+	record.finish(instance, true, err)
+
+	if historyErr := saveDeployRecord(ctx, client, config.History, &record); historyErr != nil {
+		color.Yellow("× Couldn't save deploy history: " + historyErr.Error())
+	}
+
+	if err != nil {
+		return err
+	}
+
+	color.Green("✓ Completed: Rolled back " + ProjectName + " to " + plan.Target.ID + " (" + shortCommit(plan.Target.Commit) + ")")
+	color.White("Undo with: matrix rollback --to " + plan.Current.ID + " " + ProjectName)
+
+	result.DeployID = record.ID
+
+	return printResult(result)
+}
+
+// describeDeploy is a one line summary of a deploy for rollback to show
+func describeDeploy(record DeployRecord) string {
+	return record.ID + "  " + record.Ref + " (" + shortCommit(record.Commit) + ") by " + record.User + " at " + record.Time.Local().Format("2006-01-02 15:04")
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func deployed(id string, commit string) DeployRecord {
+	return DeployRecord{ID: id, Action: "deploy", Commit: commit, InstanceID: "i-1", Backup: "backups/" + id + ".sql.gz", Result: DeploySucceeded}
+}
+
+func failed(id string, commit string) DeployRecord {
+	record := deployed(id, commit)
+	record.Result = DeployFailed
+
+	return record
+}
+
+func rolledBack(id string, to DeployRecord) DeployRecord {
+	record := deployed(id, to.Commit)
+	record.Action = "rollback"
+	record.RollbackTo = to.ID
+
+	return record
+}
+
+func TestPlanRollback(t *testing.T) {
+	a := deployed("a", "c1")
+	b := deployed("b", "c2")
+	c := deployed("c", "c3")
+	d := deployed("d", "c4")
+
+	tests := []struct {
+		name    string
+		records []DeployRecord
+		to      string
+		target  string
+		next    string
+		err     bool
+	}{
+		{name: "no deploys", err: true},
+		{name: "only one deploy", records: []DeployRecord{a}, err: true},
+		{name: "previous deploy", records: []DeployRecord{a, b, c}, target: "b", next: "c"},
+		{name: "skips redeploys of the live commit", records: []DeployRecord{a, b, deployed("b2", "c2")}, target: "a", next: "b"},
+		{name: "skips failed deploys", records: []DeployRecord{a, failed("b", "c2"), c}, target: "a", next: "b"},
+		{name: "skips deploys already rolled back", records: []DeployRecord{a, b, c, rolledBack("r", b)}, target: "a", next: "b"},
+		{name: "skips rollbacks", records: []DeployRecord{a, b, rolledBack("r", a), c}, target: "a", next: "c"},
+		{name: "pairs with the change after the target was last live", records: []DeployRecord{a, b, rolledBack("r", a), c, d}, to: "a", target: "a", next: "c"},
+		{name: "to a deploy", records: []DeployRecord{a, b, c}, to: "a", target: "a", next: "b"},
+		{name: "to the live deploy", records: []DeployRecord{a, b, c}, to: "c", target: "c"},
+		{name: "to a rollback", records: []DeployRecord{a, b, c, rolledBack("r", b), d}, to: "r", target: "b", next: "d"},
+		{name: "to a failed deploy", records: []DeployRecord{a, failed("b", "c2"), c}, to: "b", err: true},
+		{name: "to an unknown deploy", records: []DeployRecord{a, b}, to: "x", err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			plan, err := planRollback(test.records, test.to)
+
+			if test.err {
+				if !errors.Is(err, ErrDeployNotFound) {
+					t.Fatalf("got error %v, want ErrDeployNotFound", err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("got error %v", err)
+			}
+
+			if plan.Current.ID != test.records[len(test.records)-1].ID {
+				t.Errorf("current is %q, want the last record", plan.Current.ID)
+			}
+
+			if plan.Target.ID != test.target {
+				t.Errorf("target is %q, want %q", plan.Target.ID, test.target)
+			}
+
+			next := ""
+			if plan.Next != nil {
+				next = plan.Next.ID
+			}
+
+			if next != test.next {
+				t.Errorf("next is %q, want %q", next, test.next)
+			}
+		})
+	}
+}
+
+func TestRollbackPlanBackup(t *testing.T) {
+	next := deployed("b", "c2")
+	plan := RollbackPlan{Target: deployed("a", "c1"), Next: &next}
+
+	if backup := plan.backup(Instance{ID: "i-1"}); backup != next.Backup {
+		t.Errorf("backup on the same instance is %q, want %q", backup, next.Backup)
+	}
+
+	if backup := plan.backup(Instance{ID: "i-2"}); backup != "" {
+		t.Errorf("backup on another instance is %q, want none", backup)
+	}
+
+	if backup := (RollbackPlan{Target: next}).backup(Instance{ID: "i-1"}); backup != "" {
+		t.Errorf("backup without a next change is %q, want none", backup)
+	}
+}
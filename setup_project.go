@@ -6,10 +6,12 @@ import (
 	"github.com/fatih/color"
 )
 
-func setupProject(freshMode bool, shallowMode bool) {
+func setupProject(freshMode bool, shallowMode bool) error {
 	if freshMode {
 		// git clone --depth=1 {CraftStarterRepo} {ProjectName}
-		runCommand(exec.Command("git", "clone", "--depth=1", CraftStarterRepo, ProjectName), false, false, true)
+		if err := runCommand(exec.Command("git", "clone", "--depth=1", CraftStarterRepo, ProjectName), false, false, true); err != nil {
+			return newError(ErrGitCloneFailed, ProjectName, err)
+		}
 
 		// ddev config --project-name={ProjectName}
 		runCommand(exec.Command("ddev", "config", "--project-name="+ProjectName), false, true, false)
@@ -29,17 +31,23 @@ func setupProject(freshMode bool, shallowMode bool) {
 			// Try in main branch
 			if shallowMode {
 				// git clone --depth=1 --no-single-branch git@github:{GithubRepoUser}/{ProjectName} {ProjectName}
-				runCommand(exec.Command("git", "clone", "--depth=1", "--no-single-branch", "git@github.com:"+GithubRepoUser+"/"+ProjectName+".git", ProjectName), false, false, true)
+				if err := runCommand(exec.Command("git", "clone", "--depth=1", "--no-single-branch", "git@github.com:"+GithubRepoUser+"/"+ProjectName+".git", ProjectName), false, false, true); err != nil {
+					return newError(ErrGitCloneFailed, ProjectName, err)
+				}
 			} else {
 				// git clone git@github:{GithubRepoUser}/{ProjectName} {ProjectName}
-				runCommand(exec.Command("git", "clone", "git@github.com:"+GithubRepoUser+"/"+ProjectName+".git", ProjectName), false, false, true)
+				if err := runCommand(exec.Command("git", "clone", "git@github.com:"+GithubRepoUser+"/"+ProjectName+".git", ProjectName), false, false, true); err != nil {
+					return newError(ErrGitCloneFailed, ProjectName, err)
+				}
 			}
 		}
 	}
 
 	// ddev start
 	if fileExists(ProjectName + "/.ddev") {
-		runCommand(exec.Command("ddev", "start"), false, true, true)
+		if err := runCommand(exec.Command("ddev", "start"), false, true, true); err != nil {
+			return err
+		}
 	}
 
 	// ddev composer install
@@ -98,4 +106,6 @@ func setupProject(freshMode bool, shallowMode bool) {
 
 	// ddev describe
 	runCommand(exec.Command("ddev", "describe"), true, true, false)
+
+	return nil
 }
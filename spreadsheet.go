@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/urfave/cli/v2"
+	"github.com/xuri/excelize/v2"
+)
+
+// sheetColumn is a column header and its width
+type sheetColumn struct {
+	Header string
+	Width  float64
+}
+
+func createSpreadsheetOfInstances(cCtx *cli.Context) (string, error) {
+	fileName := cCtx.String("out")
+	if fileName == "" {
+		fileName = "aws-instances.xlsx"
+	}
+
+	s.Suffix = " Creating spreadsheet of AWS instances..."
+	s.Start()
+
+	inventory, err := getInventory(context.Background(), cCtx, true)
+
+	s.Stop()
+
+	if err != nil {
+		return "", err
+	}
+
+	f := excelize.NewFile()
+	defer f.Close()
+
+	headerStyle, err := f.NewStyle(&excelize.Style{
+		Font:      &excelize.Font{Bold: true, Color: "FFFFFF"},
+		Fill:      excelize.Fill{Type: "pattern", Pattern: 1, Color: []string{"7030A0"}},
+		Alignment: &excelize.Alignment{Vertical: "center"},
+	})
+	if err != nil {
+		return "", newError(ErrGeneral, "creating spreadsheet", err)
+	}
+
+	// The new file starts with Sheet1 so use it for the summary
+	if err := f.SetSheetName("Sheet1", "Summary"); err != nil {
+		return "", newError(ErrGeneral, "creating spreadsheet", err)
+	}
+
+	sheets := []struct {
+		name    string
+		columns []sheetColumn
+		rows    [][]interface{}
+	}{
+		{"Summary", summaryColumns, summaryRows(inventory)},
+		{"Lightsail", lightsailColumns, lightsailRows(inventory)},
+		{"EC2", ec2Columns, ec2Rows(inventory)},
+		{"EBS Volumes", volumeColumns, volumeRows(inventory)},
+		{"S3 Buckets", bucketColumns, bucketRows(inventory)},
+		{"Static IPs", staticIPColumns, staticIPRows(inventory)},
+	}
+
+	for _, sheet := range sheets {
+		if err := writeSheet(f, sheet.name, sheet.columns, sheet.rows, headerStyle); err != nil {
+			return "", newError(ErrGeneral, "writing "+sheet.name+" sheet", err)
+		}
+	}
+
+	// Open on the summary
+	f.SetActiveSheet(0)
+
+	// Save spreadsheet
+	if err := f.SaveAs(fileName); err != nil {
+		return "", newError(ErrGeneral, "saving spreadsheet", err)
+	}
+
+	color.Magenta("--------------------------------------------------")
+	color.Magenta("🎉   SPREADSHEET CREATED: " + fileName)
+	color.Magenta("--------------------------------------------------")
+
+	return fileName, nil
+}
+
+// writeSheet writes a table with a styled, frozen and filterable header row
+func writeSheet(f *excelize.File, sheet string, columns []sheetColumn, rows [][]interface{}, headerStyle int) error {
+	if index, _ := f.GetSheetIndex(sheet); index == -1 {
+		if _, err := f.NewSheet(sheet); err != nil {
+			return err
+		}
+	}
+
+	headers := make([]interface{}, len(columns))
+	for i, column := range columns {
+		headers[i] = column.Header
+
+		name, err := excelize.ColumnNumberToName(i + 1)
+		if err != nil {
+			return err
+		}
+
+		if err := f.SetColWidth(sheet, name, name, column.Width); err != nil {
+			return err
+		}
+	}
+
+	if err := f.SetSheetRow(sheet, "A1", &headers); err != nil {
+		return err
+	}
+
+	for i, row := range rows {
+		cell, err := excelize.CoordinatesToCellName(1, i+2)
+		if err != nil {
+			return err
+		}
+
+		if err := f.SetSheetRow(sheet, cell, &row); err != nil {
+			return err
+		}
+	}
+
+	lastHeader, err := excelize.CoordinatesToCellName(len(columns), 1)
+	if err != nil {
+		return err
+	}
+
+	lastCell, err := excelize.CoordinatesToCellName(len(columns), len(rows)+1)
+	if err != nil {
+		return err
+	}
+
+	if err := f.SetCellStyle(sheet, "A1", lastHeader, headerStyle); err != nil {
+		return err
+	}
+
+	if err := f.SetRowHeight(sheet, 1, 20); err != nil {
+		return err
+	}
+
+	if err := f.SetPanes(sheet, &excelize.Panes{
+		Freeze:      true,
+		YSplit:      1,
+		TopLeftCell: "A2",
+		ActivePane:  "bottomLeft",
+	}); err != nil {
+		return err
+	}
+
+	return f.AutoFilter(sheet, "A1:"+lastCell, nil)
+}
+
+// timeCell lets optional times be written as empty cells
+func timeCell(t *time.Time) interface{} {
+	if t == nil {
+		return ""
+	}
+
+	return t.UTC()
+}
+
+var lightsailColumns = []sheetColumn{
+	{"Name", 25}, {"Status", 12}, {"Bundle", 15}, {"Public IP", 16}, {"Private IP", 16},
+	{"CPUs", 8}, {"RAM (GB)", 10}, {"Disk (GB)", 10}, {"Zone", 14}, {"Region", 14}, {"Account", 15}, {"Launched", 20},
+}
+
+func lightsailRows(inventory Inventory) [][]interface{} {
+	var rows [][]interface{}
+
+	for _, instance := range inventory.Instances {
+		if instance.Provider != ProviderLightsail {
+			continue
+		}
+
+		rows = append(rows, []interface{}{
+			instance.Name, instance.State, instance.Type, instance.PublicIP, instance.PrivateIP,
+			instance.CPUs, instance.RAMGB, instance.DiskGB, instance.Zone, instance.Region, instance.Account, timeCell(instance.LaunchTime),
+		})
+	}
+
+	return rows
+}
+
+var ec2Columns = []sheetColumn{
+	{"Name", 25}, {"Instance ID", 22}, {"Status", 12}, {"Instance Type", 15}, {"Public IP", 16}, {"Private IP", 16},
+	{"vCPUs", 8}, {"RAM (GB)", 10}, {"Disk (GB)", 10}, {"Zone", 14}, {"Region", 14}, {"Account", 15}, {"Launched", 20},
+}
+
+func ec2Rows(inventory Inventory) [][]interface{} {
+	var rows [][]interface{}
+
+	for _, instance := range inventory.Instances {
+		if instance.Provider != ProviderEC2 {
+			continue
+		}
+
+		rows = append(rows, []interface{}{
+			instance.Name, instance.ID, instance.State, instance.Type, instance.PublicIP, instance.PrivateIP,
+			instance.CPUs, instance.RAMGB, instance.DiskGB, instance.Zone, instance.Region, instance.Account, timeCell(instance.LaunchTime),
+		})
+	}
+
+	return rows
+}
+
+var volumeColumns = []sheetColumn{
+	{"Volume ID", 24}, {"Name", 25}, {"Status", 12}, {"Type", 8}, {"Size (GB)", 10}, {"IOPS", 8},
+	{"Encrypted", 10}, {"Instance ID", 22}, {"Zone", 14}, {"Region", 14}, {"Account", 15}, {"Created", 20},
+}
+
+func volumeRows(inventory Inventory) [][]interface{} {
+	var rows [][]interface{}
+
+	for _, volume := range inventory.Volumes {
+		rows = append(rows, []interface{}{
+			volume.ID, volume.Name, volume.State, volume.Type, volume.SizeGB, volume.IOPS,
+			volume.Encrypted, volume.InstanceID, volume.Zone, volume.Region, volume.Account, timeCell(volume.CreateTime),
+		})
+	}
+
+	return rows
+}
+
+var bucketColumns = []sheetColumn{
+	{"Name", 35}, {"Region", 14}, {"Account", 15}, {"Created", 20},
+}
+
+func bucketRows(inventory Inventory) [][]interface{} {
+	var rows [][]interface{}
+
+	for _, bucket := range inventory.Buckets {
+		rows = append(rows, []interface{}{bucket.Name, bucket.Region, bucket.Account, timeCell(bucket.CreationDate)})
+	}
+
+	return rows
+}
+
+var staticIPColumns = []sheetColumn{
+	{"Name", 25}, {"IP", 16}, {"Attached", 10}, {"Attached To", 25}, {"Region", 14}, {"Account", 15}, {"Created", 20},
+}
+
+func staticIPRows(inventory Inventory) [][]interface{} {
+	var rows [][]interface{}
+
+	for _, staticIP := range inventory.StaticIPs {
+		rows = append(rows, []interface{}{
+			staticIP.Name, staticIP.IP, staticIP.Attached, staticIP.AttachedTo, staticIP.Region, staticIP.Account, timeCell(staticIP.CreatedAt),
+		})
+	}
+
+	return rows
+}
+
+var summaryColumns = []sheetColumn{
+	{"Account", 15}, {"Region", 14}, {"Lightsail", 10}, {"EC2", 8}, {"Running", 10}, {"Stopped", 10},
+	{"vCPUs", 8}, {"RAM (GB)", 10}, {"Instance Disk (GB)", 18}, {"EBS Volumes", 12}, {"EBS (GB)", 10},
+	{"Unattached EBS", 15}, {"Static IPs", 10}, {"Unattached Static IPs", 20}, {"S3 Buckets", 10},
+}
+
+// summaryTotals are the counts and totals for one account and region
+type summaryTotals struct {
+	lightsail, ec2, running, stopped, cpus int32
+	ramGB, diskGB                          float64
+	volumes, volumeGB, unattachedVolumes   int32
+	staticIPs, unattachedStaticIPs         int32
+	buckets                                int32
+}
+
+func (t summaryTotals) row(account string, region string) []interface{} {
+	return []interface{}{
+		account, region, t.lightsail, t.ec2, t.running, t.stopped,
+		t.cpus, t.ramGB, t.diskGB, t.volumes, t.volumeGB,
+		t.unattachedVolumes, t.staticIPs, t.unattachedStaticIPs, t.buckets,
+	}
+}
+
+func (t *summaryTotals) add(other summaryTotals) {
+	t.lightsail += other.lightsail
+	t.ec2 += other.ec2
+	t.running += other.running
+	t.stopped += other.stopped
+	t.cpus += other.cpus
+	t.ramGB += other.ramGB
+	t.diskGB += other.diskGB
+	t.volumes += other.volumes
+	t.volumeGB += other.volumeGB
+	t.unattachedVolumes += other.unattachedVolumes
+	t.staticIPs += other.staticIPs
+	t.unattachedStaticIPs += other.unattachedStaticIPs
+	t.buckets += other.buckets
+}
+
+// summaryRows has a row per account and region followed by a total row
+func summaryRows(inventory Inventory) [][]interface{} {
+	type key struct{ account, region string }
+
+	totals := map[key]*summaryTotals{}
+	get := func(account string, region string) *summaryTotals {
+		k := key{account, region}
+		if totals[k] == nil {
+			totals[k] = &summaryTotals{}
+		}
+
+		return totals[k]
+	}
+
+	for _, instance := range inventory.Instances {
+		t := get(instance.Account, instance.Region)
+
+		if instance.Provider == ProviderLightsail {
+			t.lightsail++
+		} else {
+			t.ec2++
+		}
+
+		switch instance.State {
+		case "running":
+			t.running++
+		case "stopped":
+			t.stopped++
+		}
+
+		t.cpus += instance.CPUs
+		t.ramGB += instance.RAMGB
+		t.diskGB += float64(instance.DiskGB)
+	}
+
+	for _, volume := range inventory.Volumes {
+		t := get(volume.Account, volume.Region)
+		t.volumes++
+		t.volumeGB += volume.SizeGB
+
+		if volume.InstanceID == "" {
+			t.unattachedVolumes++
+		}
+	}
+
+	for _, staticIP := range inventory.StaticIPs {
+		t := get(staticIP.Account, staticIP.Region)
+		t.staticIPs++
+
+		if !staticIP.Attached {
+			t.unattachedStaticIPs++
+		}
+	}
+
+	for _, bucket := range inventory.Buckets {
+		get(bucket.Account, bucket.Region).buckets++
+	}
+
+	var keys []key
+	for k := range totals {
+		keys = append(keys, k)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].account != keys[j].account {
+			return keys[i].account < keys[j].account
+		}
+
+		return keys[i].region < keys[j].region
+	})
+
+	var rows [][]interface{}
+	var total summaryTotals
+
+	for _, k := range keys {
+		rows = append(rows, totals[k].row(k.account, k.region))
+		total.add(*totals[k])
+	}
+
+	rows = append(rows, total.row("Total", ""))
+
+	for _, inventoryErr := range inventory.Errors {
+		rows = append(rows, []interface{}{inventoryErr.Profile, inventoryErr.Region, "Skipped: " + inventoryErr.Error})
+	}
+
+	return rows
+}
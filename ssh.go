@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/fatih/color"
+	"github.com/urfave/cli/v2"
+)
+
+// SSHResult is the result of matrix ssh <project> -- <cmd> in JSON mode
+type SSHResult struct {
+	Project string   `json:"project"`
+	Host    string   `json:"host"`
+	User    string   `json:"user"`
+	Key     string   `json:"key,omitempty"`
+	Command []string `json:"command"`
+	Output  string   `json:"output"`
+	DryRun  bool     `json:"dryRun,omitempty"`
+}
+
+func sshToProject(cCtx *cli.Context) error {
+	args := cCtx.Args().Slice()
+
+	if len(args) == 0 {
+		return newError(ErrMissingProjectName, "", nil)
+	}
+
+	ProjectName = args[0]
+
+	// Everything after the project (and an optional --) is the remote command
+	remoteCommand := args[1:]
+	if len(remoteCommand) > 0 && remoteCommand[0] == "--" {
+		remoteCommand = remoteCommand[1:]
+	}
+
+	if len(remoteCommand) == 0 && jsonOutput() {
+		return newError(ErrUnsupported, "an interactive ssh session can't be used with --output json, give a command to run", nil)
+	}
+
+	ctx := context.Background()
+
+	instance, err := findProjectInstance(ctx, cCtx, ProjectName)
+	if err != nil {
+		return err
+	}
+
+	target, err := sshTarget(ctx, cCtx, instance)
+	if err != nil {
+		return err
+	}
+
+	cmd := target.command(nil, remoteCommand)
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = os.Stderr
+
+	color.Magenta("Connecting to " + ProjectName + " as " + target.User + "@" + target.Host)
+
+	// Capture the output of a remote command for the JSON result
+	if jsonOutput() {
+		out, err := executor.Output(cmd)
+		if err != nil {
+			return commandError(ErrCommandFailed, cmd, err)
+		}
+
+		return printResult(SSHResult{
+			Project: ProjectName,
+			Host:    target.Host,
+			User:    target.User,
+			Key:     target.Key,
+			Command: remoteCommand,
+			Output:  string(out),
+			DryRun:  dryRun,
+		})
+	}
+
+	cmd.Stdout = os.Stdout
+
+	if err := executor.Run(cmd); err != nil {
+		return commandError(ErrCommandFailed, cmd, err)
+	}
+
+	return nil
+}
+
+// What ssh says when it can't log in, which retrying won't change
+var sshLoginErrors = []string{"Permission denied", "Too many authentication failures", "Host key verification failed"}
+
+// isSSHLoginError is whether ssh's stderr says it can't log in at all, rather
+// than that it couldn't connect yet
+func isSSHLoginError(stderr string) bool {
+	return slices.ContainsFunc(sshLoginErrors, func(message string) bool { return strings.Contains(stderr, message) })
+}
+
+// forgetHostKey removes a new instance's IP from known_hosts. IPs, and the
+// project's static IP especially, are reused by instances with new host keys,
+// which ssh would otherwise refuse to log in to.
+func forgetHostKey(instance Instance) {
+	if instance.PublicIP == "" {
+		return
+	}
+
+	// Fails when there is no known_hosts yet, which is fine
+	executor.Run(exec.Command("ssh-keygen", "-R", instance.PublicIP))
+}
+
+// SSHTarget is who and where to log in to an instance as
+type SSHTarget struct {
+	Host string
+	User string
+	Key  string
+}
+
+// sshTarget works out how to log in to an instance
+func sshTarget(ctx context.Context, cCtx *cli.Context, instance Instance) (SSHTarget, error) {
+	if instance.PublicIP == "" {
+		return SSHTarget{}, newError(ErrGeneral, instance.Name+" has no public IP, it is "+instance.State, nil)
+	}
+
+	config, err := readMatrixConfig()
+	if err != nil {
+		return SSHTarget{}, err
+	}
+
+	target := SSHTarget{
+		Host: instance.PublicIP,
+		User: sshUser(ctx, cCtx, config, instance),
+		Key:  sshKey(cCtx, config, instance),
+	}
+
+	if target.Key == "" {
+		color.Yellow("× No key file found for " + valueOr(instance.KeyName, instance.Name) + ", leaving it to ssh-agent and ~/.ssh/config")
+	}
+
+	return target, nil
+}
+
+// command builds the ssh command to run remote (or log in, with no command)
+// with any extra ssh -o options
+func (target SSHTarget) command(options []string, remote []string) *exec.Cmd {
+	args := []string{"-o", "StrictHostKeyChecking=accept-new"}
+
+	for _, option := range options {
+		args = append(args, "-o", option)
+	}
+
+	if target.Key != "" {
+		args = append(args, "-i", target.Key)
+	}
+
+	args = append(args, target.User+"@"+target.Host)
+	args = append(args, remote...)
+
+	return exec.Command("ssh", args...)
+}
+
+// sshUser picks the user to log in as. --user wins over ssh_user in
+// ~/.matrix/config, otherwise it is worked out from the instance's image.
+func sshUser(ctx context.Context, cCtx *cli.Context, config map[string]string, instance Instance) string {
+	if user := cCtx.String("user"); user != "" {
+		return user
+	}
+
+	if user := config["ssh_user"]; user != "" {
+		return user
+	}
+
+	image := strings.ToLower(instance.Image)
+
+	// EC2 only gives the AMI ID so look up its name
+	if instance.Provider == ProviderEC2 {
+		image = strings.ToLower(getEC2ImageName(ctx, instance))
+	}
+
+	switch {
+	case strings.Contains(image, "ubuntu"):
+		return "ubuntu"
+	case strings.Contains(image, "bitnami"):
+		return "bitnami"
+	case strings.Contains(image, "debian"):
+		return "admin"
+	case strings.Contains(image, "centos"):
+		return "centos"
+	case strings.Contains(image, "amazon") || strings.Contains(image, "amzn"):
+		return "ec2-user"
+	}
+
+	// Lightsail's app blueprints (wordpress, lamp...) are all Bitnami images
+	if instance.Provider == ProviderLightsail {
+		return "bitnami"
+	}
+
+	return "ec2-user"
+}
+
+// getEC2ImageName returns the name of the AMI an instance was launched from,
+// or nothing if it can't be looked up
+func getEC2ImageName(ctx context.Context, instance Instance) string {
+	if instance.Image == "" {
+		return ""
+	}
+
+	client, err := newAWSClient(ctx, instance.Profile, instance.Region)
+	if err != nil {
+		return ""
+	}
+
+	out, err := client.EC2.DescribeImages(ctx, &ec2.DescribeImagesInput{ImageIds: []string{instance.Image}})
+	if err != nil || len(out.Images) == 0 {
+		return ""
+	}
+
+	image := out.Images[0]
+
+	return valueOr(aws.ToString(image.Name), aws.ToString(image.Description))
+}
+
+// sshKey picks the private key to log in with. --identity wins over ssh_key in
+// ~/.matrix/config, otherwise it is the key pair's .pem in ssh_key_dir
+// (default ~/.ssh). Nothing is returned if there is no such file.
+func sshKey(cCtx *cli.Context, config map[string]string, instance Instance) string {
+	if key := cCtx.String("identity"); key != "" {
+		return key
+	}
+
+	if key := config["ssh_key"]; key != "" {
+		return expandHome(key)
+	}
+
+	keyDir := expandHome(valueOr(config["ssh_key_dir"], "~/.ssh"))
+
+	name := instance.KeyName
+
+	// Lightsail's default key pair downloads as LightsailDefaultKey-<region>.pem
+	if instance.Provider == ProviderLightsail && (name == "" || name == "LightsailDefaultKeyPair") {
+		name = "LightsailDefaultKey-" + instance.Region
+	}
+
+	if name == "" {
+		return ""
+	}
+
+	for _, file := range []string{name + ".pem", name} {
+		if path := filepath.Join(keyDir, file); fileExists(path) {
+			return path
+		}
+	}
+
+	return ""
+}
+
+// expandHome expands a leading ~ to $HOME
+func expandHome(path string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		return os.Getenv("HOME") + path[1:]
+	}
+
+	return path
+}
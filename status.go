@@ -1,33 +1,124 @@
 package main
 
 import (
+	"context"
 	"os/exec"
+	"strings"
 
 	"github.com/fatih/color"
 )
 
-func status() {
-	color.Magenta("Matrix CLI Status")
+// ToolCheck is the result of checking one of the tools matrix relies on
+type ToolCheck struct {
+	Name      string `json:"name"`
+	Command   string `json:"command"`
+	Installed bool   `json:"installed"`
+	Output    string `json:"output,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
 
-	// Check if Git is installed
-	runCommand(exec.Command("git", "--version"), true, false, false)
+type StatusResult struct {
+	Tools []ToolCheck `json:"tools"`
+	OK    bool        `json:"ok"`
+}
 
-	color.Green("✓ Git is installed")
+func status() error {
+	color.Magenta("Matrix CLI Status")
 
-	// Check if DDEV is installed
-	runCommand(exec.Command("ddev", "--version"), true, false, false)
+	result := StatusResult{OK: true}
+	var missing []string
 
-	color.Green("✓ DDEV is installed")
+	for _, tool := range []struct {
+		name    string
+		cmd     *exec.Cmd
+		success string
+	}{
+		// Check if Git is installed
+		{"git", exec.Command("git", "--version"), "Git is installed"},
+		// Check if DDEV is installed
+		{"ddev", exec.Command("ddev", "--version"), "DDEV is installed"},
+		// Check if Github CLI (gh) is installed and authed
+		{"gh", exec.Command("gh", "auth", "status"), "GitHub CLI is installed and authed"},
+	} {
+		check := checkTool(tool.name, tool.cmd, tool.success)
+		result.Tools = append(result.Tools, check)
 
-	// Check if Github CLI (gh) is installed and authed
-	runCommand(exec.Command("gh", "auth", "status"), true, false, false)
+		if !check.Installed {
+			missing = append(missing, tool.name)
+		}
+	}
 
-	color.Green("✓ GitHub CLI is installed and authed")
+	// Check if AWS is authed
+	check := checkAWS()
+	result.Tools = append(result.Tools, check)
 
-	// TODO: Check if AWS CLI (aws) is installed and authed
-	runCommand(exec.Command("aws", "--version"), true, false, false)
+	if !check.Installed {
+		missing = append(missing, "aws")
+	}
 
-	color.Green("✓ AWS CLI is installed and authed")
+	if len(missing) > 0 {
+		result.OK = false
+		printResult(result)
+
+		return newError(ErrToolNotInstalled, strings.Join(missing, ", "), nil)
+	}
 
 	color.Green("✓ Completed: Matrix CLI Status")
+
+	return printResult(result)
+}
+
+// checkTool runs a read-only version/auth check and reports the result
+func checkTool(name string, cmd *exec.Cmd, success string) ToolCheck {
+	check := ToolCheck{Name: name, Command: cmd.String()}
+
+	color.White("Running: " + cmd.String())
+
+	out, err := executor.Lookup(cmd)
+	if err != nil {
+		color.Red("× Error Running: " + cmd.String())
+		color.Red("× " + err.Error())
+
+		check.Error = commandError(ErrToolNotInstalled, cmd, err).Error()
+
+		return check
+	}
+
+	printCommandOutput(out)
+
+	color.Green("✓ " + success)
+
+	check.Installed = true
+	check.Output = strings.TrimSpace(string(out))
+
+	return check
+}
+
+// checkAWS checks the matrix AWS profile has working credentials
+func checkAWS() ToolCheck {
+	check := ToolCheck{Name: "aws", Command: "sts get-caller-identity --profile " + AWSProfile}
+
+	color.White("Checking: AWS credentials for profile " + AWSProfile)
+
+	ctx := context.Background()
+
+	client, err := newAWSClient(ctx, AWSProfile, "")
+	if err == nil {
+		check.Output, err = checkAWSAuth(ctx, client)
+	}
+
+	if err != nil {
+		color.Red("× " + err.Error())
+
+		check.Error = err.Error()
+
+		return check
+	}
+
+	color.White(check.Output)
+	color.Green("✓ AWS is authed")
+
+	check.Installed = true
+
+	return check
 }
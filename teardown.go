@@ -0,0 +1,593 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/lightsail"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/fatih/color"
+	"github.com/urfave/cli/v2"
+)
+
+// TeardownPlan is everything in AWS and GitHub that belongs to a project
+type TeardownPlan struct {
+	Instances  []Instance         `json:"instances"`
+	StaticIPs  []StaticIP         `json:"staticIps"`
+	Volumes    []Volume           `json:"volumes"`
+	Parameters []ProjectParameter `json:"parameters"`
+	Domains    []DNSRecord        `json:"domains"`
+	DeployKeys []GitHubDeployKey  `json:"deployKeys"`
+	Backups    []BackupSet        `json:"backups"`
+	Skipped    map[string]string  `json:"skipped,omitempty"`
+}
+
+// ProjectParameter is an SSM parameter under /matrix/{project}/
+type ProjectParameter struct {
+	Name    string `json:"name"`
+	Region  string `json:"region"`
+	Profile string `json:"profile"`
+}
+
+// GitHubDeployKey is a deploy key matrix deploy added to a repo
+type GitHubDeployKey struct {
+	ID    int64  `json:"id"`
+	Title string `json:"title"`
+	Repo  string `json:"repo"`
+}
+
+// TeardownResult is the result of matrix teardown
+type TeardownResult struct {
+	Project string         `json:"project"`
+	Plan    TeardownPlan   `json:"plan"`
+	Backup  []BackupUpload `json:"backup,omitempty"`
+	DryRun  bool           `json:"dryRun,omitempty"`
+}
+
+func teardown(cCtx *cli.Context) error {
+	ProjectName = cCtx.Args().First()
+	if ProjectName == "" {
+		return newError(ErrMissingProjectName, "", nil)
+	}
+
+	ctx := context.Background()
+
+	color.Magenta("Looking for everything " + ProjectName + " left in AWS")
+
+	plan, err := planTeardown(ctx, cCtx)
+	if err != nil {
+		return err
+	}
+
+	printTeardownPlan(plan)
+
+	if len(plan.Instances)+len(plan.StaticIPs)+len(plan.Volumes)+len(plan.Parameters)+len(plan.Domains)+len(plan.DeployKeys) == 0 {
+		color.Green("✓ Nothing to tear down")
+
+		return printResult(TeardownResult{Project: ProjectName, Plan: plan, DryRun: dryRun})
+	}
+
+	// The last chance to get the site back, so it has to work before anything
+	// is deleted
+	running := []Instance{}
+	for _, instance := range plan.Instances {
+		if instance.State == "running" {
+			running = append(running, instance)
+		}
+	}
+
+	backup := !cCtx.Bool("skip-backup") && len(plan.Instances) > 0
+
+	if backup && len(running) != 1 {
+		return newError(ErrConfig, "a final backup needs "+ProjectName+" to be running on one instance, it is on "+strconv.Itoa(len(running))+". Start it or use --skip-backup", nil)
+	}
+
+	// Nothing changes in a dry run so there is nothing to confirm
+	if !dryRun && !cCtx.Bool("yes") {
+		if err := confirmName("This will delete everything above and can't be undone.", ProjectName); err != nil {
+			return err
+		}
+	}
+
+	result := TeardownResult{Project: ProjectName, Plan: plan, DryRun: dryRun}
+
+	// With the instances gone there is nothing left to back up
+	if backup {
+		if result.Backup, err = finalBackup(ctx, cCtx, running[0]); err != nil {
+			return err
+		}
+	}
+
+	if err := runTeardown(ctx, cCtx, plan); err != nil {
+		return err
+	}
+
+	if !dryRun {
+		color.Green("✓ Completed: Tore down " + ProjectName)
+	}
+
+	return printResult(result)
+}
+
+// planTeardown finds the project's instances by name or matrix:project tag,
+// and everything else that was created for them
+func planTeardown(ctx context.Context, cCtx *cli.Context) (TeardownPlan, error) {
+	plan := TeardownPlan{Skipped: map[string]string{}}
+
+	inventory, err := getInventory(ctx, cCtx, true)
+	if err != nil {
+		return plan, err
+	}
+
+	ips := []string{}
+
+	for _, instance := range inventory.Instances {
+		if instance.Name != ProjectName && instance.Tags["matrix:project"] != ProjectName || instance.State == "terminated" || instance.State == "shutting-down" {
+			continue
+		}
+
+		plan.Instances = append(plan.Instances, instance)
+
+		if instance.PublicIP != "" {
+			ips = append(ips, instance.PublicIP)
+		}
+	}
+
+	for _, staticIP := range inventory.StaticIPs {
+		if staticIP.Name == ProjectName+"-ip" || staticIP.AttachedTo == ProjectName {
+			plan.StaticIPs = append(plan.StaticIPs, staticIP)
+		}
+	}
+
+	// Volumes attached to the instances mostly go with them, but ones kept on
+	// termination and ones left behind by earlier instances don't. deploy tags
+	// them with the project at launch.
+	for _, volume := range inventory.Volumes {
+		if volume.Name != ProjectName && volume.Tags["matrix:project"] != ProjectName {
+			continue
+		}
+
+		attached := slices.ContainsFunc(plan.Instances, func(instance Instance) bool { return instance.ID == volume.InstanceID })
+
+		if volume.InstanceID == "" || attached && !volume.DeleteOnTermination {
+			plan.Volumes = append(plan.Volumes, volume)
+		}
+	}
+
+	// Parameters are kept in the deploy region, and wherever the project has
+	// been deployed since
+	config, err := loadDeployConfig(cCtx)
+	if err != nil {
+		return plan, err
+	}
+
+	targets := []InventoryTarget{{Profile: config.Profile, Region: config.Region}}
+	for _, instance := range plan.Instances {
+		targets = append(targets, InventoryTarget{Profile: instance.Profile, Region: instance.Region})
+	}
+
+	seen := map[string]bool{}
+
+	for _, target := range targets {
+		client, err := newAWSClient(ctx, target.Profile, target.Region)
+		if err != nil {
+			return plan, err
+		}
+
+		if seen[client.Profile+" "+client.Region] {
+			continue
+		}
+
+		seen[client.Profile+" "+client.Region] = true
+
+		parameters, err := getProjectParameters(ctx, client)
+		if err != nil {
+			return plan, err
+		}
+
+		plan.Parameters = append(plan.Parameters, parameters...)
+	}
+
+	// Only records that point at nothing but the project are its own
+	domains := map[string]bool{}
+
+	for _, instance := range plan.Instances {
+		if instance.PublicIP == "" {
+			continue
+		}
+
+		client, err := dnsClient(ctx, cCtx, instance)
+		if err != nil {
+			return plan, err
+		}
+
+		records, err := listDNSRecords(ctx, client, instance.PublicIP)
+		if err != nil {
+			return plan, err
+		}
+
+		for _, record := range records {
+			if domains[record.Domain] {
+				continue
+			}
+
+			ours := true
+			for _, value := range record.Values {
+				if !slices.Contains(ips, value) {
+					ours = false
+				}
+			}
+
+			if !ours {
+				plan.Skipped[record.Domain] = "also points at " + strings.Join(record.Values, ", ")
+
+				continue
+			}
+
+			domains[record.Domain] = true
+			plan.Domains = append(plan.Domains, record)
+		}
+	}
+
+	plan.DeployKeys, err = getGitHubDeployKeys(cCtx)
+	if err != nil {
+		plan.Skipped["GitHub deploy key"] = err.Error()
+	}
+
+	// Backups go in the bucket matrix backup uses
+	backupClient, err := newAWSClient(ctx, AWSProfile, "")
+	if err != nil {
+		return plan, err
+	}
+
+	plan.Backups, err = listBackupSets(ctx, backupClient)
+	if err != nil {
+		plan.Skipped["s3://"+ProjectName] = err.Error()
+	}
+
+	return plan, nil
+}
+
+// getProjectParameters lists the project's SSM parameters: its deploy key and
+// environment variables
+func getProjectParameters(ctx context.Context, client *AWSClient) ([]ProjectParameter, error) {
+	parameters := []ProjectParameter{}
+
+	paginator := ssm.NewGetParametersByPathPaginator(client.SSM, &ssm.GetParametersByPathInput{
+		Path:      aws.String(projectParameter(ProjectName, "")),
+		Recursive: aws.Bool(true),
+	})
+
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, awsError("ssm get-parameters-by-path", err)
+		}
+
+		for _, parameter := range out.Parameters {
+			parameters = append(parameters, ProjectParameter{Name: aws.ToString(parameter.Name), Region: client.Region, Profile: client.Profile})
+		}
+	}
+
+	return parameters, nil
+}
+
+// getGitHubDeployKeys finds the deploy keys matrix deploy added for the
+// project, in the repo given with --repo or the current directory's
+func getGitHubDeployKeys(cCtx *cli.Context) ([]GitHubDeployKey, error) {
+	repo := cCtx.String("repo")
+
+	if repo == "" {
+		cmd := exec.Command("git", "config", "--get", "remote.origin.url")
+		out, err := executor.Lookup(cmd)
+		if err != nil {
+			return nil, newError(ErrConfig, "no GitHub repo, run teardown in the project or use --repo", nil)
+		}
+
+		if repo, err = githubRepoFromRemote(string(out)); err != nil {
+			return nil, err
+		}
+	}
+
+	cmd := exec.Command("gh", "api", "repos/"+repo+"/keys")
+	out, err := executor.Lookup(cmd)
+	if err != nil {
+		return nil, commandError(ErrGitHub, cmd, err)
+	}
+
+	var keys []GitHubDeployKey
+	if err := json.Unmarshal(out, &keys); err != nil {
+		return nil, newError(ErrGitHub, "reading deploy keys of "+repo, err)
+	}
+
+	found := []GitHubDeployKey{}
+
+	for _, key := range keys {
+		if key.Title == "matrix "+ProjectName {
+			key.Repo = repo
+			found = append(found, key)
+		}
+	}
+
+	return found, nil
+}
+
+func printTeardownPlan(plan TeardownPlan) {
+	sections := []struct {
+		Title string
+		Lines []string
+	}{
+		{Title: "Instances to terminate:"},
+		{Title: "Static IPs to release:"},
+		{Title: "Volumes to delete:"},
+		{Title: "SSM parameters to delete:"},
+		{Title: "DNS records to delete:"},
+		{Title: "GitHub deploy keys to remove:"},
+	}
+
+	for _, instance := range plan.Instances {
+		sections[0].Lines = append(sections[0].Lines, instance.Name+" ("+instance.Provider+" "+instance.ID+", "+instance.State+", "+instance.Region+", profile "+valueOr(instance.Profile, "-")+")")
+	}
+
+	for _, staticIP := range plan.StaticIPs {
+		sections[1].Lines = append(sections[1].Lines, staticIP.Name+" ("+staticIP.IP+", "+staticIP.Region+")")
+	}
+
+	for _, volume := range plan.Volumes {
+		sections[2].Lines = append(sections[2].Lines, volume.ID+" ("+strconv.Itoa(int(volume.SizeGB))+" GB, "+volume.Region+")")
+	}
+
+	for _, parameter := range plan.Parameters {
+		sections[3].Lines = append(sections[3].Lines, parameter.Name+" ("+parameter.Region+")")
+	}
+
+	for _, record := range plan.Domains {
+		sections[4].Lines = append(sections[4].Lines, record.Domain+" ("+record.Provider+" zone "+record.Zone+")")
+	}
+
+	for _, key := range plan.DeployKeys {
+		sections[5].Lines = append(sections[5].Lines, key.Title+" ("+key.Repo+")")
+	}
+
+	for _, section := range sections {
+		if len(section.Lines) == 0 {
+			continue
+		}
+
+		color.Magenta(section.Title)
+		for _, line := range section.Lines {
+			color.White("  - " + line)
+		}
+	}
+
+	color.Magenta("Kept:")
+	color.White("  - " + strconv.Itoa(len(plan.Backups)) + " backups in s3://" + ProjectName + "/backups/")
+	color.White("  - Deploy history")
+
+	for _, name := range sortedKeys(plan.Skipped) {
+		color.Yellow("  - Left alone, " + name + ": " + plan.Skipped[name])
+	}
+}
+
+// finalBackup dumps the database and archives the files on instance, and
+// uploads them to the project's bucket the way matrix backup does
+func finalBackup(ctx context.Context, cCtx *cli.Context, instance Instance) ([]BackupUpload, error) {
+	config, err := loadDeployConfig(cCtx)
+	if err != nil {
+		return nil, err
+	}
+
+	historyClient, err := newAWSClient(ctx, config.Profile, config.Region)
+	if err != nil {
+		return nil, err
+	}
+
+	// The type it was deployed as, as teardown isn't necessarily run in the
+	// project
+	projectType := config.Bootstrap.Type
+	if records, err := loadDeployHistory(ctx, historyClient, config.History, ProjectName); err == nil && len(records) > 0 {
+		projectType = valueOr(records[len(records)-1].Type, projectType)
+	}
+
+	target, err := sshTarget(ctx, cCtx, instance)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := newAWSClient(ctx, AWSProfile, "")
+	if err != nil {
+		return nil, err
+	}
+
+	settings, err := loadSettings(cCtx)
+	if err != nil {
+		return nil, err
+	}
+
+	encryption, err := loadBackupEncryption(settings, client)
+	if err != nil {
+		return nil, err
+	}
+
+	color.Magenta("Taking a final backup of " + ProjectName + " from " + instance.Name)
+
+	backupFileName := ProjectName + "-" + time.Now().Format(backupTimeFormat)
+
+	// Archived the same way as matrix backup so they are restored the same way
+	archives := map[string]string{
+		backupFileName + ".tar.gz": "set -e\ncd " + deployDir + "\n" +
+			"tar --warning=no-file-changed -czf - --exclude=./web/cpresources --exclude=./storage/runtime --exclude=./vendor --exclude=./.git . || [ $? -eq 1 ]\n",
+	}
+
+	if dump := dbBackupCommand(projectType, dbBackupDir+"/"+ProjectName+".sql"); dump != "" {
+		archives[backupFileName+".sql.gz"] = "set -e\nmkdir -p -m 700 " + dbBackupDir + "\ncd " + deployDir + "\n" +
+			dump + " >&2\n" +
+			"gzip -c " + dbBackupDir + "/" + ProjectName + ".sql\n" +
+			"rm -f " + dbBackupDir + "/" + ProjectName + ".sql\n"
+	} else {
+		color.Yellow("× Not backing up the database of " + valueOr(projectType, "this") + " project, only craft and wordpress are")
+	}
+
+	uploads := []BackupUpload{}
+
+	for _, archive := range sortedKeys(archives) {
+		upload := newBackupUpload(archive)
+
+		cmd := target.command([]string{"BatchMode=yes"}, []string{"sudo", "bash", "-s"})
+		cmd.Stdin = strings.NewReader(archives[archive])
+		cmd.Stderr = os.Stderr
+
+		// Streamed straight from the server to S3, nothing is written locally
+		err := streamBackup(ctx, client, &upload, cmd.Args, newBackupProgress(archive, 0), encryption, func(w io.Writer) error {
+			cmd.Stdout = w
+
+			if err := executor.Run(cmd); err != nil {
+				return commandError(ErrCommandFailed, cmd, err)
+			}
+
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		uploads = append(uploads, upload)
+	}
+
+	if !dryRun {
+		color.Green("✓ Completed: Final backup uploaded to s3://" + ProjectName + "/backups/")
+	}
+
+	return uploads, nil
+}
+
+// runTeardown deletes everything in the plan, stopping at the first failure
+// so teardown can be run again to pick up where it left off
+func runTeardown(ctx context.Context, cCtx *cli.Context, plan TeardownPlan) error {
+	for _, record := range plan.Domains {
+		instance := plan.Instances[0]
+		for _, candidate := range plan.Instances {
+			if slices.Contains(record.Values, candidate.PublicIP) {
+				instance = candidate
+			}
+		}
+
+		client, err := dnsClient(ctx, cCtx, instance)
+		if err != nil {
+			return err
+		}
+
+		if err := deleteDNSRecord(ctx, client, record); err != nil {
+			return err
+		}
+	}
+
+	for _, instance := range plan.Instances {
+		client, err := newAWSClient(ctx, instance.Profile, instance.Region)
+		if err != nil {
+			return err
+		}
+
+		state := "terminated"
+
+		if instance.Provider == ProviderLightsail {
+			state = instanceStateDeleted
+
+			err = awsChange([]string{"lightsail", "delete-instance", "--instance-name", instance.ID, "--profile", instance.Profile, "--region", instance.Region}, func() error {
+				_, err := client.Lightsail.DeleteInstance(ctx, &lightsail.DeleteInstanceInput{InstanceName: aws.String(instance.ID)})
+				return awsError("lightsail delete-instance", err)
+			})
+		} else {
+			err = awsChange([]string{"ec2", "terminate-instances", "--instance-ids", instance.ID, "--profile", instance.Profile, "--region", instance.Region}, func() error {
+				_, err := client.EC2.TerminateInstances(ctx, &ec2.TerminateInstancesInput{InstanceIds: []string{instance.ID}})
+				return awsError("ec2 terminate-instances", err)
+			})
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if dryRun {
+			continue
+		}
+
+		// Static IPs and volumes can only go once the instance has
+		if _, err := waitForInstanceState(ctx, client, instance, state, cCtx.Duration("timeout")); err != nil {
+			return err
+		}
+
+		color.Green("✓ Completed: " + instance.Name + " is " + state)
+	}
+
+	for _, staticIP := range plan.StaticIPs {
+		client, err := newAWSClient(ctx, staticIP.Profile, staticIP.Region)
+		if err != nil {
+			return err
+		}
+
+		err = awsChange([]string{"lightsail", "release-static-ip", "--static-ip-name", staticIP.Name, "--profile", staticIP.Profile, "--region", staticIP.Region}, func() error {
+			_, err := client.Lightsail.ReleaseStaticIp(ctx, &lightsail.ReleaseStaticIpInput{StaticIpName: aws.String(staticIP.Name)})
+			return awsError("lightsail release-static-ip", err)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, volume := range plan.Volumes {
+		client, err := newAWSClient(ctx, volume.Profile, volume.Region)
+		if err != nil {
+			return err
+		}
+
+		err = awsChange([]string{"ec2", "delete-volume", "--volume-id", volume.ID, "--profile", volume.Profile, "--region", volume.Region}, func() error {
+			_, err := client.EC2.DeleteVolume(ctx, &ec2.DeleteVolumeInput{VolumeId: aws.String(volume.ID)})
+			return awsError("ec2 delete-volume", err)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// DeleteParameters takes at most 10 names at a time, in one region
+	for start := 0; start < len(plan.Parameters); {
+		first := plan.Parameters[start]
+
+		names := []string{}
+		for ; start < len(plan.Parameters) && len(names) < 10 && plan.Parameters[start].Profile == first.Profile && plan.Parameters[start].Region == first.Region; start++ {
+			names = append(names, plan.Parameters[start].Name)
+		}
+
+		client, err := newAWSClient(ctx, first.Profile, first.Region)
+		if err != nil {
+			return err
+		}
+
+		err = awsChange(append(append([]string{"ssm", "delete-parameters", "--names"}, names...), "--profile", first.Profile, "--region", first.Region), func() error {
+			_, err := client.SSM.DeleteParameters(ctx, &ssm.DeleteParametersInput{Names: names})
+			return awsError("ssm delete-parameters", err)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, key := range plan.DeployKeys {
+		cmd := exec.Command("gh", "api", "--method", "DELETE", "repos/"+key.Repo+"/keys/"+strconv.FormatInt(key.ID, 10))
+		if err := executor.Run(cmd); err != nil {
+			return commandError(ErrGitHub, cmd, err)
+		}
+	}
+
+	return nil
+}
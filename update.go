@@ -6,12 +6,16 @@ import (
 	"github.com/fatih/color"
 )
 
-func update() {
+func update() error {
 	color.Magenta("Self Updating Matrix CLI")
 
-	runCommand(exec.Command("go", "install", "github.com/MatrixCreate/matrix@latest"), false, false, true)
+	if err := runCommand(exec.Command("go", "install", "github.com/MatrixCreate/matrix@latest"), false, false, true); err != nil {
+		return err
+	}
 
 	color.Magenta("--------------------------------------------------")
 	color.Magenta("🎉            UPDATE COMPLETE                   🎉")
 	color.Magenta("--------------------------------------------------")
+
+	return printResult(ActionResult{Action: "update", DryRun: dryRun})
 }